@@ -0,0 +1,398 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hrystynaa/lab4-go/dbclient"
+)
+
+var ErrNoQuorum = errors.New("quorum not reached")
+
+// DefaultTimeout limits the requests to the replicas.
+const DefaultTimeout = 10 * time.Second
+
+// Quorum is the number of replicas of every key, N, and how many of them
+// must answer a read, R, and acknowledge a write, W. With R+W > N every read
+// sees the last acknowledged write.
+type Quorum struct {
+	N int `json:"n"`
+	R int `json:"r"`
+	W int `json:"w"`
+}
+
+// DefaultQuorum returns the majority quorums for n replicas.
+func DefaultQuorum(n int) Quorum {
+	return Quorum{N: n, R: n/2 + 1, W: n/2 + 1}
+}
+
+func (q Quorum) validate(nodes int) error {
+	if q.N < 1 || q.N > nodes {
+		return fmt.Errorf("bad number of replicas %d for %d nodes", q.N, nodes)
+	}
+	if q.R < 1 || q.R > q.N || q.W < 1 || q.W > q.N {
+		return fmt.Errorf("bad quorums R=%d W=%d for %d replicas", q.R, q.W, q.N)
+	}
+	return nil
+}
+
+// Replicated stores every key on the N nodes which follow it on the ring.
+// Writes are sent to all of them and succeed after W acknowledgements, reads
+// ask all of them and return the newest of the first R answers. The replicas
+// which answered with an older value or none are repaired in background.
+// Writes which were not acknowledged in time still go on in background, a
+// replica missed by a write is only repaired by a later read.
+type Replicated struct {
+	ring    *Ring
+	nodes   map[string]*dbclient.Client
+	quorum  Quorum
+	timeout time.Duration
+	clock   clock
+	pending sync.WaitGroup
+	repairs atomic.Int64
+}
+
+type Option func(rp *Replicated) error
+
+// WithTimeout limits every request to a replica, including the ones which
+// go on after a quorum has answered.
+func WithTimeout(d time.Duration) Option {
+	return func(rp *Replicated) error {
+		if d <= 0 {
+			return fmt.Errorf("bad timeout %s", d)
+		}
+		rp.timeout = d
+		return nil
+	}
+}
+
+func NewReplicated(ring *Ring, nodes map[string]*dbclient.Client, q Quorum, opts ...Option) (*Replicated, error) {
+	if err := q.validate(len(ring.Nodes())); err != nil {
+		return nil, err
+	}
+	for _, node := range ring.Nodes() {
+		if nodes[node] == nil {
+			return nil, fmt.Errorf("no client of node %s", node)
+		}
+	}
+	rp := &Replicated{
+		ring:    ring,
+		nodes:   nodes,
+		quorum:  q,
+		timeout: DefaultTimeout,
+	}
+	for _, opt := range opts {
+		if err := opt(rp); err != nil {
+			return nil, err
+		}
+	}
+	return rp, nil
+}
+
+func (rp *Replicated) Quorum() Quorum {
+	return rp.quorum
+}
+
+// Repairs returns the number of stale replicas written by read repair.
+func (rp *Replicated) Repairs() int64 {
+	return rp.repairs.Load()
+}
+
+// Wait waits for the replica requests which still run after a quorum has
+// answered, including the read repairs.
+func (rp *Replicated) Wait() {
+	rp.pending.Wait()
+}
+
+type reply struct {
+	node  string
+	value Versioned
+	found bool
+	err   error
+}
+
+// ask sends a request to every replica of the key and returns the channel of
+// their replies. The requests don't stop with the caller, so the replicas
+// which answer late are still written and repaired, they are only limited
+// by the timeout.
+func (rp *Replicated) ask(key string, request func(ctx context.Context, c *dbclient.Client) reply) (<-chan reply, int) {
+	owners := rp.ring.Owners(key, rp.quorum.N)
+	replies := make(chan reply, len(owners))
+	for _, node := range owners {
+		rp.pending.Add(1)
+		go func(node string) {
+			defer rp.pending.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), rp.timeout)
+			defer cancel()
+			r := request(ctx, rp.nodes[node])
+			r.node = node
+			replies <- r
+		}(node)
+	}
+	return replies, len(owners)
+}
+
+// await collects the replies until need of them succeed. It returns the
+// successful replies and how many replies were received.
+func await(ctx context.Context, replies <-chan reply, total, need int) ([]reply, int, error) {
+	var ok []reply
+	var failed []error
+	for received := 1; ; received++ {
+		select {
+		case <-ctx.Done():
+			return nil, received - 1, ctx.Err()
+		case r := <-replies:
+			if r.err != nil {
+				failed = append(failed, fmt.Errorf("node %s: %w", r.node, r.err))
+			} else {
+				ok = append(ok, r)
+			}
+			if len(ok) == need {
+				return ok, received, nil
+			}
+			if len(failed) > total-need {
+				return nil, received, fmt.Errorf("%w: %d of %d replicas answered, %d needed: %w", ErrNoQuorum, len(ok), total, need, failed[0])
+			}
+		}
+	}
+}
+
+// newest returns the newest value of the replies, false if no replica has
+// the key.
+func newest(replies []reply) (Versioned, bool) {
+	var v Versioned
+	found := false
+	for _, r := range replies {
+		if r.found && (!found || r.value.newer(v)) {
+			v, found = r.value, true
+		}
+	}
+	return v, found
+}
+
+// readReplica is the request of a read.
+func readReplica(key string) func(ctx context.Context, c *dbclient.Client) reply {
+	return func(ctx context.Context, c *dbclient.Client) reply {
+		raw, err := c.Get(ctx, key)
+		if errors.Is(err, dbclient.ErrNotFound) {
+			return reply{}
+		} else if err != nil {
+			return reply{err: err}
+		}
+		v, err := DecodeVersioned(raw)
+		if err != nil {
+			return reply{err: fmt.Errorf("%s: %w", key, err)}
+		}
+		return reply{value: v, found: true}
+	}
+}
+
+func (rp *Replicated) read(ctx context.Context, key string) (Versioned, bool, error) {
+	replies, total := rp.ask(key, readReplica(key))
+	ok, received, err := await(ctx, replies, total, rp.quorum.R)
+	if err != nil {
+		return Versioned{}, false, err
+	}
+	v, found := newest(ok)
+
+	rp.pending.Add(1)
+	go func() {
+		defer rp.pending.Done()
+		all := ok
+		for ; received < total; received++ {
+			if r := <-replies; r.err == nil {
+				all = append(all, r)
+			}
+		}
+		rp.repair(key, all)
+	}()
+	return v, found, nil
+}
+
+// repair writes the newest value to the replicas which answered with an
+// older one or none.
+func (rp *Replicated) repair(key string, replies []reply) {
+	v, found := newest(replies)
+	if !found {
+		return
+	}
+	for _, r := range replies {
+		if r.found && !v.newer(r.value) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), rp.timeout)
+		err := rp.nodes[r.node].PutVersion(ctx, key, v.Encode(), v.Version)
+		cancel()
+		if err == nil {
+			rp.repairs.Add(1)
+		}
+	}
+}
+
+func (rp *Replicated) write(ctx context.Context, key string, v Versioned) error {
+	replies, total := rp.ask(key, func(ctx context.Context, c *dbclient.Client) reply {
+		err := c.PutVersion(ctx, key, v.Encode(), v.Version)
+		if errors.Is(err, dbclient.ErrStaleVersion) {
+			// The replica has a newer write, which wins.
+			err = nil
+		}
+		return reply{err: err}
+	})
+	_, _, err := await(ctx, replies, total, rp.quorum.W)
+	return err
+}
+
+// Get returns the newest value of the key or dbclient.ErrNotFound.
+func (rp *Replicated) Get(ctx context.Context, key string) (string, error) {
+	v, found, err := rp.read(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if !found || v.Deleted {
+		return "", dbclient.ErrNotFound
+	}
+	return v.Value, nil
+}
+
+func (rp *Replicated) Put(ctx context.Context, key, value string) error {
+	return rp.write(ctx, key, Versioned{Version: rp.clock.next(), Value: value})
+}
+
+// Delete writes a tombstone of the key or returns dbclient.ErrNotFound if a
+// read quorum does not have it.
+func (rp *Replicated) Delete(ctx context.Context, key string) error {
+	v, found, err := rp.read(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !found || v.Deleted {
+		return dbclient.ErrNotFound
+	}
+	return rp.write(ctx, key, Versioned{Version: rp.clock.next(), Deleted: true})
+}
+
+// ScanPage returns up to limit records of the keys with the prefix which
+// follow the key after, with the newest value found on any node. Every node
+// must answer. The deleted keys are skipped, the nodes are read further
+// until the page is full.
+func (rp *Replicated) ScanPage(ctx context.Context, prefix, after string, limit int) ([]dbclient.Record, string, error) {
+	var records []dbclient.Record
+	for {
+		values, keys, more, err := rp.scanNodes(ctx, prefix, after, limit)
+		if err != nil {
+			return nil, "", err
+		}
+		for i, key := range keys {
+			v := values[key]
+			if v.Deleted {
+				continue
+			}
+			records = append(records, dbclient.Record{Key: key, Value: v.Value})
+			if len(records) == limit {
+				if more || i < len(keys)-1 {
+					return records, key, nil
+				}
+				return records, "", nil
+			}
+		}
+		if !more || len(keys) == 0 {
+			return records, "", nil
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+// scanNodes returns the newest values of up to limit keys with the prefix
+// which follow the key after, in key order, and whether more keys follow.
+func (rp *Replicated) scanNodes(ctx context.Context, prefix, after string, limit int) (map[string]Versioned, []string, bool, error) {
+	values := make(map[string]Versioned)
+	more := false
+	for _, node := range rp.ring.Nodes() {
+		records, next, err := rp.nodes[node].ScanPage(ctx, prefix, after, limit)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("node %s: %w", node, err)
+		}
+		more = more || next != ""
+		for _, r := range records {
+			v, err := DecodeVersioned(r.Value)
+			if err != nil {
+				return nil, nil, false, fmt.Errorf("node %s: %s: %w", node, r.Key, err)
+			}
+			if cur, ok := values[r.Key]; !ok || v.newer(cur) {
+				values[r.Key] = v
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys, more = keys[:limit], true
+	}
+	return values, keys, more, nil
+}
+
+// CollectTombstones removes the tombstones written more than grace ago from
+// the nodes. A tombstone is removed only once every replica of the key has
+// it, so that no replica is left with an older value which read repair
+// would bring back. The replicas which miss it are repaired, so it is
+// removed by a later run. The grace period must outlast the writes which go
+// on in background. It returns the number of removed tombstones.
+func (rp *Replicated) CollectTombstones(ctx context.Context, grace time.Duration) (int, error) {
+	before := uint64(time.Now().Add(-grace).UnixNano())
+	old := make(map[string]bool)
+	for _, node := range rp.ring.Nodes() {
+		err := rp.nodes[node].Scan(ctx, "", func(key, raw string) error {
+			if v, err := DecodeVersioned(raw); err == nil && v.Deleted && v.Version < before {
+				old[key] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("node %s: %w", node, err)
+		}
+	}
+
+	collected := 0
+	for key := range old {
+		replies, total := rp.ask(key, readReplica(key))
+		all, _, err := await(ctx, replies, total, total)
+		if err != nil {
+			// The tombstone is kept until every replica answers.
+			continue
+		}
+		v, _ := newest(all)
+		if !v.Deleted || v.Version >= before {
+			continue
+		}
+		everywhere := true
+		for _, r := range all {
+			everywhere = everywhere && r.found && r.value == v
+		}
+		if !everywhere {
+			rp.repair(key, all)
+			continue
+		}
+		removed := true
+		for _, r := range all {
+			err := rp.nodes[r.node].DeleteVersion(ctx, key, v.Version)
+			// A newer write or another collector won.
+			if err != nil && !errors.Is(err, dbclient.ErrStaleVersion) && !errors.Is(err, dbclient.ErrNotFound) {
+				return collected, fmt.Errorf("node %s: %s: %w", r.node, key, err)
+			}
+			removed = removed && err == nil
+		}
+		if removed {
+			collected++
+		}
+	}
+	return collected, nil
+}
@@ -0,0 +1,147 @@
+// Package cluster partitions keys across db nodes.
+package cluster
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// DefaultVirtualNodes is the number of points a node gets on the ring.
+const DefaultVirtualNodes = 128
+
+type point struct {
+	hash uint32
+	node string
+}
+
+// Ring assigns keys to nodes by consistent hashing: adding a node moves only
+// the keys it takes over. A Ring is immutable, so it is safe for concurrent
+// use.
+type Ring struct {
+	vnodes int
+	nodes  []string
+	points []point
+}
+
+// hash is FNV-1a mixed with the MurmurHash3 finalizer, as plain FNV spreads
+// similar names such as node#1 and node#2 poorly.
+func hash(s string) uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return uint32(x)
+}
+
+// NewRing returns the ring of the nodes, each placed at vnodes points.
+func NewRing(vnodes int, nodes ...string) (*Ring, error) {
+	if vnodes < 1 {
+		return nil, fmt.Errorf("bad number of virtual nodes %d", vnodes)
+	}
+	r := &Ring{vnodes: vnodes}
+	for _, node := range nodes {
+		var err error
+		if r, err = r.With(node); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// With returns a copy of the ring with the node added.
+func (r *Ring) With(node string) (*Ring, error) {
+	if node == "" {
+		return nil, fmt.Errorf("empty node name")
+	}
+	if r.Has(node) {
+		return nil, fmt.Errorf("node %s is already in the ring", node)
+	}
+	next := &Ring{
+		vnodes: r.vnodes,
+		nodes:  append(append([]string(nil), r.nodes...), node),
+		points: append([]point(nil), r.points...),
+	}
+	for i := 0; i < r.vnodes; i++ {
+		next.points = append(next.points, point{hash(fmt.Sprintf("%s#%d", node, i)), node})
+	}
+	sort.Slice(next.points, func(i, j int) bool {
+		a, b := next.points[i], next.points[j]
+		// Ties are broken by name so every router builds the same ring.
+		return a.hash < b.hash || a.hash == b.hash && a.node < b.node
+	})
+	return next, nil
+}
+
+func (r *Ring) Has(node string) bool {
+	return contains(r.nodes, node)
+}
+
+// Nodes returns the nodes in the order they were added.
+func (r *Ring) Nodes() []string {
+	return append([]string(nil), r.nodes...)
+}
+
+func (r *Ring) VirtualNodes() int {
+	return r.vnodes
+}
+
+// Owner returns the node of the key, the empty string if the ring is empty.
+func (r *Ring) Owner(key string) string {
+	owners := r.Owners(key, 1)
+	if len(owners) == 0 {
+		return ""
+	}
+	return owners[0]
+}
+
+// Owners returns up to n distinct nodes which follow the key on the ring,
+// the owner first.
+func (r *Ring) Owners(key string, n int) []string {
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	if n <= 0 {
+		return nil
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	owners := make([]string, 0, n)
+	for len(owners) < n {
+		node := r.points[i%len(r.points)].node
+		if !contains(owners, node) {
+			owners = append(owners, node)
+		}
+		i++
+	}
+	return owners
+}
+
+// Shares returns the part of the hash space owned by every node.
+func (r *Ring) Shares() map[string]float64 {
+	shares := make(map[string]float64, len(r.nodes))
+	for i, p := range r.points {
+		// A point owns the hashes after the previous point, the first one
+		// also owns the hashes after the last point.
+		prev := r.points[(i+len(r.points)-1)%len(r.points)].hash
+		size := p.hash - prev
+		if len(r.points) == 1 {
+			size = 1<<32 - 1
+		}
+		shares[p.node] += float64(size) / (1 << 32)
+	}
+	return shares
+}
+
+func contains(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package cluster
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	if _, err := NewRing(0, "a"); err == nil {
+		t.Error("Expected an error for no virtual nodes")
+	}
+	if _, err := NewRing(8, "a", "a"); err == nil {
+		t.Error("Expected an error for a duplicate node")
+	}
+	empty, err := NewRing(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := empty.Owner("key"); owner != "" {
+		t.Errorf("Expected no owner in an empty ring, got %s", owner)
+	}
+
+	r, err := NewRing(DefaultVirtualNodes, "a", "b", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	owners := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owners[key] = r.Owner(key)
+		counts[owners[key]]++
+	}
+	for _, node := range r.Nodes() {
+		if counts[node] < 600 {
+			t.Errorf("Node %s owns only %d of 3000 keys", node, counts[node])
+		}
+	}
+
+	var total float64
+	for _, share := range r.Shares() {
+		total += share
+	}
+	if math.Abs(total-1) > 1e-6 {
+		t.Errorf("Expected the shares to add up to 1, got %f", total)
+	}
+
+	grown, err := r.With("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Has("d") || !grown.Has("d") {
+		t.Error("With must not change the original ring")
+	}
+	for key, owner := range owners {
+		if next := grown.Owner(key); next != owner && next != "d" {
+			t.Errorf("Key %s moved from %s to %s instead of the new node", key, owner, next)
+		}
+	}
+
+	same, _ := NewRing(DefaultVirtualNodes, "a", "b", "c", "d")
+	if grown.Owner("some key") != same.Owner("some key") {
+		t.Error("Expected the owner to not depend on the order nodes are added")
+	}
+}
+
+func TestRing_Owners(t *testing.T) {
+	r, err := NewRing(16, "a", "b", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := r.Owners("key", 2)
+	if len(owners) != 2 || owners[0] != r.Owner("key") || owners[0] == owners[1] {
+		t.Errorf("Unexpected owners %v", owners)
+	}
+	all := r.Owners("key", 5)
+	if len(all) != 3 || !reflect.DeepEqual(all[:2], owners) {
+		t.Errorf("Expected all the nodes starting with the owners, got %v", all)
+	}
+	if owners := r.Owners("key", 0); owners != nil {
+		t.Errorf("Expected no owners, got %v", owners)
+	}
+}
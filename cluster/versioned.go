@@ -0,0 +1,62 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Versioned is the value of a key on a replica, with the version given by
+// the coordinator which wrote it. Deletes are stored as tombstones so that
+// read repair can't bring the value back.
+type Versioned struct {
+	Version uint64 `json:"version"`
+	Value   string `json:"value,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+func (v Versioned) Encode() string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func DecodeVersioned(s string) (Versioned, error) {
+	var v Versioned
+	if err := json.Unmarshal([]byte(s), &v); err != nil || v.Version == 0 {
+		return Versioned{}, fmt.Errorf("not a versioned value")
+	}
+	return v, nil
+}
+
+// newer reports whether v wins over other. Equal versions are ordered by
+// the content, so every replica settles on the same value.
+func (v Versioned) newer(other Versioned) bool {
+	if v.Version != other.Version {
+		return v.Version > other.Version
+	}
+	if v.Deleted != other.Deleted {
+		return v.Deleted
+	}
+	return v.Value > other.Value
+}
+
+// clock hands out versions: the wall time in nanoseconds, made greater than
+// any version handed out before. The last writer wins, so the clocks of
+// the coordinators must be kept in sync.
+type clock struct {
+	last atomic.Uint64
+}
+
+func (c *clock) next() uint64 {
+	for {
+		last := c.last.Load()
+		now := uint64(time.Now().UnixNano())
+		if now <= last {
+			now = last + 1
+		}
+		if c.last.CompareAndSwap(last, now) {
+			return now
+		}
+	}
+}
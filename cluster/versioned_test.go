@@ -0,0 +1,58 @@
+package cluster
+
+import (
+	"testing"
+)
+
+func TestVersioned(t *testing.T) {
+	v := Versioned{Version: 5, Value: `{"a":1}`}
+	decoded, err := DecodeVersioned(v.Encode())
+	if err != nil || decoded != v {
+		t.Errorf("Unexpected decoded value %+v %v", decoded, err)
+	}
+	for _, s := range []string{"plain", `{"value":"v"}`, ""} {
+		if _, err := DecodeVersioned(s); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+
+	older := Versioned{Version: 4, Value: "z"}
+	tombstone := Versioned{Version: 5, Deleted: true}
+	if !v.newer(older) || older.newer(v) {
+		t.Error("Expected the greater version to win")
+	}
+	if !tombstone.newer(v) || v.newer(tombstone) {
+		t.Error("Expected the tombstone to win at the same version")
+	}
+	if v.newer(v) {
+		t.Error("Expected a value not to be newer than itself")
+	}
+
+	var c clock
+	last := c.next()
+	for i := 0; i < 1000; i++ {
+		next := c.next()
+		if next <= last {
+			t.Fatalf("Expected increasing versions, got %d after %d", next, last)
+		}
+		last = next
+	}
+}
+
+func TestQuorum(t *testing.T) {
+	if q := DefaultQuorum(3); q != (Quorum{N: 3, R: 2, W: 2}) {
+		t.Errorf("Unexpected default quorum %+v", q)
+	}
+	for _, q := range []Quorum{{N: 0, R: 1, W: 1}, {N: 4, R: 1, W: 1}, {N: 3, R: 0, W: 2}, {N: 3, R: 2, W: 4}} {
+		if err := q.validate(3); err == nil {
+			t.Errorf("Expected an error for %+v", q)
+		}
+	}
+	ring, err := NewRing(8, "http://a", "http://b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewReplicated(ring, nil, DefaultQuorum(2)); err == nil {
+		t.Error("Expected an error for nodes without clients")
+	}
+}
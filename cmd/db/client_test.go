@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hrystynaa/lab4-go/datastore"
+	"github.com/hrystynaa/lab4-go/dbclient"
+)
+
+func TestClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := datastore.NewDb(dir, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	server := httptest.NewServer(testHandler(db))
+	defer server.Close()
+
+	c, err := dbclient.New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.Put(ctx, "a key/with?escapes", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.Get(ctx, "a key/with?escapes"); err != nil || value != "v1" {
+		t.Errorf("Unexpected value %q, %v", value, err)
+	}
+	if _, err := c.Get(ctx, "missing"); !errors.Is(err, dbclient.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if err := c.Delete(ctx, "missing"); !errors.Is(err, dbclient.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if err := c.Put(ctx, "", "v"); !errors.Is(err, dbclient.ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey, got %v", err)
+	}
+
+	err = c.Batch(ctx, []dbclient.Op{
+		{Key: "user:1", Value: "a"},
+		{Key: "user:2", Value: "b"},
+		{Key: "a key/with?escapes", Delete: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := c.MGet(ctx, "user:1", "user:2", "a key/with?escapes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, map[string]string{"user:1": "a", "user:2": "b"}) {
+		t.Errorf("Unexpected values %v", values)
+	}
+
+	expected := []string{"user:1", "user:2"}
+	for i := 0; i < 250; i++ {
+		key := fmt.Sprintf("user:x%03d", i)
+		if err := c.Put(ctx, key, "v"); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, key)
+	}
+	var keys []string
+	err = c.Scan(ctx, "user:", func(key, value string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %d keys in order, got %d", len(expected), len(keys))
+	}
+
+	events := make(chan dbclient.Event)
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		done <- c.Watch(watchCtx, "user:", func(e dbclient.Event) error {
+			events <- e
+			return nil
+		})
+	}()
+	// Writes are repeated until the watcher sees one, as the stream may not
+	// be open yet.
+	var event dbclient.Event
+	for event.Key == "" {
+		if err := c.Put(ctx, "user:1", "watched"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case event = <-events:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if event.Key != "user:1" || event.Value != "watched" || event.Deleted {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	stopWatch()
+	for {
+		select {
+		case <-events:
+			continue
+		case err := <-done:
+			if err != context.Canceled {
+				t.Errorf("Expected the watch to stop with the context, got %v", err)
+			}
+		}
+		break
+	}
+}
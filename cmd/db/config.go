@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hrystynaa/lab4-go/datastore"
+)
+
+const envPrefix = "DB_"
+
+// config is the configuration of cmd/db. It is read from the JSON file given
+// by -config or DB_CONFIG, then overridden by the DB_* environment variables
+// and finally by the flags.
+type config struct {
+	Listen              string `json:"listen"`
+	DataDir             string `json:"data_dir"`
+	Engine              string `json:"engine"`
+	SegmentSize         int64  `json:"segment_size"`
+	CompactionThreshold int    `json:"compaction_threshold"`
+	CompactionDelay     string `json:"compaction_delay"`
+	Sync                string `json:"sync"`
+	CacheSize           int64  `json:"cache_size"`
+	Index               string `json:"index"`
+	Restore             string `json:"restore"`
+	RESPPort            int    `json:"resp_port"`
+	MemcachePort        int    `json:"memcache_port"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		Listen:              ":8083",
+		DataDir:             "data",
+		Engine:              "hash",
+		SegmentSize:         10 << 20,
+		CompactionThreshold: 3,
+		CompactionDelay:     "1s",
+		Sync:                "none",
+	}
+}
+
+// setting is a configuration value which can be set by a flag and by the
+// environment variable DB_ followed by the flag name in upper snake case.
+type setting struct {
+	name  string
+	usage string
+	set   func(c *config, value string) error
+}
+
+var settings = []setting{
+	{"listen", "HTTP listen address", func(c *config, v string) error { c.Listen = v; return nil }},
+	{"data-dir", "directory of the data files", func(c *config, v string) error { c.DataDir = v; return nil }},
+	{"engine", "storage engine: hash, lsm or memory", func(c *config, v string) error { c.Engine = v; return nil }},
+	{"segment-size", "segment size in bytes, the memtable size of the lsm engine", func(c *config, v string) (err error) { c.SegmentSize, err = strconv.ParseInt(v, 10, 64); return }},
+	{"compaction-threshold", "number of segments which triggers compaction, 0 disables it (hash engine)", func(c *config, v string) (err error) { c.CompactionThreshold, err = strconv.Atoi(v); return }},
+	{"compaction-delay", "how long compaction waits after it is triggered (hash engine)", func(c *config, v string) error { c.CompactionDelay = v; return nil }},
+	{"sync", "none, always to sync every write, or a sync interval such as 100ms (hash engine)", func(c *config, v string) error { c.Sync = v; return nil }},
+	{"cache-size", "value cache size in bytes, 0 disables it (hash engine)", func(c *config, v string) (err error) { c.CacheSize, err = strconv.ParseInt(v, 10, 64); return }},
+	{"index", "comma separated JSON fields of values to index (hash engine)", func(c *config, v string) error { c.Index = v; return nil }},
+	{"restore", "tar archive from /admin/backup to restore into an empty data directory (hash engine)", func(c *config, v string) error { c.Restore = v; return nil }},
+	{"resp-port", "port of the Redis protocol listener, 0 disables it", func(c *config, v string) (err error) { c.RESPPort, err = strconv.Atoi(v); return }},
+	{"memcache-port", "port of the memcached protocol listener, 0 disables it", func(c *config, v string) (err error) { c.MemcachePort, err = strconv.Atoi(v); return }},
+}
+
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadConfig builds the configuration from the config file, the environment
+// and the command line arguments, in increasing priority, and validates it.
+func loadConfig(args []string, getenv func(string) string) (*config, error) {
+	fs := flag.NewFlagSet("db", flag.ContinueOnError)
+	configPath := fs.String("config", getenv(envPrefix+"CONFIG"), "JSON configuration file")
+	// The flags are applied after the file and the environment.
+	var flags []func(c *config) error
+	for _, s := range settings {
+		s := s
+		usage := fmt.Sprintf("%s (%s)", s.usage, envName(s.name))
+		fs.Func(s.name, usage, func(value string) error {
+			flags = append(flags, func(c *config) error {
+				if err := s.set(c, value); err != nil {
+					return fmt.Errorf("bad -%s: %w", s.name, err)
+				}
+				return nil
+			})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := defaultConfig()
+	if *configPath != "" {
+		if err := c.readFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range settings {
+		if value := getenv(envName(s.name)); value != "" {
+			if err := s.set(c, value); err != nil {
+				return nil, fmt.Errorf("bad %s: %w", envName(s.name), err)
+			}
+		}
+	}
+	for _, set := range flags {
+		if err := set(c); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("bad config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// syncInterval parses the sync mode. It returns false if writes are not
+// synced.
+func (c *config) syncInterval() (time.Duration, bool, error) {
+	switch c.Sync {
+	case "none":
+		return 0, false, nil
+	case "always":
+		return 0, true, nil
+	}
+	d, err := time.ParseDuration(c.Sync)
+	if err != nil || d <= 0 {
+		return 0, false, fmt.Errorf("bad sync %q: must be none, always or a positive interval", c.Sync)
+	}
+	return d, true, nil
+}
+
+func (c *config) validate() error {
+	if c.Listen == "" {
+		return fmt.Errorf("empty listen address")
+	}
+	switch c.Engine {
+	case "hash", "lsm":
+		if c.DataDir == "" {
+			return fmt.Errorf("empty data directory")
+		}
+	case "memory":
+	default:
+		return fmt.Errorf("unknown engine %s", c.Engine)
+	}
+	if c.Restore != "" && c.Engine != "hash" {
+		return fmt.Errorf("restore is supported only by the hash engine")
+	}
+	if c.SegmentSize <= 0 {
+		return fmt.Errorf("bad segment size %d", c.SegmentSize)
+	}
+	if c.CompactionThreshold < 0 || c.CompactionThreshold == 1 {
+		return fmt.Errorf("bad compaction threshold %d: must be 0 or at least 2", c.CompactionThreshold)
+	}
+	if d, err := time.ParseDuration(c.CompactionDelay); err != nil || d < 0 {
+		return fmt.Errorf("bad compaction delay %q", c.CompactionDelay)
+	}
+	if _, _, err := c.syncInterval(); err != nil {
+		return err
+	}
+	if c.CacheSize < 0 {
+		return fmt.Errorf("bad cache size %d", c.CacheSize)
+	}
+	for _, port := range []int{c.RESPPort, c.MemcachePort} {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("bad port %d", port)
+		}
+	}
+	return nil
+}
+
+// options returns the options of the hash engine.
+func (c *config) options() []datastore.Option {
+	delay, _ := time.ParseDuration(c.CompactionDelay)
+	opts := []datastore.Option{
+		datastore.WithCompactionThreshold(c.CompactionThreshold),
+		datastore.WithCompactionDelay(delay),
+	}
+	if interval, ok, _ := c.syncInterval(); ok {
+		opts = append(opts, datastore.WithSync(interval))
+	}
+	if c.CacheSize > 0 {
+		opts = append(opts, datastore.WithCache(c.CacheSize))
+	}
+	if c.Index != "" {
+		opts = append(opts, datastore.WithSecondaryIndex(strings.Split(c.Index, ",")...))
+	}
+	return opts
+}
+
+func (c *config) String() string {
+	data, _ := json.Marshal(c)
+	return string(data)
+}
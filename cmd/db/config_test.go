@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db.json")
+	err = os.WriteFile(path, []byte(`{"data_dir":"/var/db","segment_size":1024,"sync":"always","cache_size":100}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"DB_CONFIG":       path,
+		"DB_SEGMENT_SIZE": "2048",
+		"DB_LISTEN":       ":9000",
+	}
+
+	c, err := loadConfig([]string{"-listen", "127.0.0.1:9001", "-compaction-threshold", "0"}, func(name string) string {
+		return env[name]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := *defaultConfig()
+	expected.DataDir = "/var/db"
+	expected.SegmentSize = 2048
+	expected.Sync = "always"
+	expected.CacheSize = 100
+	expected.Listen = "127.0.0.1:9001"
+	expected.CompactionThreshold = 0
+	if *c != expected {
+		t.Errorf("Expected %s, got %s", &expected, c)
+	}
+	if n := len(c.options()); n != 4 {
+		t.Errorf("Expected 4 options, got %d", n)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"-segment-size", "0"}, "bad segment size"},
+		{[]string{"-segment-size", "big"}, "bad -segment-size"},
+		{[]string{"-engine", "btree"}, "unknown engine"},
+		{[]string{"-sync", "sometimes"}, "bad sync"},
+		{[]string{"-compaction-threshold", "1"}, "bad compaction threshold"},
+		{[]string{"-compaction-delay", "soon"}, "bad compaction delay"},
+		{[]string{"-engine", "lsm", "-restore", "backup.tar"}, "only by the hash engine"},
+		{[]string{"-resp-port", "70000"}, "bad port"},
+		{[]string{"-config", filepath.Join(dir, "missing.json")}, "no such file"},
+	} {
+		_, err := loadConfig(tc.args, func(string) string { return "" })
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: expected an error with %q, got %v", tc.args, tc.err, err)
+		}
+	}
+
+	if _, err := loadConfig(nil, func(name string) string {
+		return map[string]string{"DB_CACHE_SIZE": "lots"}[name]
+	}); err == nil || !strings.Contains(err.Error(), "DB_CACHE_SIZE") {
+		t.Errorf("Expected an error for the environment variable, got %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"segment":1}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig([]string{"-config", path}, func(string) string { return "" }); err == nil {
+		t.Error("Expected an error for an unknown field of the config file")
+	}
+}
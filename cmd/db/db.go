@@ -1,84 +1,96 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"flag"
-	"io/ioutil"
+	"fmt"
 	"log"
-	"net/http"
+	"net"
+	"os"
 
 	"github.com/hrystynaa/lab4-go/datastore"
 	"github.com/hrystynaa/lab4-go/httptools"
 	"github.com/hrystynaa/lab4-go/signal"
 )
 
-var port = flag.Int("port", 8083, "server port")
+func restoreBackup(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return datastore.RestoreBackup(f, dir)
+}
 
-type Request struct {
-	Value string `json:"value"`
+func openStore(c *config) (datastore.Store, error) {
+	if c.Engine == "memory" {
+		return datastore.NewMemStore(), nil
+	}
+	if err := os.MkdirAll(c.DataDir, 0o755); err != nil {
+		return nil, err
+	}
+	switch c.Engine {
+	case "hash":
+		if c.Restore != "" {
+			if err := restoreBackup(c.Restore, c.DataDir); err != nil {
+				return nil, err
+			}
+		}
+		return datastore.NewDb(c.DataDir, c.SegmentSize, c.options()...)
+	case "lsm":
+		return datastore.NewLSM(c.DataDir, c.SegmentSize)
+	default:
+		return nil, fmt.Errorf("unknown engine %s", c.Engine)
+	}
 }
 
-type Response struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+// listen starts serving the protocol on the port in the background.
+func listen(name string, port int, serve func(net.Listener) error) net.Listener {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%s listener on port %d", name, port)
+	go func() {
+		if err := serve(l); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("%s listener stopped: %s", name, err)
+		}
+	}()
+	return l
 }
 
 func main() {
-	flag.Parse()
-	h := new(http.ServeMux)
-
-	dir, err := ioutil.TempDir("", "temp-dir")
-	if err != nil {
+	c, err := loadConfig(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
 		log.Fatal(err)
 	}
-	db, err := datastore.NewDb(dir, 500)
+	log.Printf("Configuration: %s", c)
+
+	db, err := openStore(c)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
-	h.HandleFunc("/db/", func(rw http.ResponseWriter, req *http.Request) {
-		key := req.URL.Path[len("/db/"):]
-
-		switch req.Method {
-		case http.MethodGet:
-			value, err := db.Get(key)
-			if err != nil {
-				rw.WriteHeader(http.StatusNotFound)
-				return
-			}
-			// resp := Response{
-			// 	Key:   key,
-			// 	Value: value,
-			// }
-			rw.Header().Set("Content-Type", "application/json")
-			rw.WriteHeader(http.StatusOK)
-			_ = json.NewEncoder(rw).Encode(Response{
-				Key:   key,
-				Value: value,
-			})
-
-		case http.MethodPost:
-			var body Request
-			err := json.NewDecoder(req.Body).Decode(&body)
-			if err != nil {
-				rw.WriteHeader(http.StatusBadRequest)
-				return
-			}
-
-			err = db.Put(key, body.Value)
-			if err != nil {
-				rw.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			rw.WriteHeader(http.StatusCreated)
-
-		default:
-			rw.WriteHeader(http.StatusBadRequest)
-		}
-	})
-
-	server := httptools.CreateServer(*port, h)
+	exp := newExpirer(db)
+	if err := exp.load(); err != nil {
+		log.Fatal(err)
+	}
+	server := httptools.CreateServerOn(c.Listen, newHandler(db, exp))
 	server.Start()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go exp.sweep(stop)
+	if c.RESPPort != 0 {
+		l := listen("Redis protocol", c.RESPPort, newRESPServer(db, exp).Serve)
+		defer l.Close()
+	}
+	if c.MemcachePort != 0 {
+		l := listen("memcached protocol", c.MemcachePort, newMemcacheServer(db, exp).Serve)
+		defer l.Close()
+	}
 	signal.WaitForTerminationSignal()
 }
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+var (
+	errNotJSON      = errors.New("value is not a JSON document")
+	errBadPointer   = errors.New("bad JSON pointer")
+	errPathNotFound = errors.New("path does not exist")
+	errBadPatch     = errors.New("bad patch")
+	errPatchFailed  = errors.New("patch can't be applied")
+)
+
+// decodeJSON parses a single JSON value keeping numbers as written.
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	return doc, nil
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w %q", errBadPointer, pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index token which must be at most max.
+func arrayIndex(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || strconv.Itoa(i) != token {
+		return 0, fmt.Errorf("%w: bad array index %q", errBadPointer, token)
+	}
+	if i > max {
+		return 0, fmt.Errorf("%w: index %d", errPathNotFound, i)
+	}
+	return i, nil
+}
+
+func getPath(doc interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			child, ok := d[token]
+			if !ok {
+				return nil, fmt.Errorf("%w: %q", errPathNotFound, token)
+			}
+			doc = child
+		case []interface{}:
+			i, err := arrayIndex(token, len(d)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, fmt.Errorf("%w: %q", errPathNotFound, token)
+		}
+	}
+	return doc, nil
+}
+
+// addPath adds the value at the path as the JSON Patch add operation does
+// and returns the changed document.
+func addPath(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	token, last := tokens[0], len(tokens) == 1
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		if last {
+			d[token] = value
+			return d, nil
+		}
+		child, ok := d[token]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", errPathNotFound, token)
+		}
+		child, err := addPath(child, tokens[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		d[token] = child
+		return d, nil
+	case []interface{}:
+		if last {
+			i := len(d)
+			if token != "-" {
+				var err error
+				if i, err = arrayIndex(token, len(d)); err != nil {
+					return nil, err
+				}
+			}
+			d = append(d, nil)
+			copy(d[i+1:], d[i:])
+			d[i] = value
+			return d, nil
+		}
+		i, err := arrayIndex(token, len(d)-1)
+		if err != nil {
+			return nil, err
+		}
+		if d[i], err = addPath(d[i], tokens[1:], value); err != nil {
+			return nil, err
+		}
+		return d, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", errPathNotFound, token)
+	}
+}
+
+// removePath removes the value at the path and returns the changed document.
+func removePath(doc interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%w: can't remove the whole document", errBadPatch)
+	}
+	token, last := tokens[0], len(tokens) == 1
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		child, ok := d[token]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", errPathNotFound, token)
+		}
+		if last {
+			delete(d, token)
+			return d, nil
+		}
+		child, err := removePath(child, tokens[1:])
+		if err != nil {
+			return nil, err
+		}
+		d[token] = child
+		return d, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(d)-1)
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			return append(d[:i], d[i+1:]...), nil
+		}
+		if d[i], err = removePath(d[i], tokens[1:]); err != nil {
+			return nil, err
+		}
+		return d, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", errPathNotFound, token)
+	}
+}
+
+// mergePatch applies a JSON Merge Patch (RFC 7386) to the target.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+		} else {
+			t[key] = mergePatch(t[key], value)
+		}
+	}
+	return t
+}
+
+// patchOperation is an operation of a JSON Patch (RFC 6902) document.
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+func parseJSONPatch(data []byte) ([]patchOperation, error) {
+	var ops []patchOperation
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return nil, fmt.Errorf("%w: %s", errBadPatch, err)
+	}
+	for _, op := range ops {
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("%w: %s without a value", errBadPatch, op.Op)
+			}
+		case "remove", "move", "copy":
+		default:
+			return nil, fmt.Errorf("%w: unknown operation %q", errBadPatch, op.Op)
+		}
+	}
+	return ops, nil
+}
+
+// jsonPatch applies the operations in order. Any failed operation fails the
+// whole patch.
+func jsonPatch(doc interface{}, ops []patchOperation) (interface{}, error) {
+	for _, op := range ops {
+		var err error
+		doc, err = applyOperation(doc, op)
+		if errors.Is(err, errPathNotFound) {
+			return nil, fmt.Errorf("%w: %s %s: %s", errPatchFailed, op.Op, op.Path, err)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+func applyOperation(doc interface{}, op patchOperation) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if op.Value != nil {
+		if value, err = decodeJSON(op.Value); err != nil {
+			return nil, fmt.Errorf("%w: %s", errBadPatch, err)
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return addPath(doc, path, value)
+	case "remove":
+		return removePath(doc, path)
+	case "replace":
+		if _, err := getPath(doc, path); err != nil {
+			return nil, err
+		}
+		if len(path) > 0 {
+			if doc, err = removePath(doc, path); err != nil {
+				return nil, err
+			}
+		}
+		return addPath(doc, path, value)
+	case "test":
+		current, err := getPath(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equalJSON(current, value) {
+			return nil, fmt.Errorf("%w: test %s failed", errPatchFailed, op.Path)
+		}
+		return doc, nil
+	}
+
+	// move and copy
+	from, err := parsePointer(op.From)
+	if err != nil {
+		return nil, err
+	}
+	value, err = getPath(doc, from)
+	if err != nil {
+		return nil, err
+	}
+	if op.Op == "move" {
+		if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+			return nil, fmt.Errorf("%w: can't move %s into itself", errBadPatch, op.From)
+		}
+		if doc, err = removePath(doc, from); err != nil {
+			return nil, err
+		}
+	} else {
+		value = copyJSON(value)
+	}
+	return addPath(doc, path, value)
+}
+
+func copyJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			res[key] = copyJSON(value)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, value := range v {
+			res[i] = copyJSON(value)
+		}
+		return res
+	}
+	return v
+}
+
+// encodeJSON formats a decoded JSON value without escaping HTML characters.
+func encodeJSON(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// equalJSON compares decoded JSON values, numbers by their value.
+func equalJSON(a, b interface{}) bool {
+	an, aok := a.(json.Number)
+	bn, bok := b.(json.Number)
+	if aok && bok {
+		af, aerr := an.Float64()
+		bf, berr := bn.Float64()
+		return aerr == nil && berr == nil && af == bf
+	}
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !equalJSON(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equalJSON(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// documentPatch changes a decoded JSON document.
+type documentPatch func(doc interface{}) (interface{}, error)
+
+// parsePatch parses a JSON Merge Patch or a JSON Patch depending on the
+// media type.
+func parsePatch(mediaType string, data []byte) (documentPatch, error) {
+	switch mediaType {
+	case mergePatchType:
+		p, err := decodeJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errBadPatch, err)
+		}
+		return func(doc interface{}) (interface{}, error) {
+			return mergePatch(doc, p), nil
+		}, nil
+	case jsonPatchType:
+		ops, err := parseJSONPatch(data)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc interface{}) (interface{}, error) {
+			return jsonPatch(doc, ops)
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: unsupported media type %q", errBadPatch, mediaType)
+}
+
+// applyPatch applies the patch to the document stored as the value.
+func applyPatch(value string, patch documentPatch) (string, error) {
+	doc, err := decodeJSON([]byte(value))
+	if err != nil {
+		return "", errNotJSON
+	}
+	if doc, err = patch(doc); err != nil {
+		return "", err
+	}
+	return encodeJSON(doc)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParsePointer(t *testing.T) {
+	tokens, err := parsePointer("/a~1b/m~0n/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a/b", "m~n", "0"}; !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("Unexpected tokens %q", tokens)
+	}
+	if tokens, err := parsePointer(""); err != nil || len(tokens) != 0 {
+		t.Errorf("Expected the whole document for an empty pointer, got %q %v", tokens, err)
+	}
+	if _, err := parsePointer("a"); !errors.Is(err, errBadPointer) {
+		t.Errorf("Expected errBadPointer, got %v", err)
+	}
+}
+
+func TestGetPath(t *testing.T) {
+	doc, err := decodeJSON([]byte(`{"foo":["bar","baz"],"":0,"a/b":1,"m~n":8,"n":{"x":null}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"":       `{"":0,"a/b":1,"foo":["bar","baz"],"m~n":8,"n":{"x":null}}`,
+		"/foo":   `["bar","baz"]`,
+		"/foo/0": `"bar"`,
+		"/":      `0`,
+		"/a~1b":  `1`,
+		"/m~0n":  `8`,
+		"/n/x":   `null`,
+	}
+	for pointer, expected := range cases {
+		tokens, err := parsePointer(pointer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := getPath(doc, tokens)
+		if err != nil {
+			t.Fatalf("Cannot get %q: %s", pointer, err)
+		}
+		if got, _ := encodeJSON(value); got != expected {
+			t.Errorf("Bad value of %q: expected %s, got %s", pointer, expected, got)
+		}
+	}
+	for _, pointer := range []string{"/missing", "/foo/2", "/foo/0/x"} {
+		tokens, _ := parsePointer(pointer)
+		if _, err := getPath(doc, tokens); !errors.Is(err, errPathNotFound) {
+			t.Errorf("Expected errPathNotFound for %q, got %v", pointer, err)
+		}
+	}
+	tokens, _ := parsePointer("/foo/01")
+	if _, err := getPath(doc, tokens); !errors.Is(err, errBadPointer) {
+		t.Errorf("Expected errBadPointer for a leading zero, got %v", err)
+	}
+}
+
+func TestApplyPatch_Merge(t *testing.T) {
+	patch, err := parsePatch(mergePatchType, []byte(`{"title":"Hello!","phoneNumber":"+01-123-456-7890","author":{"familyName":null},"tags":["example"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := applyPatch(`{"title":"Goodbye!","author":{"givenName":"John","familyName":"Doe"},"tags":["example","sample"],"content":"This will be unchanged"}`, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"author":{"givenName":"John"},"content":"This will be unchanged","phoneNumber":"+01-123-456-7890","tags":["example"],"title":"Hello!"}`
+	if res != expected {
+		t.Errorf("Unexpected result %s", res)
+	}
+}
+
+func TestApplyPatch_JSONPatch(t *testing.T) {
+	cases := []struct {
+		doc, patch, expected string
+		err                  error
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`, nil},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`, nil},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc"]}]`, `{"foo":["bar",["abc"]]}`, nil},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`, nil},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`, nil},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`, nil},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, nil},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`, nil},
+		{`{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`, `{"a":{"b":1},"c":{"b":2}}`, nil},
+		{`{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`, `{"baz":"qux","foo":["a",2,"c"]}`, nil},
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, ``, errPatchFailed},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, ``, errPatchFailed},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"/missing","value":1}]`, ``, errPatchFailed},
+		{`{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/x"}]`, ``, errBadPatch},
+		{`not json`, `[]`, ``, errNotJSON},
+	}
+	for _, c := range cases {
+		patch, err := parsePatch(jsonPatchType, []byte(c.patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := applyPatch(c.doc, patch)
+		if c.err != nil {
+			if !errors.Is(err, c.err) {
+				t.Errorf("Expected %v patching %s with %s, got %v", c.err, c.doc, c.patch, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Cannot patch %s with %s: %s", c.doc, c.patch, err)
+		}
+		if res != c.expected {
+			t.Errorf("Bad result of %s: expected %s, got %s", c.patch, c.expected, res)
+		}
+	}
+
+	for _, patch := range []string{`{}`, `[{"op":"bad","path":"/"}]`, `[{"op":"add","path":"/a"}]`} {
+		if _, err := parsePatch(jsonPatchType, []byte(patch)); !errors.Is(err, errBadPatch) {
+			t.Errorf("Expected errBadPatch for %s, got %v", patch, err)
+		}
+	}
+}
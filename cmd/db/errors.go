@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/hrystynaa/lab4-go/datastore"
+	"github.com/hrystynaa/lab4-go/dbclient"
+)
+
+const (
+	maxRequestID  = 128
+	versionHeader = "X-Version"
+	// maxBodySize leaves room for the JSON escaping of the largest value.
+	maxBodySize = 2 * datastore.MaxValueSize
+)
+
+// Error codes of dbclient.ErrorResponse.
+const (
+	codeBadRequest           = "bad_request"
+	codeInvalidKey           = "invalid_key"
+	codeNotFound             = "not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeTooLarge             = "too_large"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeConflict             = "conflict"
+	codeStaleVersion         = "stale_version"
+	codeNotJSON              = "not_json"
+	codeNotImplemented       = "not_implemented"
+	codeCorrupted            = "corrupted_record"
+	codeStorage              = "storage_error"
+)
+
+var errStaleVersion = errors.New("a newer version is stored")
+
+// writeStoreError tells missing keys and rejected records from corrupted
+// data and other storage failures.
+func writeStoreError(rw http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, datastore.ErrNotFound):
+		dbclient.WriteError(rw, http.StatusNotFound, codeNotFound, err.Error())
+	case errors.Is(err, datastore.ErrKeyTooLarge):
+		dbclient.WriteError(rw, http.StatusBadRequest, codeInvalidKey, err.Error())
+	case errors.Is(err, datastore.ErrValueTooLarge):
+		dbclient.WriteError(rw, http.StatusRequestEntityTooLarge, codeTooLarge, err.Error())
+	case errors.Is(err, datastore.ErrCorruptedRecord):
+		dbclient.WriteError(rw, http.StatusInternalServerError, codeCorrupted, err.Error())
+	default:
+		dbclient.WriteError(rw, http.StatusInternalServerError, codeStorage, err.Error())
+	}
+}
+
+// writeBodyError reports a request body which can't be read or decoded.
+func writeBodyError(rw http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		dbclient.WriteError(rw, http.StatusRequestEntityTooLarge, codeTooLarge, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+		return
+	}
+	dbclient.WriteError(rw, http.StatusBadRequest, codeBadRequest, "bad request body: "+err.Error())
+}
+
+// decodeBody decodes the JSON request body and writes the error response if
+// it fails.
+func decodeBody(rw http.ResponseWriter, req *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(req.Body).Decode(v); err != nil {
+		writeBodyError(rw, err)
+		return false
+	}
+	return true
+}
+
+// incrSuffix ends the path of POST /db/{key}/incr, so a key ending with it
+// can't be put with POST /db/{key} and is written with /db/_batch instead.
+const incrSuffix = "/incr"
+
+// reservedKey reports the key names taken by the requests on several keys.
+func reservedKey(key string) bool {
+	return key == "_mget" || key == "_batch" || key == "_watch"
+}
+
+// validKey writes the error response for empty, oversized and reserved keys,
+// including the metadata keys.
+func validKey(rw http.ResponseWriter, key string) bool {
+	if key == "" {
+		dbclient.WriteError(rw, http.StatusBadRequest, codeInvalidKey, "empty key")
+		return false
+	}
+	if reservedKey(key) {
+		dbclient.WriteError(rw, http.StatusBadRequest, codeInvalidKey, fmt.Sprintf("key %q is reserved", key))
+		return false
+	}
+	if err := checkKey(key); err != nil {
+		dbclient.WriteError(rw, http.StatusBadRequest, codeInvalidKey, err.Error())
+		return false
+	}
+	return true
+}
+
+// methodNotAllowed writes the 405 response listing the allowed methods.
+func methodNotAllowed(rw http.ResponseWriter, req *http.Request, allowed ...string) {
+	rw.Header().Set("Allow", strings.Join(allowed, ", "))
+	dbclient.WriteError(rw, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Sprintf("method %s is not allowed", req.Method))
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(id)
+}
+
+// withRequests tags every request with an id, taken from the X-Request-Id
+// header or generated, and limits the request body size.
+func withRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(dbclient.RequestIDHeader)
+		if id == "" || len(id) > maxRequestID {
+			id = newRequestID()
+		}
+		rw.Header().Set(dbclient.RequestIDHeader, id)
+		req.Body = http.MaxBytesReader(rw, req.Body, maxBodySize)
+		h.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hrystynaa/lab4-go/datastore"
+)
+
+const sweepInterval = 100 * time.Millisecond
+
+// expirer deletes keys from the store once their expiration time passes.
+// The times are set by the Redis and memcached listeners and stored in the
+// metadata of the keys, so they survive restarts, and a put through the HTTP
+// API, which replaces the metadata, removes them unless it carries the
+// metadata, as the router does when it moves keys. The HTTP API still
+// returns the expired keys until they are swept.
+//
+// Commands lock the keys they use with lockKeys or rlockKeys, so a key can't
+// expire between the check and the command, while commands on other keys go
+// on.
+type expirer struct {
+	db datastore.Store
+	mu sync.Mutex // guards deadlines
+	// deadlines holds the keys to sweep. A key may stay in it after its
+	// expiration time is removed, the sweep checks the stored one.
+	deadlines map[string]time.Time
+	now       func() time.Time
+}
+
+func newExpirer(db datastore.Store) *expirer {
+	return &expirer{
+		db:        db,
+		deadlines: make(map[string]time.Time),
+		now:       time.Now,
+	}
+}
+
+// load collects the stored expiration times, so the keys which got them
+// before a restart are swept.
+func (e *expirer) load() error {
+	return e.db.Scan(metaKeyPrefix, func(key, value string) error {
+		key = strings.TrimPrefix(key, metaKeyPrefix)
+		meta, err := decodeMeta(key, value)
+		if err != nil {
+			return err
+		}
+		e.track(key, meta.deadline())
+		return nil
+	})
+}
+
+// sweep periodically deletes the expired keys until stop is closed. The
+// keys are collected first and then deleted one by one, so commands only
+// wait for the deletes of their own keys.
+func (e *expirer) sweep(stop <-chan struct{}) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, key := range e.expiredKeys() {
+				unlock := lockKeys(key)
+				// The key is checked again, it may have been set since.
+				err := e.drop(key)
+				unlock()
+				if err != nil {
+					log.Printf("Cannot delete expired key %s: %s", key, err)
+				}
+			}
+		}
+	}
+}
+
+func (e *expirer) expiredKeys() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := e.now()
+	var keys []string
+	for key, deadline := range e.deadlines {
+		if !now.Before(deadline) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// passed reports whether the expiration time in the metadata has passed.
+func (e *expirer) passed(meta recordMeta) bool {
+	deadline := meta.deadline()
+	return !deadline.IsZero() && !e.now().Before(deadline)
+}
+
+// expired reports whether the key has passed its expiration time.
+func (e *expirer) expired(key string) (bool, error) {
+	meta, err := readMeta(e.db, key)
+	if err != nil {
+		return false, err
+	}
+	return e.passed(meta), nil
+}
+
+// drop deletes the key if it has expired. The caller must hold the lock of
+// the key.
+func (e *expirer) drop(key string) error {
+	meta, err := readMeta(e.db, key)
+	if err != nil {
+		return err
+	}
+	if !e.passed(meta) {
+		e.track(key, meta.deadline())
+		return nil
+	}
+	e.track(key, time.Time{})
+	if err := deleteValue(e.db, key); err != nil && err != datastore.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// expireAt stores the expiration time of the existing key, keeping the rest
+// of its metadata. The caller must hold the lock of the key.
+func (e *expirer) expireAt(key string, deadline time.Time) error {
+	meta, err := readMeta(e.db, key)
+	if err != nil {
+		return err
+	}
+	meta.setDeadline(deadline)
+	if err := e.db.Put(metaKey(key), encodeMeta(meta)); err != nil {
+		return err
+	}
+	e.track(key, deadline)
+	return nil
+}
+
+// track adds the key to the swept ones once its expiration time is stored,
+// the zero time removes it.
+func (e *expirer) track(key string, deadline time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if deadline.IsZero() {
+		delete(e.deadlines, key)
+	} else {
+		e.deadlines[key] = deadline
+	}
+}
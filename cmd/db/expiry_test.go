@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hrystynaa/lab4-go/datastore"
+)
+
+// testExpirer returns a sweeping expirer with a clock which only moves
+// when advanced.
+func testExpirer(t *testing.T, db datastore.Store) (*expirer, func(time.Duration)) {
+	exp := newExpirer(db)
+	var mu sync.Mutex
+	now := time.Now()
+	exp.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	go exp.sweep(stop)
+	return exp, func(d time.Duration) {
+		mu.Lock()
+		now = now.Add(d)
+		mu.Unlock()
+	}
+}
+
+// testListener serves connections on a local port and returns a connection
+// to it.
+func testListener(t *testing.T, serve func(net.Listener) error) net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitDeleted waits until the sweeper deletes the key.
+func waitDeleted(t *testing.T, db datastore.Store, key string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := db.Get(key); err == datastore.ErrNotFound {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expired key %s is not deleted", key)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// blockingStore blocks batches until release is closed, the expired keys are
+// deleted with their metadata in a batch.
+type blockingStore struct {
+	*datastore.MemStore
+	deleting chan string
+	release  chan struct{}
+}
+
+func (s blockingStore) WriteBatch(ops []datastore.BatchOp) error {
+	s.deleting <- ops[0].Key
+	<-s.release
+	return s.MemStore.WriteBatch(ops)
+}
+
+func TestExpirer_Sweep(t *testing.T) {
+	db := blockingStore{datastore.NewMemStore(), make(chan string, 1), make(chan struct{})}
+	exp, advance := testExpirer(t, db)
+	if stripes([]string{"a"})[0] == stripes([]string{"b"})[0] {
+		t.Fatal("Expected the keys to have different lock stripes")
+	}
+	db.Put("a", "1")
+	db.Put("b", "2")
+	unlock := lockKeys("a")
+	err := exp.expireAt("a", exp.now().Add(time.Second))
+	unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	advance(time.Second)
+
+	if key := <-db.deleting; key != "a" {
+		t.Fatalf("Unexpected delete of %s", key)
+	}
+	// The commands on other keys don't wait for the sweep.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer rlockKeys("b")()
+		if expired, err := exp.expired("b"); err != nil || expired {
+			t.Errorf("Unexpected expiration of b: %v", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("A command on another key waits for the sweep")
+	}
+	close(db.release)
+	waitDeleted(t, db, "a")
+	if _, err := db.Get("b"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpirer_Restart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := datastore.NewDb(dir, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for _, key := range []string{"a", "b"} {
+		meta := recordMeta{Flags: 1}
+		meta.setDeadline(deadline)
+		if err := putValue(db, key, "v", meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// The expiration times are stored with the keys, and a put through
+	// the HTTP API removes them.
+	db, err = datastore.NewDb(dir, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	exp, advance := testExpirer(t, db)
+	if err := exp.load(); err != nil {
+		t.Fatal(err)
+	}
+	rw := httptest.NewRecorder()
+	newHandler(db, exp).ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/db/b", strings.NewReader(`{"value":"new"}`)))
+	if rw.Code != http.StatusCreated {
+		t.Fatalf("Unexpected status %d", rw.Code)
+	}
+	advance(time.Second)
+	waitDeleted(t, db, "a")
+	if _, err := db.Get(metaKey("a")); err != datastore.ErrNotFound {
+		t.Errorf("Expected the metadata of a to be deleted, got %v", err)
+	}
+	if expired, err := exp.expired("b"); err != nil || expired {
+		t.Errorf("Expected b not to expire after a put, got %v %v", expired, err)
+	}
+	if value, err := db.Get("b"); err != nil || value != "new" {
+		t.Errorf("Unexpected value of b %q %v", value, err)
+	}
+}
+
+func TestExpirer_PutWithMeta(t *testing.T) {
+	db := datastore.NewMemStore()
+	exp, advance := testExpirer(t, db)
+	h := newHandler(db, exp)
+	deadline := time.Now().Add(time.Second).UnixMilli()
+
+	rw := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"value":"v","meta":{"flags":3,"expires":%d}}`, deadline)
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/db/a", strings.NewReader(body)))
+	if rw.Code != http.StatusCreated {
+		t.Fatalf("Unexpected status %d", rw.Code)
+	}
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/db/a?meta", nil))
+	var res Response
+	if err := json.NewDecoder(rw.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Value != "v" || res.Meta == nil || *res.Meta != (recordMeta{Flags: 3, Expires: deadline}) {
+		t.Errorf("Unexpected response %+v", res)
+	}
+	advance(time.Second)
+	waitDeleted(t, db, "a")
+}
@@ -0,0 +1,706 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hrystynaa/lab4-go/cluster"
+	"github.com/hrystynaa/lab4-go/datastore"
+	"github.com/hrystynaa/lab4-go/dbclient"
+)
+
+type Request struct {
+	Value string `json:"value"`
+	// Meta is stored with the value. A put without it clears the metadata
+	// of the key.
+	Meta *recordMeta `json:"meta,omitempty"`
+}
+
+type Response struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// Meta is the metadata of the key, returned for GET /db/{key}?meta.
+	Meta *recordMeta `json:"meta,omitempty"`
+}
+
+// IncrRequest is the body of POST /db/{key}/incr. The delta is 1 if the body
+// is empty.
+type IncrRequest struct {
+	Delta *int64 `json:"delta"`
+}
+
+type IncrResponse struct {
+	Key   string `json:"key"`
+	Value int64  `json:"value"`
+}
+
+func handleIncr(db datastore.Store, key string, rw http.ResponseWriter, req *http.Request) {
+	var body IncrRequest
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil && err != io.EOF {
+		writeBodyError(rw, err)
+		return
+	}
+	delta := int64(1)
+	if body.Delta != nil {
+		delta = *body.Delta
+	}
+
+	value, err := db.Incr(key, delta)
+	if errors.Is(err, datastore.ErrNotInteger) || errors.Is(err, datastore.ErrOverflow) {
+		dbclient.WriteError(rw, http.StatusConflict, codeConflict, err.Error())
+		return
+	} else if err != nil {
+		writeStoreError(rw, err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(IncrResponse{
+		Key:   key,
+		Value: value,
+	})
+}
+
+// PathResponse is the body of GET /db/{key}?path=, the value is the part of
+// the JSON document selected by the JSON Pointer.
+type PathResponse struct {
+	Key   string          `json:"key"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+func handleGetPath(db datastore.Store, key, path string, rw http.ResponseWriter) {
+	tokens, err := parsePointer(path)
+	if err != nil {
+		dbclient.WriteError(rw, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	value, err := db.Get(key)
+	if err != nil {
+		writeStoreError(rw, err)
+		return
+	}
+	doc, err := decodeJSON([]byte(value))
+	if err != nil {
+		dbclient.WriteError(rw, http.StatusUnprocessableEntity, codeNotJSON, errNotJSON.Error())
+		return
+	}
+	doc, err = getPath(doc, tokens)
+	if errors.Is(err, errBadPointer) {
+		dbclient.WriteError(rw, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	} else if err != nil {
+		dbclient.WriteError(rw, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	}
+	sub, err := encodeJSON(doc)
+	if err != nil {
+		dbclient.WriteError(rw, http.StatusInternalServerError, codeStorage, err.Error())
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(PathResponse{
+		Key:   key,
+		Path:  path,
+		Value: json.RawMessage(sub),
+	})
+}
+
+// handlePatch applies a JSON Merge Patch or a JSON Patch, chosen by the
+// content type, to the stored document in a single atomic update.
+func handlePatch(db datastore.Store, key string, rw http.ResponseWriter, req *http.Request) {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != mergePatchType && mediaType != jsonPatchType {
+		rw.Header().Set("Accept-Patch", mergePatchType+", "+jsonPatchType)
+		dbclient.WriteError(rw, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "patch must be "+mergePatchType+" or "+jsonPatchType)
+		return
+	}
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		writeBodyError(rw, err)
+		return
+	}
+	patch, err := parsePatch(mediaType, data)
+	if err != nil {
+		dbclient.WriteError(rw, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	var result string
+	err = db.Update(key, func(value string, ok bool) (string, error) {
+		if !ok {
+			return "", datastore.ErrNotFound
+		}
+		patched, err := applyPatch(value, patch)
+		result = patched
+		return patched, err
+	})
+	switch {
+	case err == nil:
+	case errors.Is(err, errNotJSON):
+		dbclient.WriteError(rw, http.StatusUnprocessableEntity, codeNotJSON, err.Error())
+		return
+	case errors.Is(err, errPatchFailed):
+		dbclient.WriteError(rw, http.StatusConflict, codeConflict, err.Error())
+		return
+	case errors.Is(err, errBadPatch), errors.Is(err, errBadPointer):
+		dbclient.WriteError(rw, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	default:
+		writeStoreError(rw, err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(Response{
+		Key:   key,
+		Value: result,
+	})
+}
+
+func parseVersion(rw http.ResponseWriter, header string) (uint64, bool) {
+	version, err := strconv.ParseUint(header, 10, 64)
+	if err != nil || version == 0 {
+		dbclient.WriteError(rw, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("bad %s header %q", versionHeader, header))
+		return 0, false
+	}
+	return version, true
+}
+
+// handlePutVersion stores a replica value of the cluster package unless the
+// stored one has the same or a newer version, so late and repeated writes of
+// the replicas don't overwrite newer ones. The caller holds the lock of the
+// key.
+func handlePutVersion(db datastore.Store, key, header, value string, rw http.ResponseWriter) {
+	version, ok := parseVersion(rw, header)
+	if !ok {
+		return
+	}
+	current, err := db.Get(key)
+	if err != nil && err != datastore.ErrNotFound {
+		writeStoreError(rw, err)
+		return
+	}
+	if err == nil {
+		if v, err := cluster.DecodeVersioned(current); err == nil && v.Version >= version {
+			dbclient.WriteError(rw, http.StatusConflict, codeStaleVersion, fmt.Sprintf("%s: version %d is stored", errStaleVersion, v.Version))
+			return
+		}
+	}
+	if err := putValue(db, key, value, recordMeta{}); err != nil {
+		writeStoreError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusCreated)
+}
+
+// handleDeleteVersion deletes a replica value of the cluster package only if
+// it has the version, it is used to remove the tombstones which every
+// replica has. The caller holds the lock of the key.
+func handleDeleteVersion(db datastore.Store, key, header string, rw http.ResponseWriter) {
+	version, ok := parseVersion(rw, header)
+	if !ok {
+		return
+	}
+	current, err := db.Get(key)
+	if err != nil {
+		writeStoreError(rw, err)
+		return
+	}
+	if v, err := cluster.DecodeVersioned(current); err != nil || v.Version != version {
+		dbclient.WriteError(rw, http.StatusConflict, codeStaleVersion, fmt.Sprintf("%s: version %d is not stored", errStaleVersion, version))
+		return
+	}
+	if err := deleteValue(db, key); err != nil {
+		writeStoreError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// handleFind serves GET /db?where=field:value with the records whose JSON
+// value has the value at the field.
+func handleFind(db datastore.Store, rw http.ResponseWriter, req *http.Request) {
+	field, value, ok := strings.Cut(req.URL.Query().Get("where"), ":")
+	if !ok || field == "" {
+		dbclient.WriteError(rw, http.StatusBadRequest, codeBadRequest, "where must be field:value")
+		return
+	}
+	finder, ok := db.(datastore.Finder)
+	if !ok {
+		dbclient.WriteError(rw, http.StatusNotImplemented, codeNotImplemented, "the store has no secondary indexes")
+		return
+	}
+	keys, err := finder.FindBy(field, value)
+	if errors.Is(err, datastore.ErrNotIndexed) {
+		dbclient.WriteError(rw, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	} else if err != nil {
+		writeStoreError(rw, err)
+		return
+	}
+
+	res := make([]Response, 0, len(keys))
+	for _, key := range keys {
+		if isMetaKey(key) {
+			continue
+		}
+		value, err := db.Get(key)
+		if err == datastore.ErrNotFound {
+			continue
+		} else if err != nil {
+			writeStoreError(rw, err)
+			return
+		}
+		res = append(res, Response{
+			Key:   key,
+			Value: value,
+		})
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(res)
+}
+
+const maxBatchSize = 1000
+
+const defaultScanLimit = 100
+
+// ScanResponse is a page of GET /db?prefix=. Next is the key to pass as
+// after to get the following page, it is empty on the last page.
+type ScanResponse struct {
+	Records []Response `json:"records"`
+	Next    string     `json:"next,omitempty"`
+}
+
+var errPageFull = errors.New("page is full")
+
+// handleScan serves GET /db?prefix=&after=&limit=, the prefix may be empty, with the records of the
+// keys with the prefix which follow the key after, in key order.
+func handleScan(db datastore.Store, rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	prefix, after := query.Get("prefix"), query.Get("after")
+	limit := defaultScanLimit
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxBatchSize {
+			dbclient.WriteError(rw, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("limit must be from 1 to %d", maxBatchSize))
+			return
+		}
+		limit = n
+	}
+
+	// The scan starts at the cursor and only the values of the page are
+	// read.
+	res := ScanResponse{Records: make([]Response, 0)}
+	keys := make([]string, 0, limit)
+	err := scanKeys(db, prefix, after, func(key string) error {
+		if len(keys) == limit {
+			res.Next = keys[limit-1]
+			return errPageFull
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil && err != errPageFull {
+		writeStoreError(rw, err)
+		return
+	}
+	for _, key := range keys {
+		value, err := db.Get(key)
+		if err == datastore.ErrNotFound {
+			continue
+		} else if err != nil {
+			writeStoreError(rw, err)
+			return
+		}
+		res.Records = append(res.Records, Response{Key: key, Value: value})
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(res)
+}
+
+const watchBuffer = 256
+
+// WatchEvent is a line of the GET /db/_watch?prefix= stream.
+type WatchEvent struct {
+	Seq     uint64 `json:"seq"`
+	Key     string `json:"key"`
+	Value   string `json:"value,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// handleWatch streams the writes of the keys with the prefix as JSON lines
+// until the client goes away. The stream ends early if the client reads
+// too slowly to keep up with the writes.
+func handleWatch(db datastore.Store, rw http.ResponseWriter, req *http.Request) {
+	watcher, ok := db.(datastore.Watcher)
+	if !ok {
+		dbclient.WriteError(rw, http.StatusNotImplemented, codeNotImplemented, "the store can't be watched")
+		return
+	}
+	rc := http.NewResponseController(rw)
+	// The stream outlives the write timeout of the server.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		dbclient.WriteError(rw, http.StatusInternalServerError, codeStorage, err.Error())
+		return
+	}
+	changes, stop := watcher.Watch(req.URL.Query().Get("prefix"), watchBuffer)
+	defer stop()
+
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	rw.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	enc := json.NewEncoder(rw)
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case c, ok := <-changes:
+			if !ok {
+				return
+			}
+			if isMetaKey(c.Key) {
+				continue
+			}
+			err := enc.Encode(WatchEvent{
+				Seq:     c.Seq,
+				Key:     c.Key,
+				Value:   c.Value,
+				Deleted: c.Deleted,
+			})
+			if err != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+type MGetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// MGetResult is the value of a key requested by POST /db/_mget, Value is
+// empty for the keys which are not found.
+type MGetResult struct {
+	Found bool   `json:"found"`
+	Value string `json:"value,omitempty"`
+}
+
+type MGetResponse struct {
+	Values map[string]MGetResult `json:"values"`
+}
+
+func handleMGet(db datastore.Store, rw http.ResponseWriter, req *http.Request) {
+	var body MGetRequest
+	if !decodeBody(rw, req, &body) {
+		return
+	}
+	if len(body.Keys) > maxBatchSize {
+		dbclient.WriteError(rw, http.StatusRequestEntityTooLarge, codeTooLarge, fmt.Sprintf("at most %d keys allowed", maxBatchSize))
+		return
+	}
+	for _, key := range body.Keys {
+		if !validKey(rw, key) {
+			return
+		}
+	}
+	res := MGetResponse{Values: make(map[string]MGetResult, len(body.Keys))}
+	for _, key := range body.Keys {
+		value, err := db.Get(key)
+		if err == datastore.ErrNotFound {
+			res.Values[key] = MGetResult{}
+			continue
+		} else if err != nil {
+			writeStoreError(rw, fmt.Errorf("cannot read %s: %w", key, err))
+			return
+		}
+		res.Values[key] = MGetResult{Found: true, Value: value}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(res)
+}
+
+// BatchOperation is a put or a delete of POST /db/_batch.
+type BatchOperation struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type BatchRequest struct {
+	Ops []BatchOperation `json:"ops"`
+}
+
+type BatchResponse struct {
+	Applied int `json:"applied"`
+}
+
+// handleBatch applies the puts and deletes of the request atomically: all of
+// them or, if any fails, none. Both replace the metadata of the keys.
+func handleBatch(db datastore.Store, rw http.ResponseWriter, req *http.Request) {
+	var body BatchRequest
+	if !decodeBody(rw, req, &body) {
+		return
+	}
+	if len(body.Ops) > maxBatchSize {
+		dbclient.WriteError(rw, http.StatusRequestEntityTooLarge, codeTooLarge, fmt.Sprintf("at most %d operations allowed", maxBatchSize))
+		return
+	}
+	ops := make([]datastore.BatchOp, 0, 2*len(body.Ops))
+	keys := make([]string, len(body.Ops))
+	for i, op := range body.Ops {
+		if !validKey(rw, op.Key) {
+			return
+		}
+		switch op.Op {
+		case "put":
+			ops = append(ops, putOps(op.Key, op.Value, recordMeta{})...)
+		case "delete":
+			ops = append(ops, deleteOps(op.Key)...)
+		default:
+			dbclient.WriteError(rw, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("operation %d: unknown op %q", i, op.Op))
+			return
+		}
+		keys[i] = op.Key
+	}
+
+	defer lockKeys(keys...)()
+	if err := db.WriteBatch(ops); err != nil {
+		writeStoreError(rw, err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(BatchResponse{Applied: len(body.Ops)})
+}
+
+// StatsResponse is the body of GET /admin/stats.
+type StatsResponse struct {
+	RawValueBytes    int64   `json:"raw_value_bytes"`
+	StoredValueBytes int64   `json:"stored_value_bytes"`
+	CompressionRatio float64 `json:"compression_ratio"`
+	CacheHits        int64   `json:"cache_hits"`
+	CacheMisses      int64   `json:"cache_misses"`
+	CacheBytes       int64   `json:"cache_bytes"`
+}
+
+func handleStats(db datastore.Store, rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		methodNotAllowed(rw, req, http.MethodGet)
+		return
+	}
+	reporter, ok := db.(datastore.StatsReporter)
+	if !ok {
+		dbclient.WriteError(rw, http.StatusNotImplemented, codeNotImplemented, "the store has no stats")
+		return
+	}
+	s := reporter.Stats()
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(StatsResponse{
+		RawValueBytes:    s.RawValueBytes,
+		StoredValueBytes: s.StoredValueBytes,
+		CompressionRatio: s.CompressionRatio,
+		CacheHits:        s.CacheHits,
+		CacheMisses:      s.CacheMisses,
+		CacheBytes:       s.CacheBytes,
+	})
+}
+
+// handleCompact serves POST /admin/compact, which returns once the sealed
+// segments are merged.
+func handleCompact(db datastore.Store, rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		methodNotAllowed(rw, req, http.MethodPost)
+		return
+	}
+	compacter, ok := db.(datastore.Compacter)
+	if !ok {
+		dbclient.WriteError(rw, http.StatusNotImplemented, codeNotImplemented, "the store can't be compacted on demand")
+		return
+	}
+	err := compacter.Compact()
+	if errors.Is(err, datastore.ErrCompactionRunning) {
+		dbclient.WriteError(rw, http.StatusConflict, codeConflict, err.Error())
+		return
+	} else if err != nil {
+		writeStoreError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func newHandler(db datastore.Store, exp *expirer) http.Handler {
+	h := new(http.ServeMux)
+
+	h.HandleFunc("/db", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			methodNotAllowed(rw, req, http.MethodGet)
+			return
+		}
+		if req.URL.Query().Has("prefix") {
+			handleScan(db, rw, req)
+			return
+		}
+		handleFind(db, rw, req)
+	})
+
+	h.HandleFunc("/db/", func(rw http.ResponseWriter, req *http.Request) {
+		key := req.URL.Path[len("/db/"):]
+		switch {
+		case key == "_mget" || key == "_batch":
+			if req.Method != http.MethodPost {
+				methodNotAllowed(rw, req, http.MethodPost)
+			} else if key == "_mget" {
+				handleMGet(db, rw, req)
+			} else {
+				handleBatch(db, rw, req)
+			}
+			return
+		case key == "_watch":
+			if req.Method != http.MethodGet {
+				methodNotAllowed(rw, req, http.MethodGet)
+				return
+			}
+			handleWatch(db, rw, req)
+			return
+		case req.Method == http.MethodPost && strings.HasSuffix(key, incrSuffix):
+			key = strings.TrimSuffix(key, incrSuffix)
+			if validKey(rw, key) {
+				defer lockKeys(key)()
+				handleIncr(db, key, rw, req)
+			}
+			return
+		}
+		if !validKey(rw, key) {
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet:
+			if path, ok := req.URL.Query()["path"]; ok {
+				handleGetPath(db, key, path[0], rw)
+				return
+			}
+			res := Response{Key: key}
+			var err error
+			if req.URL.Query().Has("meta") {
+				defer rlockKeys(key)()
+				res.Meta = new(recordMeta)
+				*res.Meta, err = readMeta(db, key)
+			}
+			if err == nil {
+				res.Value, err = db.Get(key)
+			}
+			if err != nil {
+				writeStoreError(rw, err)
+				return
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(rw).Encode(res)
+
+		case http.MethodPost:
+			var body Request
+			if !decodeBody(rw, req, &body) {
+				return
+			}
+			defer lockKeys(key)()
+			if version := req.Header.Get(versionHeader); version != "" {
+				handlePutVersion(db, key, version, body.Value, rw)
+				return
+			}
+
+			// The value replaces the metadata of the key, such as memcached
+			// flags.
+			var meta recordMeta
+			if body.Meta != nil {
+				meta = *body.Meta
+			}
+			if err := putValue(db, key, body.Value, meta); err != nil {
+				writeStoreError(rw, err)
+				return
+			}
+			exp.track(key, meta.deadline())
+			rw.WriteHeader(http.StatusCreated)
+
+		case http.MethodDelete:
+			defer lockKeys(key)()
+			if version := req.Header.Get(versionHeader); version != "" {
+				handleDeleteVersion(db, key, version, rw)
+				return
+			}
+			if err := deleteValue(db, key); err != nil {
+				writeStoreError(rw, err)
+				return
+			}
+			rw.WriteHeader(http.StatusNoContent)
+
+		case http.MethodPatch:
+			defer lockKeys(key)()
+			handlePatch(db, key, rw, req)
+
+		default:
+			methodNotAllowed(rw, req, http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodPatch)
+		}
+	})
+
+	h.HandleFunc("/admin/backup", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			methodNotAllowed(rw, req, http.MethodGet)
+			return
+		}
+		s, ok := db.(datastore.Snapshotter)
+		if !ok {
+			dbclient.WriteError(rw, http.StatusNotImplemented, codeNotImplemented, "the store has no snapshots")
+			return
+		}
+		backup, err := datastore.NewBackup(s)
+		if err != nil {
+			log.Printf("Backup failed: %s", err)
+			writeStoreError(rw, err)
+			return
+		}
+		defer backup.Close()
+		rc := http.NewResponseController(rw)
+		// The archive may take longer to send than the write timeout of the
+		// server.
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			dbclient.WriteError(rw, http.StatusInternalServerError, codeStorage, err.Error())
+			return
+		}
+		rw.Header().Set("Content-Type", "application/x-tar")
+		rw.Header().Set("Content-Disposition", `attachment; filename="backup.tar"`)
+		if err := backup.Write(rw); err != nil {
+			log.Printf("Backup failed: %s", err)
+			// A part of the archive is sent already, the connection is
+			// dropped so the client sees a truncated transfer.
+			panic(http.ErrAbortHandler)
+		}
+	})
+
+	h.HandleFunc("/admin/stats", func(rw http.ResponseWriter, req *http.Request) {
+		handleStats(db, rw, req)
+	})
+
+	h.HandleFunc("/admin/compact", func(rw http.ResponseWriter, req *http.Request) {
+		handleCompact(db, rw, req)
+	})
+
+	return withRequests(h)
+}
@@ -0,0 +1,673 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hrystynaa/lab4-go/datastore"
+	"github.com/hrystynaa/lab4-go/dbclient"
+)
+
+// testHandler is the handler of the store with an expirer which is not
+// swept.
+func testHandler(db datastore.Store) http.Handler {
+	return newHandler(db, newExpirer(db))
+}
+
+func TestHandler(t *testing.T) {
+	h := testHandler(datastore.NewMemStore())
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rw
+	}
+
+	if rw := do(http.MethodGet, "/db/codequeens", ""); rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing key, got %d", rw.Code)
+	}
+	if rw := do(http.MethodPost, "/db/codequeens", `{"value":"2023-05-01"}`); rw.Code != http.StatusCreated {
+		t.Errorf("Expected 201 on put, got %d", rw.Code)
+	}
+	if rw := do(http.MethodPost, "/db/codequeens", `not json`); rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 on a bad body, got %d", rw.Code)
+	}
+
+	rw := do(http.MethodGet, "/db/codequeens", "")
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on get, got %d", rw.Code)
+	}
+	var resp Response
+	if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Key != "codequeens" || resp.Value != "2023-05-01" {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+
+	if rw := do(http.MethodDelete, "/db/codequeens", ""); rw.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 on delete, got %d", rw.Code)
+	}
+	if rw := do(http.MethodDelete, "/db/codequeens", ""); rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 deleting a missing key, got %d", rw.Code)
+	}
+}
+
+func TestHandler_Backup(t *testing.T) {
+	rw := httptest.NewRecorder()
+	testHandler(datastore.NewMemStore()).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/admin/backup", nil))
+	if rw.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 for a store without snapshots, got %d", rw.Code)
+	}
+
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := datastore.NewDb(dir, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("codequeens", "2023-05-01"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The archive is sent past the write timeout of the server.
+	server := httptest.NewUnstartedServer(testHandler(db))
+	server.Config.WriteTimeout = time.Nanosecond
+	server.Start()
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/admin/backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 on backup, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-tar" {
+		t.Errorf("Unexpected content type %s", ct)
+	}
+
+	restoreDir := filepath.Join(dir, "restored")
+	if err := datastore.RestoreBackup(resp.Body, restoreDir); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := datastore.NewDb(restoreDir, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if value, err := restored.Get("codequeens"); err != nil || value != "2023-05-01" {
+		t.Errorf("Unexpected restored value %s %v", value, err)
+	}
+}
+
+// brokenSnapshots is a store whose snapshots fail, or with partial set, fail
+// only once a part of the archive is written.
+type brokenSnapshots struct {
+	*datastore.MemStore
+	partial bool
+}
+
+func (b brokenSnapshots) Snapshot(dir string) error {
+	if !b.partial {
+		return errors.New("disk is full")
+	}
+	// The file is larger than the response buffer, so it is sent before the
+	// backup fails.
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), make([]byte, 64<<10), 0o600); err != nil {
+		return err
+	}
+	// A directory can't be read into the archive.
+	return os.Mkdir(filepath.Join(dir, "b"), 0o700)
+}
+
+func TestHandler_BackupErrors(t *testing.T) {
+	rw := httptest.NewRecorder()
+	testHandler(brokenSnapshots{MemStore: datastore.NewMemStore()}).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/admin/backup", nil))
+	var res dbclient.ErrorResponse
+	if rw.Code != http.StatusInternalServerError || json.Unmarshal(rw.Body.Bytes(), &res) != nil || res.Code != codeStorage {
+		t.Errorf("Expected the error envelope for a failed snapshot, got %d %s", rw.Code, rw.Body)
+	}
+
+	server := httptest.NewServer(testHandler(brokenSnapshots{MemStore: datastore.NewMemStore(), partial: true}))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/admin/backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	archive, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Error("Expected the transfer of a backup failed part-way to be cut")
+	}
+	if len(archive) == 0 {
+		t.Error("Expected a part of the archive to be sent")
+	}
+}
+
+func TestHandler_Admin(t *testing.T) {
+	mem := datastore.NewMemStore()
+	mem.Put("key", "value")
+	rw := httptest.NewRecorder()
+	testHandler(mem).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/admin/stats", nil))
+	var stats StatsResponse
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on stats, got %d", rw.Code)
+	}
+	if err := json.NewDecoder(rw.Body).Decode(&stats); err != nil || stats.RawValueBytes != 5 || stats.CompressionRatio != 1 {
+		t.Errorf("Unexpected stats %+v %v", stats, err)
+	}
+	rw = httptest.NewRecorder()
+	testHandler(mem).ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/admin/compact", nil))
+	if rw.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 for a store without compaction, got %d", rw.Code)
+	}
+
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := datastore.NewDb(dir, 50, datastore.WithCompactionThreshold(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		if err := db.Put("key", fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := testHandler(db)
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/admin/compact", nil))
+	if rw.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 on compact, got %d", rw.Code)
+	}
+	if value, err := db.Get("key"); err != nil || value != "value9" {
+		t.Errorf("Unexpected value %s %v", value, err)
+	}
+
+	for _, c := range []struct{ method, path string }{
+		{http.MethodGet, "/admin/compact"},
+		{http.MethodPost, "/admin/stats"},
+	} {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(c.method, c.path, nil))
+		if rw.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected 405 for %s %s, got %d", c.method, c.path, rw.Code)
+		}
+	}
+}
+
+func TestHandler_Incr(t *testing.T) {
+	h := testHandler(datastore.NewMemStore())
+
+	incr := func(key, body string) (int, int64) {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/db/"+key+"/incr", strings.NewReader(body)))
+		var resp IncrResponse
+		if rw.Code == http.StatusOK {
+			if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Key != key {
+				t.Errorf("Unexpected key %s", resp.Key)
+			}
+		}
+		return rw.Code, resp.Value
+	}
+
+	if code, value := incr("hits", ""); code != http.StatusOK || value != 1 {
+		t.Errorf("Expected 200 and 1, got %d %d", code, value)
+	}
+	if code, value := incr("hits", `{"delta":10}`); code != http.StatusOK || value != 11 {
+		t.Errorf("Expected 200 and 11, got %d %d", code, value)
+	}
+	if code, _ := incr("hits", `bad`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 on a bad body, got %d", code)
+	}
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/db/name", strings.NewReader(`{"value":"text"}`)))
+	if code, _ := incr("name", ""); code != http.StatusConflict {
+		t.Errorf("Expected 409 for a non-integer value, got %d", code)
+	}
+
+	// Only the names of the requests on several keys are reserved. A key
+	// ending with /incr is put with a batch and read and deleted as usual.
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rw
+	}
+	if rw := serve(http.MethodPost, "/db/_other", `{"value":"v"}`); rw.Code != http.StatusCreated {
+		t.Errorf("Expected 201 for a put of _other, got %d", rw.Code)
+	}
+	if rw := serve(http.MethodGet, "/db/_other", ""); rw.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a get of _other, got %d", rw.Code)
+	}
+	if rw := serve(http.MethodPost, "/db/_batch", `{"ops":[{"op":"put","key":"a/incr","value":"1"}]}`); rw.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a batch put of a/incr, got %d", rw.Code)
+	}
+	if rw := serve(http.MethodGet, "/db/a/incr", ""); rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), `"1"`) {
+		t.Errorf("Unexpected get of a/incr %d %s", rw.Code, rw.Body)
+	}
+	if code, value := incr("a", ""); code != http.StatusOK || value != 1 {
+		t.Errorf("Expected POST /db/a/incr to increment a, got %d %d", code, value)
+	}
+	if rw := serve(http.MethodDelete, "/db/a/incr", ""); rw.Code >= 300 {
+		t.Errorf("Unexpected delete of a/incr %d", rw.Code)
+	}
+	for _, key := range []string{"_mget", "_batch", "_watch"} {
+		rw := serve(http.MethodPost, "/db/_batch", `{"ops":[{"op":"put","key":"`+key+`","value":"1"}]}`)
+		if rw.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for a batch put of %s, got %d", key, rw.Code)
+		}
+	}
+}
+
+func TestHandler_Document(t *testing.T) {
+	h := testHandler(datastore.NewMemStore())
+
+	do := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+
+	do(http.MethodPost, "/db/doc", "application/json", `{"value":"{\"a\":{\"b\":[1,2]},\"c\":\"x\"}"}`)
+
+	rw := do(http.MethodGet, "/db/doc?path=/a/b/1", "", "")
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on get by path, got %d", rw.Code)
+	}
+	var resp PathResponse
+	if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Key != "doc" || resp.Path != "/a/b/1" || string(resp.Value) != "2" {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+	if rw := do(http.MethodGet, "/db/doc?path=/missing", "", ""); rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing path, got %d", rw.Code)
+	}
+	if rw := do(http.MethodGet, "/db/doc?path=bad", "", ""); rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad pointer, got %d", rw.Code)
+	}
+
+	rw = do(http.MethodPatch, "/db/doc", "application/merge-patch+json", `{"c":null,"d":1}`)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on merge patch, got %d", rw.Code)
+	}
+	var patched Response
+	if err := json.NewDecoder(rw.Body).Decode(&patched); err != nil {
+		t.Fatal(err)
+	}
+	if patched.Value != `{"a":{"b":[1,2]},"d":1}` {
+		t.Errorf("Unexpected patched value %s", patched.Value)
+	}
+
+	rw = do(http.MethodPatch, "/db/doc", "application/json-patch+json", `[{"op":"add","path":"/a/b/-","value":3}]`)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on JSON patch, got %d", rw.Code)
+	}
+	if rw := do(http.MethodGet, "/db/doc?path=/a/b/2", "", ""); rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), `"value":3`) {
+		t.Errorf("Expected the patched element, got %d %s", rw.Code, rw.Body)
+	}
+
+	cases := []struct {
+		key, contentType, body string
+		code                   int
+	}{
+		{"doc", "application/json-patch+json", `[{"op":"test","path":"/d","value":2}]`, http.StatusConflict},
+		{"doc", "application/json-patch+json", `{}`, http.StatusBadRequest},
+		{"doc", "text/plain", `{}`, http.StatusUnsupportedMediaType},
+		{"missing", "application/merge-patch+json", `{}`, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		if rw := do(http.MethodPatch, "/db/"+c.key, c.contentType, c.body); rw.Code != c.code {
+			t.Errorf("Expected %d patching %s with %s, got %d", c.code, c.key, c.body, rw.Code)
+		}
+	}
+
+	do(http.MethodPost, "/db/text", "application/json", `{"value":"plain"}`)
+	if rw := do(http.MethodPatch, "/db/text", "application/merge-patch+json", `{}`); rw.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 patching a non-JSON value, got %d", rw.Code)
+	}
+}
+
+func TestHandler_Find(t *testing.T) {
+	rw := httptest.NewRecorder()
+	testHandler(datastore.NewMemStore()).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/db?where=status:active", nil))
+	if rw.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 for a store without indexes, got %d", rw.Code)
+	}
+
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := datastore.NewDb(dir, 500, datastore.WithSecondaryIndex("status"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for key, value := range map[string]string{"a": `{"status":"active"}`, "b": `{"status":"done"}`, "c": `{"status":"active"}`} {
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := testHandler(db)
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/db?where=status:active", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on find, got %d", rw.Code)
+	}
+	var resp []Response
+	if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 2 || resp[0].Key != "a" || resp[1].Key != "c" || resp[0].Value != `{"status":"active"}` {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+
+	for _, query := range []string{"", "?where=status", "?where=other:x"} {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/db"+query, nil))
+		if rw.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %q, got %d", query, rw.Code)
+		}
+	}
+}
+
+func TestHandler_Scan(t *testing.T) {
+	db := datastore.NewMemStore()
+	for _, key := range []string{"user:1", "user:2", "user:3", "other"} {
+		db.Put(key, "v-"+key)
+	}
+	h := testHandler(db)
+
+	scan := func(query string) ScanResponse {
+		t.Helper()
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/db?"+query, nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %q, got %d", query, rw.Code)
+		}
+		var resp ScanResponse
+		if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := scan("prefix=user:&limit=2")
+	if len(resp.Records) != 2 || resp.Records[0].Key != "user:1" || resp.Records[1].Value != "v-user:2" || resp.Next != "user:2" {
+		t.Errorf("Unexpected first page %+v", resp)
+	}
+	resp = scan("prefix=user:&limit=2&after=" + resp.Next)
+	if len(resp.Records) != 1 || resp.Records[0].Key != "user:3" || resp.Next != "" {
+		t.Errorf("Unexpected last page %+v", resp)
+	}
+	if resp := scan("prefix="); len(resp.Records) != 4 || resp.Next != "" {
+		t.Errorf("Expected all the records, got %+v", resp)
+	}
+	if resp := scan("prefix=none"); resp.Records == nil || len(resp.Records) != 0 {
+		t.Errorf("Expected an empty page, got %+v", resp)
+	}
+
+	for _, limit := range []string{"0", "x", "1001"} {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/db?prefix=&limit="+limit, nil))
+		if rw.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for limit %s, got %d", limit, rw.Code)
+		}
+	}
+}
+
+// countingStore counts the values read by Get and Scan.
+type countingStore struct {
+	*datastore.MemStore
+	reads int
+}
+
+func (c *countingStore) Get(key string) (string, error) {
+	c.reads++
+	return c.MemStore.Get(key)
+}
+
+func (c *countingStore) Scan(prefix string, fn func(key, value string) error) error {
+	return c.MemStore.Scan(prefix, func(key, value string) error {
+		c.reads++
+		return fn(key, value)
+	})
+}
+
+func TestHandler_ScanPage(t *testing.T) {
+	db := &countingStore{MemStore: datastore.NewMemStore()}
+	for i := 0; i < 100; i++ {
+		db.Put(fmt.Sprintf("key%03d", i), "value")
+	}
+	rw := httptest.NewRecorder()
+	testHandler(db).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/db?prefix=key&after=key090&limit=5", nil))
+	var resp ScanResponse
+	if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Records) != 5 || resp.Records[0].Key != "key091" || resp.Next != "key095" {
+		t.Errorf("Unexpected page %+v", resp)
+	}
+	if db.reads != 5 {
+		t.Errorf("Expected only the values of the page to be read, got %d reads", db.reads)
+	}
+}
+
+func TestHandler_Watch(t *testing.T) {
+	rw := httptest.NewRecorder()
+	testHandler(datastore.NewMemStore()).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/db/_watch", nil))
+	if rw.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 for a store without watchers, got %d", rw.Code)
+	}
+
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := datastore.NewDb(dir, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	server := httptest.NewServer(testHandler(db))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/db/_watch?prefix=user:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	// The watcher is registered before the headers are sent.
+	db.Put("other", "x")
+	db.Put("user:1", "a")
+	db.Delete("user:1")
+
+	dec := json.NewDecoder(resp.Body)
+	expected := []WatchEvent{{Key: "user:1", Value: "a"}, {Key: "user:1", Deleted: true}}
+	for _, want := range expected {
+		var event WatchEvent
+		if err := dec.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Key != want.Key || event.Value != want.Value || event.Deleted != want.Deleted || event.Seq == 0 {
+			t.Errorf("Expected %+v, got %+v", want, event)
+		}
+	}
+}
+
+func TestHandler_Batch(t *testing.T) {
+	db := datastore.NewMemStore()
+	h := testHandler(db)
+
+	do := func(path, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return rw
+	}
+	checkError := func(rw *httptest.ResponseRecorder, code int) {
+		t.Helper()
+		if rw.Code != code {
+			t.Errorf("Expected %d, got %d", code, rw.Code)
+		}
+		var resp dbclient.ErrorResponse
+		if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil || resp.Code == "" || resp.Message == "" {
+			t.Errorf("Expected an error message, got %v", err)
+		}
+	}
+
+	db.Put("old", "value")
+	rw := do("/db/_batch", `{"ops":[
+		{"op":"put","key":"k1","value":"v1"},
+		{"op":"put","key":"k2","value":"v2"},
+		{"op":"delete","key":"old"}
+	]}`)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on batch, got %d", rw.Code)
+	}
+	var batch BatchResponse
+	if err := json.NewDecoder(rw.Body).Decode(&batch); err != nil || batch.Applied != 3 {
+		t.Errorf("Unexpected response %+v %v", batch, err)
+	}
+
+	rw = do("/db/_mget", `{"keys":["k1","k2","old"]}`)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on mget, got %d", rw.Code)
+	}
+	var mget MGetResponse
+	if err := json.NewDecoder(rw.Body).Decode(&mget); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]MGetResult{
+		"k1":  {Found: true, Value: "v1"},
+		"k2":  {Found: true, Value: "v2"},
+		"old": {},
+	}
+	if !reflect.DeepEqual(mget.Values, expected) {
+		t.Errorf("Unexpected values %+v", mget.Values)
+	}
+
+	checkError(do("/db/_batch", `{"ops":[{"op":"put","key":"k1","value":"new"},{"op":"merge","key":"k2"}]}`), http.StatusBadRequest)
+	checkError(do("/db/_batch", `{"ops":[{"op":"put","key":"","value":"v"}]}`), http.StatusBadRequest)
+	checkError(do("/db/_batch", `not json`), http.StatusBadRequest)
+	if value, _ := db.Get("k1"); value != "v1" {
+		t.Errorf("Expected a rejected batch to write nothing, got %s", value)
+	}
+
+	keys := make([]string, maxBatchSize+1)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+	}
+	body, _ := json.Marshal(MGetRequest{Keys: keys})
+	checkError(do("/db/_mget", string(body)), http.StatusRequestEntityTooLarge)
+	checkError(do("/db/_batch", `{"ops":[{"op":"put","key":"k","value":"`+strings.Repeat("x", maxBodySize)+`"}]}`), http.StatusRequestEntityTooLarge)
+}
+
+// failingStore fails every read with err.
+type failingStore struct {
+	*datastore.MemStore
+	err error
+}
+
+func (s failingStore) Get(key string) (string, error) {
+	return "", s.err
+}
+
+func TestHandler_Errors(t *testing.T) {
+	h := testHandler(datastore.NewMemStore())
+
+	do := func(method, path, body string) (*httptest.ResponseRecorder, dbclient.ErrorResponse) {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-Request-Id", "req-1")
+		h.ServeHTTP(rw, req)
+		var resp dbclient.ErrorResponse
+		if rw.Code >= 400 {
+			if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+				t.Fatalf("%s %s: bad error body: %s", method, path, err)
+			}
+		}
+		return rw, resp
+	}
+	check := func(method, path, body string, status int, code string) *httptest.ResponseRecorder {
+		t.Helper()
+		rw, resp := do(method, path, body)
+		if rw.Code != status || resp.Code != code || resp.Message == "" || resp.RequestID != "req-1" {
+			t.Errorf("%s %s: expected %d %s, got %d %+v", method, path, status, code, rw.Code, resp)
+		}
+		return rw
+	}
+
+	check(http.MethodGet, "/db/missing", "", http.StatusNotFound, codeNotFound)
+	check(http.MethodGet, "/db/", "", http.StatusBadRequest, codeInvalidKey)
+	check(http.MethodGet, "/db/"+strings.Repeat("k", datastore.MaxKeySize+1), "", http.StatusBadRequest, codeInvalidKey)
+	check(http.MethodPost, "/db/key", "not json", http.StatusBadRequest, codeBadRequest)
+	value, _ := json.Marshal(Request{Value: strings.Repeat("v", datastore.MaxValueSize+1)})
+	check(http.MethodPost, "/db/key", string(value), http.StatusRequestEntityTooLarge, codeTooLarge)
+	check(http.MethodPost, "/db/key", `{"value":"`+strings.Repeat("v", maxBodySize)+`"}`, http.StatusRequestEntityTooLarge, codeTooLarge)
+
+	rw := check(http.MethodPut, "/db/key", "", http.StatusMethodNotAllowed, codeMethodNotAllowed)
+	if allow := rw.Header().Get("Allow"); allow != "GET, POST, DELETE, PATCH" {
+		t.Errorf("Unexpected Allow header %q", allow)
+	}
+	rw = check(http.MethodPost, "/admin/backup", "", http.StatusMethodNotAllowed, codeMethodNotAllowed)
+	if allow := rw.Header().Get("Allow"); allow != "GET" {
+		t.Errorf("Unexpected Allow header %q", allow)
+	}
+	check(http.MethodDelete, "/db?where=a:b", "", http.StatusMethodNotAllowed, codeMethodNotAllowed)
+
+	// Every response has a request id, generated if the client sent none.
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/db/missing", nil))
+	var resp dbclient.ErrorResponse
+	if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.RequestID == "" || rw.Header().Get("X-Request-Id") != resp.RequestID {
+		t.Errorf("Expected a generated request id, got %q and header %q", resp.RequestID, rw.Header().Get("X-Request-Id"))
+	}
+
+	// Corrupted data and I/O errors are not reported as missing keys.
+	for _, tc := range []struct {
+		err  error
+		code string
+	}{
+		{fmt.Errorf("%w: bad size 3", datastore.ErrCorruptedRecord), codeCorrupted},
+		{os.ErrPermission, codeStorage},
+	} {
+		h = testHandler(failingStore{datastore.NewMemStore(), tc.err})
+		check(http.MethodGet, "/db/key", "", http.StatusInternalServerError, tc.code)
+	}
+}
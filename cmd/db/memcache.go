@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hrystynaa/lab4-go/datastore"
+)
+
+const (
+	memcacheMaxKey = 250
+	// Expiration times up to 30 days are relative, larger ones are Unix
+	// times.
+	memcacheMaxRelativeExpiration = 30 * 24 * 60 * 60
+)
+
+var (
+	errNotStored  = errors.New("not stored")
+	errNotNumeric = errors.New("cannot increment or decrement non-numeric value")
+)
+
+// memcacheServer serves the memcached text protocol on top of a Store. CAS
+// tokens are the record versions, so the store must be a
+// datastore.Versioner for gets and cas. Client flags and expiration times
+// are stored in the metadata of the key, see metaKeyPrefix.
+type memcacheServer struct {
+	db  datastore.Store
+	exp *expirer
+}
+
+func newMemcacheServer(db datastore.Store, exp *expirer) *memcacheServer {
+	return &memcacheServer{
+		db:  db,
+		exp: exp,
+	}
+}
+
+// Serve accepts connections until the listener is closed.
+func (s *memcacheServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *memcacheServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return
+		}
+		if err := s.execute(r, w, strings.Fields(line)); err != nil {
+			return
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// execute runs a command. It returns an error only if the connection can't
+// be used any more.
+func (s *memcacheServer) execute(r *bufio.Reader, w *bufio.Writer, args []string) error {
+	if len(args) == 0 {
+		w.WriteString("ERROR\r\n")
+		return nil
+	}
+	switch args[0] {
+	case "get", "gets":
+		s.get(w, args[1:], args[0] == "gets")
+		return nil
+	case "set", "add", "replace", "cas":
+		return s.store(r, w, args[0], args[1:])
+	case "delete":
+		s.delete(w, args[1:])
+		return nil
+	case "incr":
+		s.incr(w, args[1:])
+		return nil
+	}
+	w.WriteString("ERROR\r\n")
+	return nil
+}
+
+func validMemcacheKey(key string) bool {
+	if len(key) > memcacheMaxKey {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func writeMemcacheError(w *bufio.Writer, err error) {
+	if errors.Is(err, datastore.ErrKeyTooLarge) || errors.Is(err, datastore.ErrValueTooLarge) {
+		w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return
+	}
+	fmt.Fprintf(w, "SERVER_ERROR %s\r\n", strings.ReplaceAll(err.Error(), "\r\n", " "))
+}
+
+// noreply removes the optional noreply argument.
+func noreply(args []string) ([]string, bool) {
+	if len(args) > 0 && args[len(args)-1] == "noreply" {
+		return args[:len(args)-1], true
+	}
+	return args, false
+}
+
+func (s *memcacheServer) get(w *bufio.Writer, keys []string, withCAS bool) {
+	if len(keys) == 0 {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	versioner, ok := s.db.(datastore.Versioner)
+	if withCAS && !ok {
+		w.WriteString("SERVER_ERROR cas is not supported by the store\r\n")
+		return
+	}
+	defer rlockKeys(keys...)()
+	for _, key := range keys {
+		var value string
+		var version uint64
+		var err error
+		if withCAS {
+			value, version, err = versioner.GetVersion(key)
+		} else {
+			value, err = s.db.Get(key)
+		}
+		if err == datastore.ErrNotFound {
+			continue
+		} else if err != nil {
+			writeMemcacheError(w, err)
+			return
+		}
+		meta, err := readMeta(s.db, key)
+		if err != nil {
+			writeMemcacheError(w, err)
+			return
+		}
+		if s.exp.passed(meta) {
+			continue
+		}
+		if withCAS {
+			fmt.Fprintf(w, "VALUE %s %d %d %d\r\n%s\r\n", key, meta.Flags, len(value), version, value)
+		} else {
+			fmt.Fprintf(w, "VALUE %s %d %d\r\n%s\r\n", key, meta.Flags, len(value), value)
+		}
+	}
+	w.WriteString("END\r\n")
+}
+
+// deadline converts a memcached expiration time to a deadline.
+func (s *memcacheServer) deadline(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return s.exp.now()
+	case exptime > memcacheMaxRelativeExpiration:
+		return time.Unix(exptime, 0)
+	}
+	return s.exp.now().Add(time.Duration(exptime) * time.Second)
+}
+
+// store handles set, add, replace and cas:
+//
+//	<command> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]
+func (s *memcacheServer) store(r *bufio.Reader, w *bufio.Writer, command string, args []string) error {
+	args, quiet := noreply(args)
+	expected := 4
+	if command == "cas" {
+		expected = 5
+	}
+	if len(args) != expected {
+		w.WriteString("ERROR\r\n")
+		return nil
+	}
+	size, err := strconv.Atoi(args[3])
+	if err != nil || size < 0 {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+	if size > datastore.MaxValueSize {
+		// The data block can't be skipped safely, so the connection is
+		// closed after the reply.
+		w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		w.Flush()
+		return errors.New("value too large")
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if string(data[size:]) != "\r\n" {
+		// The rest of the line is skipped so it is not read as a command.
+		if data[size+1] != '\n' {
+			if _, err := readLine(r); err != nil {
+				return err
+			}
+		}
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return nil
+	}
+
+	key := args[0]
+	flags, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil || !validMemcacheKey(key) {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+	exptime, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+	value, meta := string(data[:size]), recordMeta{Flags: uint32(flags)}
+	meta.setDeadline(s.deadline(exptime))
+	var version uint64
+	if command == "cas" {
+		if version, err = strconv.ParseUint(args[4], 10, 64); err != nil {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return nil
+		}
+	}
+	reply := func(s string) {
+		if !quiet {
+			w.WriteString(s + "\r\n")
+		}
+	}
+
+	defer lockKeys(key)()
+	if err := s.exp.drop(key); err != nil {
+		writeMemcacheError(w, err)
+		return nil
+	}
+	// The key is locked, so nothing is written between the check and the
+	// put. The version of cas is checked by the store.
+	switch command {
+	case "add", "replace":
+		_, err = s.db.Get(key)
+		if err == nil && command == "add" || err == datastore.ErrNotFound && command == "replace" {
+			err = errNotStored
+		} else if err == datastore.ErrNotFound {
+			err = nil
+		}
+		if err == nil {
+			err = putValue(s.db, key, value, meta)
+		}
+	case "cas":
+		versioner, ok := s.db.(datastore.Versioner)
+		if !ok {
+			w.WriteString("SERVER_ERROR cas is not supported by the store\r\n")
+			return nil
+		}
+		err = swapValue(versioner, key, value, meta, version)
+	default:
+		err = putValue(s.db, key, value, meta)
+	}
+	switch {
+	case err == nil:
+		s.exp.track(key, meta.deadline())
+		reply("STORED")
+	case err == errNotStored:
+		reply("NOT_STORED")
+	case err == datastore.ErrNotFound:
+		reply("NOT_FOUND")
+	case err == datastore.ErrVersionMismatch:
+		reply("EXISTS")
+	default:
+		writeMemcacheError(w, err)
+	}
+	return nil
+}
+
+// delete handles delete <key> [noreply].
+func (s *memcacheServer) delete(w *bufio.Writer, args []string) {
+	args, quiet := noreply(args)
+	if len(args) != 1 {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	key := args[0]
+
+	defer lockKeys(key)()
+	if err := s.exp.drop(key); err != nil {
+		writeMemcacheError(w, err)
+		return
+	}
+	err := deleteValue(s.db, key)
+	if err != nil && err != datastore.ErrNotFound {
+		writeMemcacheError(w, err)
+		return
+	}
+	s.exp.track(key, time.Time{})
+	if quiet {
+		return
+	}
+	if err == datastore.ErrNotFound {
+		w.WriteString("NOT_FOUND\r\n")
+	} else {
+		w.WriteString("DELETED\r\n")
+	}
+}
+
+// incr handles incr <key> <value> [noreply]. The stored value must be an
+// unsigned 64-bit integer, the result wraps around on overflow.
+func (s *memcacheServer) incr(w *bufio.Writer, args []string) {
+	args, quiet := noreply(args)
+	if len(args) != 2 {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	key := args[0]
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		w.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+		return
+	}
+
+	defer lockKeys(key)()
+	if err := s.exp.drop(key); err != nil {
+		writeMemcacheError(w, err)
+		return
+	}
+	var result string
+	err = s.db.Update(key, func(value string, ok bool) (string, error) {
+		if !ok {
+			return "", datastore.ErrNotFound
+		}
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return "", errNotNumeric
+		}
+		result = strconv.FormatUint(n+delta, 10)
+		return result, nil
+	})
+	switch {
+	case err == nil:
+		if !quiet {
+			w.WriteString(result + "\r\n")
+		}
+	case err == datastore.ErrNotFound:
+		if !quiet {
+			w.WriteString("NOT_FOUND\r\n")
+		}
+	case err == errNotNumeric:
+		w.WriteString("CLIENT_ERROR " + err.Error() + "\r\n")
+	default:
+		writeMemcacheError(w, err)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hrystynaa/lab4-go/datastore"
+)
+
+func TestMemcacheServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := datastore.NewDb(dir, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	exp, advance := testExpirer(t, db)
+	conn := testListener(t, newMemcacheServer(db, exp).Serve)
+	r := bufio.NewReader(conn)
+
+	// do sends the request and reads the given number of reply lines.
+	do := func(request string, lines int) string {
+		t.Helper()
+		fmt.Fprint(conn, request)
+		var reply []string
+		for i := 0; i < lines; i++ {
+			line, err := readLine(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply = append(reply, line)
+		}
+		return strings.Join(reply, "\n")
+	}
+	check := func(request string, expected ...string) {
+		t.Helper()
+		if reply := do(request, len(expected)); reply != strings.Join(expected, "\n") {
+			t.Errorf("%q: expected %q, got %q", request, strings.Join(expected, "\n"), reply)
+		}
+	}
+
+	check("get k1\r\n", "END")
+	check("set k1 0 0 2\r\nv1\r\n", "STORED")
+	check("get k1 k2\r\n", "VALUE k1 0 2", "v1", "END")
+	check("add k1 0 0 2\r\nv2\r\n", "NOT_STORED")
+	check("add k2 0 0 2\r\nv2\r\n", "STORED")
+	check("replace k3 0 0 2\r\nv3\r\n", "NOT_STORED")
+	check("replace k2 0 0 3\r\nv22\r\n", "STORED")
+	check("get k1 k2\r\n", "VALUE k1 0 2", "v1", "VALUE k2 0 3", "v22", "END")
+	check("set k1 x 0 2\r\nv1\r\n", "CLIENT_ERROR bad command line format")
+	check("set k1 0 0 2\r\nv123\r\n", "CLIENT_ERROR bad data chunk")
+	check("unknown\r\n", "ERROR")
+
+	// CAS tokens are record versions.
+	_, version, err := db.GetVersion("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("gets k1\r\n", fmt.Sprintf("VALUE k1 0 2 %d", version), "v1", "END")
+	check(fmt.Sprintf("cas k1 0 0 3 %d\r\nnew\r\n", version), "STORED")
+	check(fmt.Sprintf("cas k1 0 0 3 %d\r\nold\r\n", version), "EXISTS")
+	check(fmt.Sprintf("cas k3 0 0 3 %d\r\nnew\r\n", version), "NOT_FOUND")
+	check("get k1\r\n", "VALUE k1 0 3", "new", "END")
+
+	// A compaction moves the records but keeps their versions.
+	_, version, err = db.GetVersion("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		check(fmt.Sprintf("set fill%d 0 0 2\r\n%02d\r\n", i, i), "STORED")
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(fmt.Sprintf("cas k1 0 0 2 %d\r\nv1\r\n", version), "STORED")
+
+	check("incr n 1\r\n", "NOT_FOUND")
+	check("set n 0 0 20\r\n18446744073709551615\r\n", "STORED")
+	check("incr n 2\r\n", "1")
+	check("incr n 41\r\n", "42")
+	check("incr k1 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+	check("incr n x\r\n", "CLIENT_ERROR invalid numeric delta argument")
+
+	// Client flags are stored in the metadata of the key.
+	check("set f 4294967295 0 2\r\n10\r\n", "STORED")
+	check("get f\r\n", "VALUE f 4294967295 2", "10", "END")
+	check("incr f 5\r\n", "15")
+	check("replace f 7 0 2\r\nv7\r\n", "STORED")
+	_, version, err = db.GetVersion("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("gets f\r\n", fmt.Sprintf("VALUE f 7 2 %d", version), "v7", "END")
+	check(fmt.Sprintf("cas f 0 0 2 %d\r\nv0\r\n", version), "STORED")
+	check("get f\r\n", "VALUE f 0 2", "v0", "END")
+	check("set f 3 0 2\r\nv3\r\n", "STORED")
+	if value, _ := db.Get("f"); value != "v3" {
+		t.Errorf("Expected the value to be stored as is, got %q", value)
+	}
+
+	check("delete k2\r\n", "DELETED")
+	check("delete k2\r\n", "NOT_FOUND")
+
+	// Replies to noreply commands are skipped.
+	check("set q 0 0 1 noreply\r\n1\r\nincr q 1 noreply\r\ndelete missing noreply\r\nget q\r\n", "VALUE q 0 1", "2", "END")
+
+	t.Run("expiration", func(t *testing.T) {
+		check("set e1 0 10 1\r\na\r\n", "STORED")
+		check(fmt.Sprintf("set e2 0 %d 1\r\nb\r\n", exp.now().Add(time.Hour).Unix()), "STORED")
+		check("set e3 0 -1 1\r\nc\r\n", "STORED")
+		check("get e1 e2 e3\r\n", "VALUE e1 0 1", "a", "VALUE e2 0 1", "b", "END")
+
+		advance(10 * time.Second)
+		check("get e1 e2\r\n", "VALUE e2 0 1", "b", "END")
+		check("add e1 0 0 1\r\nd\r\n", "STORED")
+		check("get e1\r\n", "VALUE e1 0 1", "d", "END")
+
+		advance(time.Hour)
+		check("get e2\r\n", "END")
+		waitDeleted(t, db, "e2")
+		waitDeleted(t, db, "e3")
+	})
+}
+
+func TestMemcacheServer_NoVersions(t *testing.T) {
+	db := datastore.NewMemStore()
+	exp, _ := testExpirer(t, db)
+	conn := testListener(t, newMemcacheServer(db, exp).Serve)
+	r := bufio.NewReader(conn)
+
+	fmt.Fprint(conn, "gets k1\r\n")
+	if line, err := readLine(r); err != nil || !strings.HasPrefix(line, "SERVER_ERROR") {
+		t.Errorf("Expected a server error, got %q, %v", line, err)
+	}
+}
+
+func TestMemcacheServer_FlagsOutOfBand(t *testing.T) {
+	db := datastore.NewMemStore()
+	exp, _ := testExpirer(t, db)
+	conn := testListener(t, newMemcacheServer(db, exp).Serve)
+	r := bufio.NewReader(conn)
+	h := newHandler(db, exp)
+
+	get := func(key string) string {
+		t.Helper()
+		fmt.Fprintf(conn, "get %s\r\n", key)
+		var reply []string
+		for {
+			line, err := readLine(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "END" {
+				return strings.Join(reply, "\n")
+			}
+			reply = append(reply, line)
+		}
+	}
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rw
+	}
+
+	fmt.Fprint(conn, "set f 5 0 4\r\ndata\r\n")
+	if line, _ := readLine(r); line != "STORED" {
+		t.Fatalf("Unexpected reply %q", line)
+	}
+	if body := do(http.MethodGet, "/db/f", "").Body.String(); body != `{"key":"f","value":"data"}`+"\n" {
+		t.Errorf("Expected the value without the flags, got %s", body)
+	}
+	if body := do(http.MethodGet, "/db?prefix=", "").Body.String(); body != `{"records":[{"key":"f","value":"data"}]}`+"\n" {
+		t.Errorf("Expected the metadata keys to be hidden, got %s", body)
+	}
+	if rw := do(http.MethodGet, "/db/"+url.PathEscape(metaKey("f")), ""); rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected the metadata key to be rejected, got %d", rw.Code)
+	}
+
+	// A value which looks like the old in-band flags is stored as is, and
+	// a write through HTTP clears the flags.
+	forged := "\x00memcache-flags:9\x00x"
+	body, _ := json.Marshal(Request{Value: forged})
+	if rw := do(http.MethodPost, "/db/f", string(body)); rw.Code != http.StatusCreated {
+		t.Fatalf("Unexpected status %d", rw.Code)
+	}
+	if reply := get("f"); reply != fmt.Sprintf("VALUE f 0 %d\n%s", len(forged), forged) {
+		t.Errorf("Expected the forged value without flags, got %q", reply)
+	}
+	if _, err := db.Get(metaKey("f")); err != datastore.ErrNotFound {
+		t.Errorf("Expected the metadata to be deleted, got %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hrystynaa/lab4-go/datastore"
+)
+
+// metaKeyPrefix starts the keys which hold the metadata of the other keys,
+// such as the memcached client flags and the expiration times. The metadata
+// of a key is written and deleted in the same batch as the key, the
+// listeners hide the metadata keys and reject keys with the prefix, so the
+// values stay as the clients wrote them.
+const metaKeyPrefix = "\x00meta:"
+
+// maxKeySize leaves room for the prefix in the metadata key of the longest
+// key.
+const maxKeySize = datastore.MaxKeySize - len(metaKeyPrefix)
+
+var errReservedKey = errors.New("keys starting with the metadata prefix are reserved")
+
+func metaKey(key string) string {
+	return metaKeyPrefix + key
+}
+
+func isMetaKey(key string) bool {
+	return strings.HasPrefix(key, metaKeyPrefix)
+}
+
+// checkKey returns the error for the keys which the clients can't use.
+func checkKey(key string) error {
+	if isMetaKey(key) {
+		return errReservedKey
+	}
+	if len(key) > maxKeySize {
+		return fmt.Errorf("%w: key of %d bytes, at most %d allowed", datastore.ErrKeyTooLarge, len(key), maxKeySize)
+	}
+	return nil
+}
+
+// recordMeta is the metadata of a key, stored as JSON under its metadata
+// key. Keys with the zero metadata have no metadata key.
+type recordMeta struct {
+	Flags uint32 `json:"flags,omitempty"`
+	// Expires is the expiration time in Unix milliseconds, 0 if the key
+	// doesn't expire.
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// deadline returns the expiration time, the zero time if the key doesn't
+// expire.
+func (m recordMeta) deadline() time.Time {
+	if m.Expires == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(m.Expires)
+}
+
+func (m *recordMeta) setDeadline(deadline time.Time) {
+	if deadline.IsZero() {
+		m.Expires = 0
+	} else {
+		m.Expires = deadline.UnixMilli()
+	}
+}
+
+func encodeMeta(meta recordMeta) string {
+	data, _ := json.Marshal(meta)
+	return string(data)
+}
+
+func decodeMeta(key, value string) (recordMeta, error) {
+	var meta recordMeta
+	if err := json.Unmarshal([]byte(value), &meta); err != nil {
+		return meta, fmt.Errorf("bad metadata of %s: %w", key, err)
+	}
+	return meta, nil
+}
+
+// readMeta returns the metadata of the key.
+func readMeta(db datastore.Store, key string) (recordMeta, error) {
+	value, err := db.Get(metaKey(key))
+	if err == datastore.ErrNotFound {
+		return recordMeta{}, nil
+	} else if err != nil {
+		return recordMeta{}, err
+	}
+	return decodeMeta(key, value)
+}
+
+// putOps returns the operations which store the value of the key with the
+// metadata.
+func putOps(key, value string, meta recordMeta) []datastore.BatchOp {
+	ops := []datastore.BatchOp{{Key: key, Value: value}}
+	if meta == (recordMeta{}) {
+		return append(ops, datastore.BatchOp{Key: metaKey(key), Delete: true})
+	}
+	return append(ops, datastore.BatchOp{Key: metaKey(key), Value: encodeMeta(meta)})
+}
+
+// deleteOps returns the operations which delete the key with its metadata.
+func deleteOps(key string) []datastore.BatchOp {
+	return []datastore.BatchOp{{Key: key, Delete: true}, {Key: metaKey(key), Delete: true}}
+}
+
+// putValue stores the value of the key, replacing its metadata. The caller
+// must hold the lock of the key.
+func putValue(db datastore.Store, key, value string, meta recordMeta) error {
+	return db.WriteBatch(putOps(key, value, meta))
+}
+
+// swapValue is putValue which writes only if the key still has the version.
+func swapValue(v datastore.Versioner, key, value string, meta recordMeta, version uint64) error {
+	return v.CompareAndWriteBatch(key, version, putOps(key, value, meta))
+}
+
+// deleteValue deletes the key with its metadata or returns ErrNotFound. The
+// caller must hold the lock of the key.
+func deleteValue(db datastore.Store, key string) error {
+	if _, err := db.Get(key); err != nil {
+		return err
+	}
+	return db.WriteBatch(deleteOps(key))
+}
+
+const keyLockStripes = 256
+
+// keyLocks serialize the writes of a key through the HTTP API and the
+// listeners, so a command which checks a key and then writes it, such as
+// the memcached cas, sees no other write in between.
+var keyLocks [keyLockStripes]sync.RWMutex
+
+// stripes returns the lock stripes of the keys in the order they are locked
+// in, so that commands on several keys don't deadlock.
+func stripes(keys []string) []int {
+	seen := make(map[int]bool, len(keys))
+	var res []int
+	for _, key := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		stripe := int(h.Sum32() % keyLockStripes)
+		if !seen[stripe] {
+			seen[stripe] = true
+			res = append(res, stripe)
+		}
+	}
+	sort.Ints(res)
+	return res
+}
+
+// lockKeys locks the keys for a command which changes them and returns the
+// function which unlocks them.
+func lockKeys(keys ...string) func() {
+	locked := stripes(keys)
+	for _, i := range locked {
+		keyLocks[i].Lock()
+	}
+	return func() {
+		for _, i := range locked {
+			keyLocks[i].Unlock()
+		}
+	}
+}
+
+// rlockKeys locks the keys for a command which only reads them.
+func rlockKeys(keys ...string) func() {
+	locked := stripes(keys)
+	for _, i := range locked {
+		keyLocks[i].RLock()
+	}
+	return func() {
+		for _, i := range locked {
+			keyLocks[i].RUnlock()
+		}
+	}
+}
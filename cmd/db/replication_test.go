@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hrystynaa/lab4-go/cluster"
+	"github.com/hrystynaa/lab4-go/datastore"
+	"github.com/hrystynaa/lab4-go/dbclient"
+)
+
+// replica is a db server which can be made unavailable.
+type replica struct {
+	db     *datastore.MemStore
+	url    string
+	client *dbclient.Client
+	down   atomic.Bool
+}
+
+func newReplica(t *testing.T) *replica {
+	r := &replica{db: datastore.NewMemStore()}
+	h := testHandler(r.db)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if r.down.Load() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	}))
+	t.Cleanup(server.Close)
+	r.url = server.URL
+	c, err := dbclient.New(server.URL, dbclient.WithRetries(0, 0), dbclient.WithTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.client = c
+	return r
+}
+
+func TestReplication(t *testing.T) {
+	replicas := []*replica{newReplica(t), newReplica(t), newReplica(t)}
+	clients := make(map[string]*dbclient.Client)
+	var addrs []string
+	for _, r := range replicas {
+		clients[r.url] = r.client
+		addrs = append(addrs, r.url)
+	}
+	ring, err := cluster.NewRing(cluster.DefaultVirtualNodes, addrs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, err := cluster.NewReplicated(ring, clients, cluster.DefaultQuorum(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for i := 0; i < 20; i++ {
+		if err := rp.Put(ctx, fmt.Sprintf("key%02d", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rp.Wait()
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		for _, r := range replicas {
+			raw, err := r.db.Get(key)
+			if err != nil {
+				t.Fatalf("Expected %s on every replica: %s", key, err)
+			}
+			if v, err := cluster.DecodeVersioned(raw); err != nil || v.Value != fmt.Sprint(i) {
+				t.Errorf("Unexpected replica of %s %q", key, raw)
+			}
+		}
+		if value, err := rp.Get(ctx, key); err != nil || value != fmt.Sprint(i) {
+			t.Errorf("Unexpected value of %s %q %v", key, value, err)
+		}
+	}
+
+	// A quorum is left with one node down.
+	replicas[2].down.Store(true)
+	if err := rp.Put(ctx, "key00", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := rp.Get(ctx, "key00"); err != nil || value != "new" {
+		t.Errorf("Unexpected value with a node down %q %v", value, err)
+	}
+	if err := rp.Delete(ctx, "key01"); err != nil {
+		t.Fatal(err)
+	}
+	replicas[1].down.Store(true)
+	if err := rp.Put(ctx, "key02", "lost"); !errors.Is(err, cluster.ErrNoQuorum) {
+		t.Errorf("Expected ErrNoQuorum with two nodes down, got %v", err)
+	}
+	if _, err := rp.Get(ctx, "key02"); !errors.Is(err, cluster.ErrNoQuorum) {
+		t.Errorf("Expected ErrNoQuorum with two nodes down, got %v", err)
+	}
+	rp.Wait()
+
+	// The node which was down gets the missed writes on read.
+	replicas[1].down.Store(false)
+	replicas[2].down.Store(false)
+	repairs := rp.Repairs()
+	if value, err := rp.Get(ctx, "key00"); err != nil || value != "new" {
+		t.Errorf("Unexpected value %q %v", value, err)
+	}
+	if _, err := rp.Get(ctx, "key01"); !errors.Is(err, dbclient.ErrNotFound) {
+		t.Errorf("Expected the deleted key to be not found, got %v", err)
+	}
+	rp.Wait()
+	if rp.Repairs() <= repairs {
+		t.Error("Expected read repairs")
+	}
+	raw, _ := replicas[2].db.Get("key00")
+	if v, err := cluster.DecodeVersioned(raw); err != nil || v.Value != "new" {
+		t.Errorf("Expected the stale replica to be repaired, got %q", raw)
+	}
+	raw, _ = replicas[2].db.Get("key01")
+	if v, err := cluster.DecodeVersioned(raw); err != nil || !v.Deleted {
+		t.Errorf("Expected the tombstone on the repaired replica, got %q", raw)
+	}
+
+	var keys []string
+	after := ""
+	for {
+		records, next, err := rp.ScanPage(ctx, "key", after, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range records {
+			keys = append(keys, r.Key)
+		}
+		if next == "" {
+			break
+		}
+		after = next
+	}
+	if len(keys) != 19 || keys[0] != "key00" || keys[1] != "key02" {
+		t.Errorf("Expected the 19 keys which were not deleted, got %v", keys)
+	}
+
+	// The deleted keys don't take places on a page.
+	for i := 4; i < 10; i++ {
+		if err := rp.Delete(ctx, fmt.Sprintf("key%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rp.Wait()
+	records, next, err := rp.ScanPage(ctx, "key", "key02", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0].Key != "key03" || records[1].Key != "key10" || next != "key11" {
+		t.Errorf("Expected a full page after the deleted keys, got %v, next %q", records, next)
+	}
+
+	// The tombstones are collected once every replica has them.
+	if n, err := rp.CollectTombstones(ctx, time.Hour); err != nil || n != 0 {
+		t.Errorf("Expected no tombstones older than the grace period, got %d %v", n, err)
+	}
+	replicas[2].down.Store(true)
+	if err := rp.Delete(ctx, "key03"); err != nil {
+		t.Fatal(err)
+	}
+	rp.Wait()
+	replicas[2].down.Store(false)
+	if n, err := rp.CollectTombstones(ctx, 0); err != nil || n != 7 {
+		t.Errorf("Expected the 7 tombstones on every replica to be collected, got %d %v", n, err)
+	}
+	if n, err := rp.CollectTombstones(ctx, 0); err != nil || n != 1 {
+		t.Errorf("Expected the repaired tombstone to be collected, got %d %v", n, err)
+	}
+	for _, r := range replicas {
+		for _, key := range []string{"key01", "key03", "key09"} {
+			if raw, err := r.db.Get(key); err != datastore.ErrNotFound {
+				t.Errorf("Expected the tombstone of %s to be removed, got %q %v", key, raw, err)
+			}
+		}
+	}
+	if _, err := rp.Get(ctx, "key03"); !errors.Is(err, dbclient.ErrNotFound) {
+		t.Errorf("Expected the deleted key to stay not found, got %v", err)
+	}
+}
+
+func TestReplication_Timeout(t *testing.T) {
+	hung := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-hung:
+		case <-req.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(hung)
+	r := newReplica(t)
+	slow, err := dbclient.New(server.URL, dbclient.WithRetries(0, 0), dbclient.WithTimeout(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring, err := cluster.NewRing(cluster.DefaultVirtualNodes, r.url, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := map[string]*dbclient.Client{r.url: r.client, server.URL: slow}
+	if _, err := cluster.NewReplicated(ring, clients, cluster.Quorum{N: 2, R: 1, W: 1}, cluster.WithTimeout(0)); err == nil {
+		t.Error("Expected an error for a zero timeout")
+	}
+	rp, err := cluster.NewReplicated(ring, clients, cluster.Quorum{N: 2, R: 1, W: 1}, cluster.WithTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rp.Put(context.Background(), "key", "v"); err != nil {
+		t.Fatal(err)
+	}
+	// The request to the hung replica gives up after the timeout.
+	done := make(chan struct{})
+	go func() {
+		rp.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The requests to a hung replica don't time out")
+	}
+}
+
+func TestHandler_PutVersion(t *testing.T) {
+	r := newReplica(t)
+	ctx := context.Background()
+
+	newer := cluster.Versioned{Version: 10, Value: "newer"}
+	if err := r.client.PutVersion(ctx, "key", newer.Encode(), newer.Version); err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range []uint64{10, 9} {
+		older := cluster.Versioned{Version: version, Value: "older"}
+		if err := r.client.PutVersion(ctx, "key", older.Encode(), older.Version); !errors.Is(err, dbclient.ErrStaleVersion) {
+			t.Errorf("Expected ErrStaleVersion for version %d, got %v", version, err)
+		}
+	}
+	if raw, _ := r.db.Get("key"); raw != newer.Encode() {
+		t.Errorf("Expected the newer value to stay, got %q", raw)
+	}
+
+	if err := r.client.DeleteVersion(ctx, "key", 9); !errors.Is(err, dbclient.ErrStaleVersion) {
+		t.Errorf("Expected ErrStaleVersion for a delete of another version, got %v", err)
+	}
+	if err := r.client.DeleteVersion(ctx, "key", 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.client.DeleteVersion(ctx, "key", 10); !errors.Is(err, dbclient.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, r.url+"/db/key", strings.NewReader(`{"value":"v"}`))
+	req.Header.Set(versionHeader, "latest")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad version, got %d", resp.StatusCode)
+	}
+}
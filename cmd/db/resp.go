@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hrystynaa/lab4-go/datastore"
+)
+
+const (
+	respMaxArgs = 1024
+	respMaxBulk = datastore.MaxValueSize
+	// respMaxCommand caps the bulk strings of a command together, as
+	// maxBodySize caps the HTTP requests.
+	respMaxCommand = maxBodySize
+	respScanCount  = 10
+	// maxLineSize caps the lines of both protocols, as Redis does for
+	// inline commands.
+	maxLineSize = 64 * 1024
+)
+
+var (
+	errRESPProtocol = errors.New("protocol error")
+	errLineTooLong  = errors.New("line too long")
+)
+
+// respServer serves a subset of the Redis protocol (RESP) on top of a Store.
+type respServer struct {
+	db  datastore.Store
+	exp *expirer
+}
+
+func newRESPServer(db datastore.Store, exp *expirer) *respServer {
+	return &respServer{
+		db:  db,
+		exp: exp,
+	}
+}
+
+// Serve accepts connections until the listener is closed.
+func (s *respServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *respServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		args, err := readRESPCommand(r)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			writeRESPError(w, err.Error())
+			w.Flush()
+			return
+		}
+		if len(args) > 0 {
+			s.execute(w, args)
+		}
+		// Pipelined commands are answered together.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readRESPCommand reads an array of bulk strings or an inline command. The
+// memory taken grows with the data read, not with the declared lengths.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > respMaxArgs {
+		return nil, fmt.Errorf("%w: bad array length %q", errRESPProtocol, line[1:])
+	}
+	var args []string
+	total := 0
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected a bulk string, got %q", errRESPProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > respMaxBulk {
+			return nil, fmt.Errorf("%w: bad bulk length %q", errRESPProtocol, line[1:])
+		}
+		if total += size; total > respMaxCommand {
+			return nil, fmt.Errorf("%w: command exceeds %d bytes", errRESPProtocol, respMaxCommand)
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if string(data[size:]) != "\r\n" {
+			return nil, fmt.Errorf("%w: bulk string is not terminated", errRESPProtocol)
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+// readLine reads a line of at most maxLineSize bytes without the line end.
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxLineSize {
+			return "", errLineTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+	}
+}
+
+func writeRESPSimple(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "+%s\r\n", s)
+}
+
+func writeRESPError(w *bufio.Writer, msg string) {
+	fmt.Fprintf(w, "-ERR %s\r\n", strings.ReplaceAll(msg, "\r\n", " "))
+}
+
+func writeRESPInt(w *bufio.Writer, n int64) {
+	fmt.Fprintf(w, ":%d\r\n", n)
+}
+
+func writeRESPBulk(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func writeRESPNull(w *bufio.Writer) {
+	w.WriteString("$-1\r\n")
+}
+
+func writeRESPArrayHeader(w *bufio.Writer, n int) {
+	fmt.Fprintf(w, "*%d\r\n", n)
+}
+
+// respArity holds the minimum and maximum number of arguments of the
+// commands, -1 means any number.
+var respArity = map[string][2]int{
+	"PING":   {0, 1},
+	"GET":    {1, 1},
+	"SET":    {2, -1},
+	"DEL":    {1, -1},
+	"EXISTS": {1, -1},
+	"INCR":   {1, 1},
+	"EXPIRE": {2, 2},
+	"SCAN":   {1, -1},
+}
+
+func (s *respServer) execute(w *bufio.Writer, args []string) {
+	name := strings.ToUpper(args[0])
+	args = args[1:]
+	arity, ok := respArity[name]
+	if !ok {
+		writeRESPError(w, fmt.Sprintf("unknown command '%s'", name))
+		return
+	}
+	if len(args) < arity[0] || arity[1] >= 0 && len(args) > arity[1] {
+		writeRESPError(w, fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+
+	if err := checkRESPKeys(name, args); err != nil {
+		writeRESPError(w, err.Error())
+		return
+	}
+
+	switch name {
+	case "PING":
+		if len(args) == 1 {
+			writeRESPBulk(w, args[0])
+		} else {
+			writeRESPSimple(w, "PONG")
+		}
+	case "GET":
+		s.get(w, args[0])
+	case "SET":
+		s.set(w, args)
+	case "DEL":
+		s.del(w, args)
+	case "EXISTS":
+		s.exists(w, args)
+	case "INCR":
+		s.incr(w, args[0])
+	case "EXPIRE":
+		s.expire(w, args)
+	case "SCAN":
+		s.scan(w, args)
+	}
+}
+
+// checkRESPKeys returns the error for the keys of the command which the
+// clients can't use.
+func checkRESPKeys(name string, args []string) error {
+	var keys []string
+	switch name {
+	case "PING", "SCAN":
+	case "DEL", "EXISTS":
+		keys = args
+	default:
+		keys = args[:1]
+	}
+	for _, key := range keys {
+		if err := checkKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *respServer) get(w *bufio.Writer, key string) {
+	defer rlockKeys(key)()
+	if expired, err := s.exp.expired(key); err != nil {
+		writeRESPError(w, err.Error())
+		return
+	} else if expired {
+		writeRESPNull(w)
+		return
+	}
+	value, err := s.db.Get(key)
+	if err == datastore.ErrNotFound {
+		writeRESPNull(w)
+	} else if err != nil {
+		writeRESPError(w, err.Error())
+	} else {
+		writeRESPBulk(w, value)
+	}
+}
+
+// set handles SET key value [EX seconds|PX milliseconds] [NX|XX].
+func (s *respServer) set(w *bufio.Writer, args []string) {
+	key, value := args[0], args[1]
+	var ttl time.Duration
+	var nx, xx bool
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 == len(args) {
+				writeRESPError(w, "syntax error")
+				return
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				writeRESPError(w, "invalid expire time in 'set' command")
+				return
+			}
+			unit := time.Second
+			if strings.ToUpper(args[i]) == "PX" {
+				unit = time.Millisecond
+			}
+			ttl = time.Duration(n) * unit
+			i++
+		default:
+			writeRESPError(w, "syntax error")
+			return
+		}
+	}
+	if nx && xx {
+		writeRESPError(w, "syntax error")
+		return
+	}
+
+	defer lockKeys(key)()
+	if err := s.exp.drop(key); err != nil {
+		writeRESPError(w, err.Error())
+		return
+	}
+	if nx || xx {
+		_, err := s.db.Get(key)
+		if err != nil && err != datastore.ErrNotFound {
+			writeRESPError(w, err.Error())
+			return
+		}
+		if ok := err == nil; nx && ok || xx && !ok {
+			writeRESPNull(w)
+			return
+		}
+	}
+	// The value replaces the metadata of the key, such as memcached flags,
+	// and so the expiration time too.
+	var meta recordMeta
+	if ttl > 0 {
+		meta.setDeadline(s.exp.now().Add(ttl))
+	}
+	if err := putValue(s.db, key, value, meta); err != nil {
+		writeRESPError(w, err.Error())
+		return
+	}
+	s.exp.track(key, meta.deadline())
+	writeRESPSimple(w, "OK")
+}
+
+func (s *respServer) del(w *bufio.Writer, keys []string) {
+	defer lockKeys(keys...)()
+	var n int64
+	for _, key := range keys {
+		if err := s.exp.drop(key); err != nil {
+			writeRESPError(w, err.Error())
+			return
+		}
+		err := deleteValue(s.db, key)
+		if err == nil {
+			n++
+		} else if err != datastore.ErrNotFound {
+			writeRESPError(w, err.Error())
+			return
+		}
+		s.exp.track(key, time.Time{})
+	}
+	writeRESPInt(w, n)
+}
+
+func (s *respServer) exists(w *bufio.Writer, keys []string) {
+	defer rlockKeys(keys...)()
+	var n int64
+	for _, key := range keys {
+		if expired, err := s.exp.expired(key); err != nil {
+			writeRESPError(w, err.Error())
+			return
+		} else if expired {
+			continue
+		}
+		_, err := s.db.Get(key)
+		if err == nil {
+			n++
+		} else if err != datastore.ErrNotFound {
+			writeRESPError(w, err.Error())
+			return
+		}
+	}
+	writeRESPInt(w, n)
+}
+
+func (s *respServer) incr(w *bufio.Writer, key string) {
+	defer lockKeys(key)()
+	if err := s.exp.drop(key); err != nil {
+		writeRESPError(w, err.Error())
+		return
+	}
+	n, err := s.db.Incr(key, 1)
+	if errors.Is(err, datastore.ErrNotInteger) || errors.Is(err, datastore.ErrOverflow) {
+		writeRESPError(w, "value is not an integer or out of range")
+	} else if err != nil {
+		writeRESPError(w, err.Error())
+	} else {
+		writeRESPInt(w, n)
+	}
+}
+
+// expire handles EXPIRE key seconds. A timeout which is not positive
+// deletes the key.
+func (s *respServer) expire(w *bufio.Writer, args []string) {
+	seconds, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		writeRESPError(w, "value is not an integer or out of range")
+		return
+	}
+	key := args[0]
+
+	defer lockKeys(key)()
+	if err := s.exp.drop(key); err != nil {
+		writeRESPError(w, err.Error())
+		return
+	}
+	if _, err := s.db.Get(key); err == datastore.ErrNotFound {
+		writeRESPInt(w, 0)
+		return
+	} else if err != nil {
+		writeRESPError(w, err.Error())
+		return
+	}
+	if seconds <= 0 {
+		if err := deleteValue(s.db, key); err != nil && err != datastore.ErrNotFound {
+			writeRESPError(w, err.Error())
+			return
+		}
+		s.exp.track(key, time.Time{})
+	} else if err := s.exp.expireAt(key, s.exp.now().Add(time.Duration(seconds)*time.Second)); err != nil {
+		writeRESPError(w, err.Error())
+		return
+	}
+	writeRESPInt(w, 1)
+}
+
+var errScanDone = errors.New("scan done")
+
+// scan handles SCAN cursor [MATCH pattern] [COUNT count]. The cursor is the
+// hex encoded last key looked at, so the scan goes on after it and no key
+// which exists for the whole scan is missed, whatever is deleted meanwhile.
+// Only the keys are read.
+func (s *respServer) scan(w *bufio.Writer, args []string) {
+	var after string
+	if args[0] != "0" {
+		key, err := hex.DecodeString(args[0])
+		if err != nil || len(key) == 0 {
+			writeRESPError(w, "invalid cursor")
+			return
+		}
+		after = string(key)
+	}
+	pattern, count := "*", respScanCount
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			writeRESPError(w, "syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			var err error
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count <= 0 {
+				writeRESPError(w, "value is not an integer or out of range")
+				return
+			}
+		default:
+			writeRESPError(w, "syntax error")
+			return
+		}
+	}
+
+	var keys []string
+	seen, next := 0, "0"
+	err := scanKeys(s.db, "", after, func(key string) error {
+		if expired, err := s.exp.expired(key); err != nil || expired {
+			return err
+		}
+		if seen == count {
+			next = hex.EncodeToString([]byte(after))
+			return errScanDone
+		}
+		seen++
+		after = key
+		if matchGlob(pattern, key) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil && err != errScanDone {
+		writeRESPError(w, err.Error())
+		return
+	}
+
+	writeRESPArrayHeader(w, 2)
+	writeRESPBulk(w, next)
+	writeRESPArrayHeader(w, len(keys))
+	for _, key := range keys {
+		writeRESPBulk(w, key)
+	}
+}
+
+// scanKeys calls fn in key order for the keys with the prefix after the key
+// after, reading the values only if the store can't list its keys alone.
+// The metadata keys are skipped.
+func scanKeys(db datastore.Store, prefix, after string, fn func(key string) error) error {
+	if ks, ok := db.(datastore.KeyScanner); ok {
+		return ks.ScanKeys(prefix, after, func(key string) error {
+			if isMetaKey(key) {
+				return nil
+			}
+			return fn(key)
+		})
+	}
+	return db.Scan(prefix, func(key, _ string) error {
+		if key <= after || isMetaKey(key) {
+			return nil
+		}
+		return fn(key)
+	})
+}
+
+// matchGlob matches the string against a Redis glob pattern with *, ?,
+// character classes and backslash escapes. A mismatch after a * goes back to
+// the last * only, which then takes one more byte, so the time is at most
+// the product of the lengths.
+func matchGlob(pattern, s string) bool {
+	p, i := 0, 0
+	// star is the position in the pattern after the last * and next the
+	// position in the string to retry it from.
+	star, next := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			if pattern[p] == '*' {
+				p++
+				star, next = p, i
+				continue
+			}
+			if n := matchByte(pattern[p:], s[i]); n > 0 {
+				p += n
+				i++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		next++
+		p, i = star, next
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchByte matches the byte against the first element of the pattern, which
+// is not a *. It returns the length of the element or 0 if it doesn't match.
+func matchByte(pattern string, c byte) int {
+	switch pattern[0] {
+	case '?':
+		return 1
+	case '[':
+		end := strings.IndexByte(pattern[1:], ']')
+		if end < 0 {
+			return 0
+		}
+		class := pattern[1 : end+1]
+		negate := strings.HasPrefix(class, "^")
+		if negate {
+			class = class[1:]
+		}
+		if matchClass(class, c) == negate {
+			return 0
+		}
+		return end + 2
+	case '\\':
+		if len(pattern) > 1 {
+			if pattern[1] != c {
+				return 0
+			}
+			return 2
+		}
+	}
+	if pattern[0] != c {
+		return 0
+	}
+	return 1
+}
+
+func matchClass(class string, c byte) bool {
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			if class[i] <= c && c <= class[i+2] {
+				return true
+			}
+			i += 2
+		} else if class[i] == c {
+			return true
+		}
+	}
+	return false
+}
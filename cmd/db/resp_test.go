@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hrystynaa/lab4-go/datastore"
+)
+
+// respReply reads a reply and returns it as a string, an int64, nil or a
+// slice of replies. Errors are returned as strings starting with "-".
+func respReply(t *testing.T, r *bufio.Reader) interface{} {
+	line, err := readLine(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return line
+	case ':':
+		var n int64
+		fmt.Sscan(line[1:], &n)
+		return n
+	case '$':
+		if line == "$-1" {
+			return nil
+		}
+		var size int
+		fmt.Sscan(line[1:], &size)
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatal(err)
+		}
+		return string(data[:size])
+	case '*':
+		var n int
+		fmt.Sscan(line[1:], &n)
+		res := make([]interface{}, n)
+		for i := range res {
+			res[i] = respReply(t, r)
+		}
+		return res
+	}
+	t.Fatalf("Unexpected reply %q", line)
+	return nil
+}
+
+func TestRESPServer(t *testing.T) {
+	db := datastore.NewMemStore()
+	exp, advance := testExpirer(t, db)
+	s := newRESPServer(db, exp)
+	conn := testListener(t, s.Serve)
+	r := bufio.NewReader(conn)
+
+	do := func(args ...string) interface{} {
+		fmt.Fprintf(conn, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+		return respReply(t, r)
+	}
+	check := func(expected interface{}, args ...string) {
+		t.Helper()
+		if reply := do(args...); !reflect.DeepEqual(reply, expected) {
+			t.Errorf("%v: expected %#v, got %#v", args, expected, reply)
+		}
+	}
+
+	check("PONG", "PING")
+	check("hello", "ping", "hello")
+	check(nil, "GET", "k1")
+	check("OK", "SET", "k1", "v1\r\nwith a newline")
+	check("v1\r\nwith a newline", "GET", "k1")
+	check(nil, "SET", "k1", "v2", "NX")
+	check("OK", "SET", "k1", "v2", "XX")
+	check(nil, "SET", "k2", "v2", "XX")
+	check("v2", "GET", "k1")
+	check(int64(1), "EXISTS", "k1", "k2")
+	check(int64(1), "INCR", "n")
+	check(int64(2), "INCR", "n")
+	check("-ERR value is not an integer or out of range", "INCR", "k1")
+	check(int64(1), "DEL", "k1", "k2")
+	check(int64(0), "EXISTS", "k1")
+	check("-ERR unknown command 'FLUSHALL'", "FLUSHALL")
+	check("-ERR wrong number of arguments for 'get' command", "GET")
+	check("-ERR syntax error", "SET", "k1", "v1", "NX", "XX")
+	check("-ERR keys starting with the metadata prefix are reserved", "SET", metaKey("k1"), "v")
+	check("-ERR keys starting with the metadata prefix are reserved", "DEL", "k1", metaKey("k1"))
+
+	// Inline commands and pipelining.
+	fmt.Fprint(conn, "SET inline 1\r\nGET inline\r\n")
+	if reply := respReply(t, r); reply != "OK" {
+		t.Errorf("Unexpected reply %#v", reply)
+	}
+	if reply := respReply(t, r); reply != "1" {
+		t.Errorf("Unexpected reply %#v", reply)
+	}
+
+	t.Run("expire", func(t *testing.T) {
+		check("OK", "SET", "e1", "v")
+		check(int64(1), "EXPIRE", "e1", "10")
+		check(int64(0), "EXPIRE", "missing", "10")
+		check("OK", "SET", "e2", "v", "EX", "5")
+		check("OK", "SET", "e3", "v", "PX", "100")
+
+		advance(time.Second)
+		check(nil, "GET", "e3")
+		check("v", "GET", "e2")
+		check(int64(1), "INCR", "e3")
+
+		advance(5 * time.Second)
+		check(nil, "GET", "e2")
+		check(int64(1), "EXISTS", "e1")
+		check("OK", "SET", "e1", "v")
+
+		advance(time.Minute)
+		check("v", "GET", "e1")
+		check(int64(1), "EXPIRE", "e1", "0")
+		check(nil, "GET", "e1")
+
+		// The sweeper removes expired keys from the store.
+		check(int64(1), "EXPIRE", "e3", "1")
+		advance(time.Second)
+		waitDeleted(t, db, "e3")
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		for i := 0; i < 25; i++ {
+			do("SET", fmt.Sprintf("scan:%02d", i), "v")
+		}
+		var keys []string
+		cursor := "0"
+		for {
+			reply := do("SCAN", cursor, "MATCH", "scan:*", "COUNT", "7").([]interface{})
+			for _, key := range reply[1].([]interface{}) {
+				keys = append(keys, key.(string))
+			}
+			if cursor = reply[0].(string); cursor == "0" {
+				break
+			}
+		}
+		if len(keys) != 25 || keys[0] != "scan:00" || keys[24] != "scan:24" {
+			t.Errorf("Unexpected keys %v", keys)
+		}
+
+		// Deleting the keys already returned skips none of the others.
+		reply := do("SCAN", "0", "MATCH", "scan:*", "COUNT", "7").([]interface{})
+		check(int64(7), "DEL", "scan:00", "scan:01", "scan:02", "scan:03", "scan:04", "scan:05", "scan:06")
+		keys = nil
+		for cursor = reply[0].(string); cursor != "0"; {
+			reply = do("SCAN", cursor, "MATCH", "scan:*", "COUNT", "7").([]interface{})
+			for _, key := range reply[1].([]interface{}) {
+				keys = append(keys, key.(string))
+			}
+			cursor = reply[0].(string)
+		}
+		if len(keys) != 18 || keys[0] != "scan:07" {
+			t.Errorf("Expected the 18 keys after the first page, got %v", keys)
+		}
+	})
+}
+
+func TestReadRESPCommand(t *testing.T) {
+	for _, input := range []string{
+		"*2\r\n$3\r\nGET\r\n",
+		"*1\r\n+GET\r\n",
+		"*1\r\n$3\r\nGETX\r\n",
+		"*-5\r\n",
+		"*1\r\n$99999999999\r\n",
+		"SET k " + strings.Repeat("v", maxLineSize) + "\r\n",
+	} {
+		if _, err := readRESPCommand(bufio.NewReader(strings.NewReader(input))); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+
+	// The bulk strings of a command are limited together.
+	bulk := fmt.Sprintf("$%d\r\n%s\r\n", respMaxBulk, strings.Repeat("v", respMaxBulk))
+	input := "*3\r\n" + strings.Repeat(bulk, 3)
+	if _, err := readRESPCommand(bufio.NewReader(strings.NewReader(input))); !errors.Is(err, errRESPProtocol) {
+		t.Errorf("Expected a protocol error for a command of %d bytes, got %v", 3*respMaxBulk, err)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"*", "a/b", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"*b*c", "abxbc", true},
+		{"a\\", "a\\", true},
+		{"*a*a*a*a*a*a*a*a*b", strings.Repeat("a", 1000), false},
+	} {
+		if match := matchGlob(tc.pattern, tc.s); match != tc.match {
+			t.Errorf("matchGlob(%q, %q) = %v", tc.pattern, tc.s, match)
+		}
+	}
+}
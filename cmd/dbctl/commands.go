@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/hrystynaa/lab4-go/dbclient"
+)
+
+// importBatchSize keeps the batches of import under the limit of the server.
+const importBatchSize = 500
+
+// record is a line of export and import and the JSON output of get and scan.
+type record struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func newTable(w io.Writer, header ...string) *tabwriter.Writer {
+	t := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	writeRow(t, header...)
+	return t
+}
+
+func writeRow(w io.Writer, cells ...string) {
+	for i, cell := range cells {
+		if i > 0 {
+			io.WriteString(w, "\t")
+		}
+		io.WriteString(w, cell)
+	}
+	io.WriteString(w, "\n")
+}
+
+// parseArgs parses the flags of a command and checks the number of the
+// remaining arguments.
+func parseArgs(fs *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if fs.NArg() < min || fs.NArg() > max {
+		return nil, fmt.Errorf("%w: wrong number of arguments", errUsage)
+	}
+	return fs.Args(), nil
+}
+
+func runGet(ctx context.Context, e *env, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("get", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	value, err := e.client.Get(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if e.format == "json" {
+		return json.NewEncoder(e.stdout).Encode(record{Key: args[0], Value: value})
+	}
+	t := newTable(e.stdout, "KEY", "VALUE")
+	writeRow(t, args[0], value)
+	return t.Flush()
+}
+
+func runPut(ctx context.Context, e *env, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("put", flag.ContinueOnError), args, 2, 2)
+	if err != nil {
+		return err
+	}
+	value := args[1]
+	if value == "-" {
+		data, err := io.ReadAll(e.stdin)
+		if err != nil {
+			return err
+		}
+		value = string(data)
+	}
+	return e.client.Put(ctx, args[0], value)
+}
+
+func runDel(ctx context.Context, e *env, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("del", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	return e.client.Delete(ctx, args[0])
+}
+
+// runScan prints a table of the records or, in JSON, a record per line.
+func runScan(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "key prefix")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	if e.format == "json" {
+		enc := json.NewEncoder(e.stdout)
+		return e.client.Scan(ctx, *prefix, func(key, value string) error {
+			return enc.Encode(record{Key: key, Value: value})
+		})
+	}
+	t := newTable(e.stdout, "KEY", "VALUE")
+	err := e.client.Scan(ctx, *prefix, func(key, value string) error {
+		writeRow(t, key, value)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return t.Flush()
+}
+
+// runWatch prints the writes until it is interrupted, in JSON an event per
+// line.
+func runWatch(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "key prefix")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	if e.format == "json" {
+		enc := json.NewEncoder(e.stdout)
+		return e.client.Watch(ctx, *prefix, func(event dbclient.Event) error {
+			return enc.Encode(event)
+		})
+	}
+	t := newTable(e.stdout, "SEQ", "OP", "KEY", "VALUE")
+	if err := t.Flush(); err != nil {
+		return err
+	}
+	return e.client.Watch(ctx, *prefix, func(event dbclient.Event) error {
+		op := "put"
+		if event.Deleted {
+			op = "del"
+		}
+		writeRow(t, strconv.FormatUint(event.Seq, 10), op, event.Key, event.Value)
+		return t.Flush()
+	})
+}
+
+func runStats(ctx context.Context, e *env, args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("stats", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	s, err := e.client.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	if e.format == "json" {
+		return json.NewEncoder(e.stdout).Encode(s)
+	}
+	t := newTable(e.stdout, "STAT", "VALUE")
+	writeRow(t, "raw_value_bytes", strconv.FormatInt(s.RawValueBytes, 10))
+	writeRow(t, "stored_value_bytes", strconv.FormatInt(s.StoredValueBytes, 10))
+	writeRow(t, "compression_ratio", strconv.FormatFloat(s.CompressionRatio, 'f', 2, 64))
+	writeRow(t, "cache_hits", strconv.FormatInt(s.CacheHits, 10))
+	writeRow(t, "cache_misses", strconv.FormatInt(s.CacheMisses, 10))
+	writeRow(t, "cache_bytes", strconv.FormatInt(s.CacheBytes, 10))
+	return t.Flush()
+}
+
+func runCompact(ctx context.Context, e *env, args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("compact", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	return e.client.Compact(ctx)
+}
+
+// create opens the output file of a command, - is stdout. A failed command
+// removes the partly written file.
+func create(e *env, path string) (io.Writer, func(failed bool) error, error) {
+	if path == "-" {
+		return e.stdout, func(bool) error { return nil }, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func(failed bool) error {
+		err := f.Close()
+		if failed {
+			os.Remove(path)
+		}
+		return err
+	}, nil
+}
+
+func runBackup(ctx context.Context, e *env, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("backup", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	w, done, err := create(e, args[0])
+	if err != nil {
+		return err
+	}
+	if err := e.client.Backup(ctx, w); err != nil {
+		done(true)
+		return err
+	}
+	return done(false)
+}
+
+func runExport(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "key prefix")
+	args, err := parseArgs(fs, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	path := "-"
+	if len(args) == 1 {
+		path = args[0]
+	}
+	w, done, err := create(e, path)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	err = e.client.Scan(ctx, *prefix, func(key, value string) error {
+		return enc.Encode(record{Key: key, Value: value})
+	})
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		done(true)
+		return err
+	}
+	return done(false)
+}
+
+// runImport puts the records in batches, so an interrupted import leaves
+// whole batches applied.
+func runImport(ctx context.Context, e *env, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("import", flag.ContinueOnError), args, 0, 1)
+	if err != nil {
+		return err
+	}
+	r := e.stdin
+	if len(args) == 1 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var ops []dbclient.Op
+	imported := 0
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		if err := e.client.Batch(ctx, ops); err != nil {
+			return fmt.Errorf("%d records imported: %w", imported, err)
+		}
+		imported += len(ops)
+		ops = ops[:0]
+		return nil
+	}
+	for {
+		var rec record
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("bad record %d: %w", imported+len(ops)+1, err)
+		}
+		ops = append(ops, dbclient.Op{Key: rec.Key, Value: rec.Value})
+		if len(ops) == importBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if e.format == "json" {
+		return json.NewEncoder(e.stdout).Encode(struct {
+			Imported int `json:"imported"`
+		}{imported})
+	}
+	_, err = fmt.Fprintf(e.stdout, "%d records imported\n", imported)
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/hrystynaa/lab4-go/dbclient"
+)
+
+// Exit codes of dbctl.
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitUsage    = 2
+	exitNotFound = 3
+)
+
+const defaultAddr = "http://localhost:8083"
+
+var errUsage = errors.New("bad usage")
+
+// env holds what the commands read and write, so tests can replace it.
+type env struct {
+	client *dbclient.Client
+	format string
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, e *env, args []string) error
+}
+
+var commands = map[string]command{
+	"get":     {"get <key>", runGet},
+	"put":     {"put <key> <value>, a value of - is read from stdin", runPut},
+	"del":     {"del <key>", runDel},
+	"scan":    {"scan [--prefix p]", runScan},
+	"watch":   {"watch [--prefix p]", runWatch},
+	"stats":   {"stats", runStats},
+	"compact": {"compact", runCompact},
+	"backup":  {"backup <file>, a file of - is stdout", runBackup},
+	"export":  {"export [--prefix p] [file], writes JSON lines of key and value", runExport},
+	"import":  {"import [file], reads the JSON lines written by export", runImport},
+}
+
+var commandOrder = []string{"get", "put", "del", "scan", "watch", "stats", "compact", "backup", "export", "import"}
+
+func usage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintln(w, "Usage: dbctl [flags] <command> [args]")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, name := range commandOrder {
+		fmt.Fprintf(w, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintln(w, "\nFlags:")
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+	fmt.Fprintf(w, "\nExit codes: %d ok, %d error, %d bad usage, %d key not found.\n", exitOK, exitError, exitUsage, exitNotFound)
+}
+
+// run executes the command line and returns the exit code.
+func run(ctx context.Context, args []string, getenv func(string) string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("dbctl", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	addr := getenv("DBCTL_ADDR")
+	if addr == "" {
+		addr = defaultAddr
+	}
+	fs.StringVar(&addr, "addr", addr, "base URL of the db server (DBCTL_ADDR)")
+	format := fs.String("o", "table", "output format: table or json")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout of a request, 0 disables it")
+	retries := fs.Int("retries", 2, "retries of a failed request")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			usage(stdout, fs)
+			return exitOK
+		}
+		fmt.Fprintln(stderr, "dbctl:", err)
+		usage(stderr, fs)
+		return exitUsage
+	}
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(stderr, "dbctl: unknown output format %s\n", *format)
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		usage(stderr, fs)
+		return exitUsage
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "dbctl: unknown command %s\n", fs.Arg(0))
+		usage(stderr, fs)
+		return exitUsage
+	}
+
+	client, err := dbclient.New(addr, dbclient.WithTimeout(*timeout), dbclient.WithRetries(*retries, 100*time.Millisecond))
+	if err != nil {
+		fmt.Fprintln(stderr, "dbctl:", err)
+		return exitUsage
+	}
+	e := &env{
+		client: client,
+		format: *format,
+		stdin:  stdin,
+		stdout: stdout,
+	}
+	err = cmd.run(ctx, e, fs.Args()[1:])
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errUsage):
+		fmt.Fprintf(stderr, "dbctl: %s\nUsage: dbctl %s\n", err, cmd.usage)
+		return exitUsage
+	case errors.Is(err, dbclient.ErrNotFound):
+		fmt.Fprintln(stderr, "dbctl:", err)
+		return exitNotFound
+	case errors.Is(err, context.Canceled):
+		return exitOK
+	}
+	fmt.Fprintln(stderr, "dbctl:", err)
+	return exitError
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, os.Args[1:], os.Getenv, os.Stdin, os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
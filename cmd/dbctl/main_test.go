@@ -0,0 +1,218 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDb serves the part of the cmd/db API which dbctl uses, with scan
+// pages of a single record.
+type fakeDb struct {
+	mu      sync.Mutex
+	values  map[string]string
+	batches int
+	backup  []byte
+}
+
+func (f *fakeDb) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	writeJSON := func(v interface{}) {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(v)
+	}
+	switch {
+	case req.URL.Path == "/db" && req.Method == http.MethodGet:
+		var keys []string
+		for key := range f.values {
+			if strings.HasPrefix(key, req.URL.Query().Get("prefix")) && key > req.URL.Query().Get("after") {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		page := map[string]interface{}{"records": []record{}}
+		if len(keys) > 0 {
+			page["records"] = []record{{keys[0], f.values[keys[0]]}}
+		}
+		if len(keys) > 1 {
+			page["next"] = keys[0]
+		}
+		writeJSON(page)
+	case req.URL.Path == "/db/_batch":
+		var body struct {
+			Ops []struct{ Key, Value string }
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		for _, op := range body.Ops {
+			f.values[op.Key] = op.Value
+		}
+		f.batches++
+		writeJSON(map[string]int{"applied": len(body.Ops)})
+	case strings.HasPrefix(req.URL.Path, "/db/"):
+		key := req.URL.Path[len("/db/"):]
+		value, ok := f.values[key]
+		if req.Method == http.MethodPost {
+			var body record
+			json.NewDecoder(req.Body).Decode(&body)
+			f.values[key] = body.Value
+			rw.WriteHeader(http.StatusCreated)
+			return
+		}
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			writeJSON(map[string]string{"code": "not_found", "message": "record does not exist"})
+			return
+		}
+		if req.Method == http.MethodDelete {
+			delete(f.values, key)
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(record{key, value})
+	case req.URL.Path == "/admin/stats":
+		writeJSON(map[string]interface{}{"raw_value_bytes": 42, "compression_ratio": 1})
+	case req.URL.Path == "/admin/compact":
+		rw.WriteHeader(http.StatusNoContent)
+	case req.URL.Path == "/admin/backup":
+		rw.Write(f.backup)
+	default:
+		rw.WriteHeader(http.StatusTeapot)
+	}
+}
+
+func TestRun(t *testing.T) {
+	db := &fakeDb{values: map[string]string{}}
+	server := httptest.NewServer(db)
+	defer server.Close()
+	getenv := func(name string) string {
+		if name == "DBCTL_ADDR" {
+			return server.URL
+		}
+		return ""
+	}
+	dbctl := func(stdin string, args ...string) (int, string, string) {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		code := run(context.Background(), args, getenv, strings.NewReader(stdin), &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	if code, _, _ := dbctl("", "put", "user:1", "alice"); code != exitOK {
+		t.Fatalf("Unexpected exit code %d of put", code)
+	}
+	if code, _, _ := dbctl("bob\n", "put", "user:2", "-"); code != exitOK || db.values["user:2"] != "bob\n" {
+		t.Fatalf("Expected the value to be read from stdin, got %d %q", code, db.values["user:2"])
+	}
+	code, out, _ := dbctl("", "get", "user:1")
+	if code != exitOK || out != "KEY     VALUE\nuser:1  alice\n" {
+		t.Errorf("Unexpected table output %d %q", code, out)
+	}
+	code, out, _ = dbctl("", "-o", "json", "get", "user:1")
+	if code != exitOK || out != `{"key":"user:1","value":"alice"}`+"\n" {
+		t.Errorf("Unexpected JSON output %d %q", code, out)
+	}
+	if code, _, errOut := dbctl("", "get", "missing"); code != exitNotFound || !strings.Contains(errOut, "record does not exist") {
+		t.Errorf("Expected the not found exit code, got %d %q", code, errOut)
+	}
+
+	db.values["other"] = "x"
+	code, out, _ = dbctl("", "-o", "json", "scan", "--prefix", "user:")
+	if code != exitOK || out != `{"key":"user:1","value":"alice"}`+"\n"+`{"key":"user:2","value":"bob\n"}`+"\n" {
+		t.Errorf("Unexpected scan output %d %q", code, out)
+	}
+
+	dir, err := ioutil.TempDir("", "test-dbctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exported := filepath.Join(dir, "export.jsonl")
+	if code, _, _ := dbctl("", "export", exported); code != exitOK {
+		t.Fatalf("Unexpected exit code %d of export", code)
+	}
+	db.values = map[string]string{}
+	code, out, _ = dbctl("", "import", exported)
+	if code != exitOK || out != "3 records imported\n" || len(db.values) != 3 || db.values["user:2"] != "bob\n" {
+		t.Errorf("Unexpected import %d %q %v", code, out, db.values)
+	}
+	if code, _, _ := dbctl("{bad", "import"); code != exitError {
+		t.Errorf("Expected an error for a bad record, got %d", code)
+	}
+
+	if code, _, _ := dbctl("", "del", "other"); code != exitOK || len(db.values) != 2 {
+		t.Errorf("Unexpected delete %d %v", code, db.values)
+	}
+	code, out, _ = dbctl("", "-o", "json", "stats")
+	if code != exitOK || !strings.Contains(out, `"raw_value_bytes":42`) {
+		t.Errorf("Unexpected stats %d %q", code, out)
+	}
+	if code, _, _ := dbctl("", "compact"); code != exitOK {
+		t.Errorf("Unexpected exit code %d of compact", code)
+	}
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: "current-data0", Mode: 0o600, Size: 4})
+	tw.Write([]byte("data"))
+	tw.Close()
+	db.backup = archive.Bytes()
+	if code, out, _ := dbctl("", "backup", "-"); code != exitOK || out != archive.String() {
+		t.Errorf("Unexpected backup %d %q", code, out)
+	}
+	// The server cut the archive short after the last file.
+	db.backup = archive.Bytes()[:archive.Len()-1024]
+	backup := filepath.Join(dir, "backup.tar")
+	if code, _, errOut := dbctl("", "backup", backup); code != exitError || !strings.Contains(errOut, "truncated") {
+		t.Errorf("Expected an error for a truncated backup, got %d %q", code, errOut)
+	}
+	if _, err := os.Stat(backup); !os.IsNotExist(err) {
+		t.Errorf("Expected the truncated backup to be removed, got %v", err)
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"unknown"},
+		{"get"},
+		{"put", "key"},
+		{"scan", "--bad"},
+		{"-o", "xml", "get", "key"},
+		{"-addr", "db:8083", "get", "key"},
+	} {
+		if code, _, _ := dbctl("", args...); code != exitUsage {
+			t.Errorf("Expected the usage exit code for %q, got %d", args, code)
+		}
+	}
+	if code, out, _ := dbctl("", "-h"); code != exitOK || !strings.Contains(out, "scan [--prefix p]") {
+		t.Errorf("Unexpected help %d %q", code, out)
+	}
+}
+
+func TestRunImportBatches(t *testing.T) {
+	db := &fakeDb{values: map[string]string{}}
+	server := httptest.NewServer(db)
+	defer server.Close()
+
+	var input strings.Builder
+	for i := 0; i < importBatchSize+1; i++ {
+		json.NewEncoder(&input).Encode(record{Key: fmt.Sprintf("key%03d", i), Value: "v"})
+	}
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"-addr", server.URL, "-o", "json", "import"}, func(string) string { return "" }, strings.NewReader(input.String()), &stdout, &stderr)
+	if code != exitOK || stdout.String() != `{"imported":501}`+"\n" {
+		t.Errorf("Unexpected import %d %q %q", code, stdout.String(), stderr.String())
+	}
+	if db.batches != 2 {
+		t.Errorf("Expected 2 batches, got %d", db.batches)
+	}
+}
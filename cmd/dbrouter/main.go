@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/hrystynaa/lab4-go/cluster"
+	"github.com/hrystynaa/lab4-go/httptools"
+	"github.com/hrystynaa/lab4-go/signal"
+)
+
+var (
+	listen   = flag.String("listen", ":8084", "HTTP listen address")
+	nodes    = flag.String("nodes", "http://db:8083", "comma separated base URLs of the db nodes")
+	vnodes   = flag.Int("vnodes", cluster.DefaultVirtualNodes, "points of every node on the hash ring, must be the same for every start")
+	timeout  = flag.Duration("timeout", 10*time.Second, "timeout of the requests the router makes to move keys, split batches and reach the replicas")
+	ringFile = flag.String("ring-file", "dbrouter-ring.json", "file which keeps the nodes which joined across restarts, empty to not keep them")
+
+	replicas       = flag.Int("replicas", 1, "nodes storing every key, with more than 1 the nodes are written and read with quorums")
+	readQuorum     = flag.Int("read-quorum", 0, "replicas which must answer a read, a majority if 0")
+	writeQuorum    = flag.Int("write-quorum", 0, "replicas which must acknowledge a write, a majority if 0")
+	tombstoneGrace = flag.Duration("tombstone-grace", 10*time.Minute, "age after which the tombstones of deleted keys are removed from the replicas, must exceed -timeout")
+)
+
+func main() {
+	flag.Parse()
+
+	ring, err := cluster.NewRing(*vnodes, strings.Split(*nodes, ",")...)
+	if err != nil {
+		log.Fatalf("Bad nodes: %s", err)
+	}
+	rt, err := newRouter(ring, *timeout)
+	if err != nil {
+		log.Fatalf("Bad nodes: %s", err)
+	}
+	if *replicas == 1 && *ringFile != "" {
+		if err := rt.restore(*ringFile); err != nil {
+			log.Fatalf("Cannot restore the ring: %s", err)
+		}
+	}
+	if *replicas > 1 {
+		q := cluster.DefaultQuorum(*replicas)
+		if *readQuorum != 0 {
+			q.R = *readQuorum
+		}
+		if *writeQuorum != 0 {
+			q.W = *writeQuorum
+		}
+		if err := rt.replicate(q); err != nil {
+			log.Fatalf("Bad quorum: %s", err)
+		}
+		if *tombstoneGrace <= *timeout {
+			log.Fatalf("The tombstone grace period %s must exceed the timeout %s", *tombstoneGrace, *timeout)
+		}
+		go rt.collectTombstones(*tombstoneGrace, nil)
+		log.Printf("Keeping %d replicas of every key, R=%d W=%d", q.N, q.R, q.W)
+	}
+
+	server := httptools.CreateServerOn(*listen, rt.handler())
+	log.Printf("Routing to %s", strings.Join(ring.Nodes(), ", "))
+	server.Start()
+	signal.WaitForTerminationSignal()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+var (
+	errMigrationRunning = errors.New("a node is already joining")
+	errNodeExists       = errors.New("node is already in the cluster")
+	errReplicated       = errors.New("nodes can't be added to a replicated cluster")
+	errMissingNode      = errors.New("node of the ring file is missing")
+)
+
+// Migration states.
+const (
+	migrationRunning = "running"
+	migrationDone    = "done"
+	migrationFailed  = "failed"
+)
+
+// migration is the progress of the last node which joined.
+type migration struct {
+	Node  string `json:"node"`
+	State string `json:"state"`
+	Moved int    `json:"moved"`
+	Error string `json:"error,omitempty"`
+}
+
+// addNode puts the node on the ring and moves its keys in background. A node
+// whose migration failed can be added again to resume it.
+func (rt *router) addNode(addr string) error {
+	if rt.replicated != nil {
+		return errReplicated
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	resume := rt.next != nil && rt.state.Node == addr && rt.state.State == migrationFailed
+	switch {
+	case resume:
+	case rt.next != nil:
+		return fmt.Errorf("%w: %s", errMigrationRunning, rt.state.Node)
+	case rt.ring.Has(addr):
+		return fmt.Errorf("%w: %s", errNodeExists, addr)
+	default:
+		n, err := newNode(addr, rt.timeout)
+		if err != nil {
+			return err
+		}
+		next, err := rt.ring.With(addr)
+		if err != nil {
+			return err
+		}
+		// The joining node is saved first, so that a restarted router
+		// resumes the migration.
+		state := rt.state
+		rt.next, rt.state = next, migration{Node: addr}
+		if err := rt.saveRing(); err != nil {
+			rt.next, rt.state = nil, state
+			return err
+		}
+		rt.nodes[addr] = n
+		rt.moved.Store(0)
+	}
+	rt.state.State = migrationRunning
+	rt.state.Error = ""
+	routed := rt.requests
+	rt.requests = new(sync.WaitGroup)
+	go rt.migrate(addr, rt.ring.Nodes(), routed)
+	return nil
+}
+
+// migrate moves the keys the node takes over from the other nodes and then
+// makes the new ring the current one. The requests routed before the node
+// joined are waited for first, as they don't move the keys they write.
+func (rt *router) migrate(addr string, from []string, routed *sync.WaitGroup) {
+	routed.Wait()
+	log.Printf("Moving the keys of %s", addr)
+	rt.mu.RLock()
+	next := rt.next
+	rt.mu.RUnlock()
+	ctx := context.Background()
+	var err error
+	for _, old := range from {
+		err = rt.node(old).client.Scan(ctx, "", func(key, _ string) error {
+			if next.Owner(key) != addr {
+				return nil
+			}
+			return rt.move(ctx, key, old, addr)
+		})
+		if err != nil {
+			break
+		}
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if err == nil {
+		ring := rt.ring
+		rt.ring, rt.next = next, nil
+		if err = rt.saveRing(); err != nil {
+			rt.ring, rt.next = ring, next
+		}
+	}
+	if err != nil {
+		log.Printf("Moving the keys of %s failed: %s", addr, err)
+		rt.state.State = migrationFailed
+		rt.state.Error = err.Error()
+		return
+	}
+	rt.state.State = migrationDone
+	log.Printf("Node %s joined after %d keys were moved, add it to -nodes", addr, rt.moved.Load())
+}
+
+// ringState is the ring saved to the ring file.
+type ringState struct {
+	VirtualNodes int      `json:"virtual_nodes"`
+	Nodes        []string `json:"nodes"`
+	Joining      string   `json:"joining,omitempty"`
+}
+
+// saveRing replaces the ring file with the current ring, if the file is
+// set. It must be called with rt.mu locked.
+func (rt *router) saveRing() error {
+	if rt.ringFile == "" {
+		return nil
+	}
+	state := ringState{VirtualNodes: rt.ring.VirtualNodes(), Nodes: rt.ring.Nodes()}
+	if rt.next != nil {
+		state.Joining = rt.state.Node
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := rt.ringFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("cannot save the ring: %w", err)
+	}
+	if err := os.Rename(tmp, rt.ringFile); err != nil {
+		return fmt.Errorf("cannot save the ring: %w", err)
+	}
+	return nil
+}
+
+// restore makes the router keep its ring in the file. Every node of the
+// ring saved by the last run must be in the ring of the router, otherwise
+// the keys moved to it would be lost. A node which was still joining is
+// added again to resume its migration.
+func (rt *router) restore(path string) error {
+	data, err := os.ReadFile(path)
+	var state ringState
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("bad ring file %s: %w", path, err)
+		}
+	}
+	if state.VirtualNodes != 0 && state.VirtualNodes != rt.ring.VirtualNodes() {
+		return fmt.Errorf("the ring file %s has %d virtual nodes, not %d", path, state.VirtualNodes, rt.ring.VirtualNodes())
+	}
+	for _, addr := range state.Nodes {
+		if !rt.ring.Has(addr) {
+			return fmt.Errorf("%w: %s is not in the nodes", errMissingNode, addr)
+		}
+	}
+	if state.Joining != "" && rt.ring.Has(state.Joining) {
+		return fmt.Errorf("node %s has not joined yet, it must not be in the nodes", state.Joining)
+	}
+
+	rt.mu.Lock()
+	rt.ringFile = path
+	err = rt.saveRing()
+	rt.mu.Unlock()
+	if err != nil || state.Joining == "" {
+		return err
+	}
+	log.Printf("Resuming the migration of %s", state.Joining)
+	return rt.addNode(state.Joining)
+}
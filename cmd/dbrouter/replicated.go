@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/hrystynaa/lab4-go/cluster"
+	"github.com/hrystynaa/lab4-go/dbclient"
+)
+
+// replicate makes the router keep every key on q.N nodes instead of moving
+// it to a single owner. The values are stored on the nodes as
+// cluster.Versioned records, so a cluster can't be switched between the modes.
+func (rt *router) replicate(q cluster.Quorum) error {
+	clients := make(map[string]*dbclient.Client, len(rt.nodes))
+	for addr, n := range rt.nodes {
+		clients[addr] = n.client
+	}
+	rp, err := cluster.NewReplicated(rt.ring, clients, q, cluster.WithTimeout(rt.timeout))
+	if err != nil {
+		return err
+	}
+	rt.replicated = rp
+	return nil
+}
+
+// collectTombstones removes the tombstones older than grace from the nodes
+// every grace period, until stop is closed.
+func (rt *router) collectTombstones(grace time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(grace)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), grace)
+			n, err := rt.replicated.CollectTombstones(ctx, grace)
+			cancel()
+			if err != nil {
+				log.Printf("Cannot collect tombstones: %s", err)
+			} else if n > 0 {
+				log.Printf("Collected %d tombstones", n)
+			}
+		}
+	}
+}
+
+// writeReplicaError relays the client errors of the nodes, like invalid keys,
+// and reports the missing quorums.
+func writeReplicaError(rw http.ResponseWriter, err error) {
+	var nodeErr *dbclient.Error
+	switch {
+	case errors.Is(err, dbclient.ErrNotFound):
+		dbclient.WriteError(rw, http.StatusNotFound, "not_found", "record does not exist")
+	case errors.As(err, &nodeErr) && nodeErr.Code != "" && nodeErr.StatusCode < 500:
+		dbclient.WriteError(rw, nodeErr.StatusCode, nodeErr.Code, nodeErr.Message)
+	case errors.Is(err, cluster.ErrNoQuorum):
+		dbclient.WriteError(rw, http.StatusServiceUnavailable, "no_quorum", err.Error())
+	default:
+		dbclient.WriteError(rw, http.StatusBadGateway, "bad_gateway", err.Error())
+	}
+}
+
+// serveReplicated serves GET, POST and DELETE of a key with the quorums.
+func (rt *router) serveReplicated(rw http.ResponseWriter, req *http.Request, key string) {
+	if req.URL.Query().Has("path") {
+		dbclient.WriteError(rw, http.StatusNotImplemented, "not_implemented", "paths are not supported by a replicated cluster")
+		return
+	}
+	rp := rt.replicated
+	switch req.Method {
+	case http.MethodGet:
+		value, err := rp.Get(req.Context(), key)
+		if err != nil {
+			writeReplicaError(rw, err)
+			return
+		}
+		writeJSON(rw, http.StatusOK, dbclient.Record{Key: key, Value: value})
+
+	case http.MethodPost:
+		var body struct {
+			Value string `json:"value"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			dbclient.WriteError(rw, http.StatusBadRequest, "bad_request", "bad request body: "+err.Error())
+			return
+		}
+		if err := rp.Put(req.Context(), key, body.Value); err != nil {
+			writeReplicaError(rw, err)
+			return
+		}
+		rw.WriteHeader(http.StatusCreated)
+
+	case http.MethodDelete:
+		if err := rp.Delete(req.Context(), key); err != nil {
+			writeReplicaError(rw, err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+
+	default:
+		rw.Header().Set("Allow", "GET, POST, DELETE")
+		dbclient.WriteError(rw, http.StatusMethodNotAllowed, "method_not_allowed", fmt.Sprintf("method %s is not allowed", req.Method))
+	}
+}
+
+// replicatedMGet reads every key with the read quorum.
+func (rt *router) replicatedMGet(rw http.ResponseWriter, req *http.Request, keys []string) {
+	values := make(map[string]mgetResult, len(keys))
+	for _, key := range keys {
+		value, err := rt.replicated.Get(req.Context(), key)
+		if errors.Is(err, dbclient.ErrNotFound) {
+			values[key] = mgetResult{}
+			continue
+		} else if err != nil {
+			writeReplicaError(rw, err)
+			return
+		}
+		values[key] = mgetResult{Found: true, Value: value}
+	}
+	writeJSON(rw, http.StatusOK, map[string]interface{}{"values": values})
+}
+
+// replicatedBatch applies the operations one by one, with the write quorum.
+// The batch is not atomic, the operations before a failed one stay applied.
+func (rt *router) replicatedBatch(rw http.ResponseWriter, req *http.Request, ops []dbclient.Op) {
+	for i, op := range ops {
+		var err error
+		if op.Delete {
+			err = rt.replicated.Delete(req.Context(), op.Key)
+			if errors.Is(err, dbclient.ErrNotFound) {
+				err = nil
+			}
+		} else {
+			err = rt.replicated.Put(req.Context(), op.Key, op.Value)
+		}
+		if err != nil {
+			writeReplicaError(rw, fmt.Errorf("operation %d: %w", i, err))
+			return
+		}
+	}
+	writeJSON(rw, http.StatusOK, map[string]int{"applied": len(ops)})
+}
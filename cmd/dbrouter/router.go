@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hrystynaa/lab4-go/cluster"
+	"github.com/hrystynaa/lab4-go/dbclient"
+)
+
+const (
+	keyLockStripes   = 256
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+// writeNodeError relays the error of a node or reports that it can't be
+// reached.
+func writeNodeError(rw http.ResponseWriter, node string, err error) {
+	var nodeErr *dbclient.Error
+	if errors.As(err, &nodeErr) && nodeErr.Code != "" {
+		dbclient.WriteError(rw, nodeErr.StatusCode, nodeErr.Code, nodeErr.Message)
+		return
+	}
+	dbclient.WriteError(rw, http.StatusBadGateway, "bad_gateway", fmt.Sprintf("node %s: %s", node, err))
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(v)
+}
+
+// node is a db server the router forwards to.
+type node struct {
+	client *dbclient.Client
+	proxy  *httputil.ReverseProxy
+}
+
+func newNode(addr string, timeout time.Duration) (*node, error) {
+	client, err := dbclient.New(addr, dbclient.WithTimeout(timeout))
+	if err != nil {
+		return nil, err
+	}
+	target, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// The router has set the same id already.
+		resp.Header.Del(dbclient.RequestIDHeader)
+		return nil
+	}
+	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		log.Printf("Cannot forward %s %s to %s: %s", req.Method, req.URL.Path, addr, err)
+		dbclient.WriteError(rw, http.StatusBadGateway, "bad_gateway", fmt.Sprintf("node %s is unavailable", addr))
+	}
+	return &node{client: client, proxy: proxy}, nil
+}
+
+// router forwards the requests of cmd/db to the nodes which own the keys.
+// While a node joins, the keys it takes over are moved to it in background
+// and on first use, so every key lives on a single node at any time. Only
+// one router may serve a cluster, as the moves are coordinated by it. A
+// replicated cluster has a fixed set of nodes instead.
+type router struct {
+	timeout time.Duration
+
+	mu    sync.RWMutex
+	ring  *cluster.Ring
+	next  *cluster.Ring // the ring with the joining node, nil otherwise
+	nodes map[string]*node
+	state migration
+	// requests are the requests to the nodes routed with the current rings.
+	requests *sync.WaitGroup
+	// ringFile keeps the ring across restarts if it is set.
+	ringFile string
+	// moved counts the keys moved to the joining node, also by requests.
+	moved atomic.Int64
+	// replicated serves the keys if they have several replicas.
+	replicated *cluster.Replicated
+
+	keyLocks [keyLockStripes]sync.Mutex
+}
+
+func newRouter(ring *cluster.Ring, timeout time.Duration) (*router, error) {
+	rt := &router{
+		timeout:  timeout,
+		ring:     ring,
+		nodes:    make(map[string]*node),
+		requests: new(sync.WaitGroup),
+	}
+	for _, addr := range ring.Nodes() {
+		n, err := newNode(addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		rt.nodes[addr] = n
+	}
+	return rt, nil
+}
+
+func (rt *router) keyLock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &rt.keyLocks[h.Sum32()%keyLockStripes]
+}
+
+// node returns the node with the address.
+func (rt *router) node(addr string) *node {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.nodes[addr]
+}
+
+// route returns the node of the key and, if the key is taken over by a
+// joining node, the node it has to be moved from first. It must be called
+// with rt.mu read locked.
+func (rt *router) route(key string) (owner, from string) {
+	owner = rt.ring.Owner(key)
+	if rt.next == nil {
+		return owner, ""
+	}
+	if next := rt.next.Owner(key); next != owner {
+		return next, owner
+	}
+	return owner, ""
+}
+
+// owners returns the nodes of the keys, moving the keys taken over by a
+// joining node first. The lock is held only to read the rings, so the
+// caller must call done once its requests to the owners are over: a node
+// which joins meanwhile waits for them before moving keys.
+func (rt *router) owners(ctx context.Context, keys ...string) (owners []string, done func(), err error) {
+	rt.mu.RLock()
+	routed := rt.requests
+	routed.Add(1)
+	owners = make([]string, len(keys))
+	from := make([]string, len(keys))
+	for i, key := range keys {
+		owners[i], from[i] = rt.route(key)
+	}
+	rt.mu.RUnlock()
+	for i, key := range keys {
+		if from[i] == "" {
+			continue
+		}
+		if err := rt.move(ctx, key, from[i], owners[i]); err != nil {
+			routed.Done()
+			return nil, nil, err
+		}
+	}
+	return owners, routed.Done, nil
+}
+
+// move copies the key with its metadata, such as memcached flags and the
+// expiration time, to the node and deletes it from the old one. The node
+// stores the value and the metadata in one batch. Moving a key which is not
+// on the old node does nothing.
+func (rt *router) move(ctx context.Context, key, from, to string) error {
+	l := rt.keyLock(key)
+	l.Lock()
+	defer l.Unlock()
+	src, dst := rt.node(from), rt.node(to)
+	value, meta, err := src.client.GetWithMeta(ctx, key)
+	if errors.Is(err, dbclient.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cannot read %s from %s: %w", key, from, err)
+	}
+	if err := dst.client.PutWithMeta(ctx, key, value, meta); err != nil {
+		return fmt.Errorf("cannot copy %s to %s: %w", key, to, err)
+	}
+	if err := src.client.Delete(ctx, key); err != nil && !errors.Is(err, dbclient.ErrNotFound) {
+		return fmt.Errorf("cannot delete %s from %s: %w", key, from, err)
+	}
+	rt.moved.Add(1)
+	return nil
+}
+
+// allNodes returns the nodes which may hold keys. It must be called with
+// rt.mu read locked.
+func (rt *router) allNodes() []string {
+	if rt.next != nil {
+		return rt.next.Nodes()
+	}
+	return rt.ring.Nodes()
+}
+
+func (rt *router) serveKey(rw http.ResponseWriter, req *http.Request) {
+	key := strings.TrimPrefix(req.URL.Path, "/db/")
+	incr := false
+	if req.Method == http.MethodPost {
+		switch key {
+		case "_mget":
+			rt.serveMGet(rw, req)
+			return
+		case "_batch":
+			rt.serveBatch(rw, req)
+			return
+		}
+		incr = strings.HasSuffix(key, "/incr")
+		key = strings.TrimSuffix(key, "/incr")
+	}
+	if key == "_watch" {
+		dbclient.WriteError(rw, http.StatusNotImplemented, "not_implemented", "watch is not supported by the router, watch the nodes")
+		return
+	}
+	if key == "" {
+		dbclient.WriteError(rw, http.StatusBadRequest, "invalid_key", "empty key")
+		return
+	}
+	if rt.replicated != nil {
+		if incr {
+			dbclient.WriteError(rw, http.StatusNotImplemented, "not_implemented", "incr is not supported by a replicated cluster")
+			return
+		}
+		rt.serveReplicated(rw, req, key)
+		return
+	}
+	rt.proxyKey(rw, req, key)
+}
+
+// proxyKey passes the request to the owner of the key.
+func (rt *router) proxyKey(rw http.ResponseWriter, req *http.Request, key string) {
+	owners, done, err := rt.owners(req.Context(), key)
+	if err != nil {
+		dbclient.WriteError(rw, http.StatusBadGateway, "bad_gateway", err.Error())
+		return
+	}
+	defer done()
+	rt.node(owners[0]).proxy.ServeHTTP(rw, req)
+}
+
+type mgetResult struct {
+	Found bool   `json:"found"`
+	Value string `json:"value,omitempty"`
+}
+
+// serveMGet splits the keys of POST /db/_mget by node.
+func (rt *router) serveMGet(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		dbclient.WriteError(rw, http.StatusBadRequest, "bad_request", "bad request body: "+err.Error())
+		return
+	}
+	if rt.replicated != nil {
+		rt.replicatedMGet(rw, req, body.Keys)
+		return
+	}
+
+	owners, done, err := rt.owners(req.Context(), body.Keys...)
+	if err != nil {
+		dbclient.WriteError(rw, http.StatusBadGateway, "bad_gateway", err.Error())
+		return
+	}
+	defer done()
+	byNode := make(map[string][]string)
+	for i, key := range body.Keys {
+		byNode[owners[i]] = append(byNode[owners[i]], key)
+	}
+	values := make(map[string]mgetResult, len(body.Keys))
+	for owner, keys := range byNode {
+		found, err := rt.node(owner).client.MGet(req.Context(), keys...)
+		if err != nil {
+			writeNodeError(rw, owner, err)
+			return
+		}
+		for _, key := range keys {
+			value, ok := found[key]
+			values[key] = mgetResult{Found: ok, Value: value}
+		}
+	}
+	writeJSON(rw, http.StatusOK, map[string]interface{}{"values": values})
+}
+
+// serveBatch splits the operations of POST /db/_batch by node. The part of
+// every node is applied atomically, the batch as a whole is not: if a node
+// fails, the parts applied by the other nodes stay.
+func (rt *router) serveBatch(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Ops []struct {
+			Op    string `json:"op"`
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"ops"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		dbclient.WriteError(rw, http.StatusBadRequest, "bad_request", "bad request body: "+err.Error())
+		return
+	}
+	ops := make([]dbclient.Op, 0, len(body.Ops))
+	for i, op := range body.Ops {
+		if op.Op != "put" && op.Op != "delete" {
+			dbclient.WriteError(rw, http.StatusBadRequest, "bad_request", fmt.Sprintf("operation %d: unknown op %q", i, op.Op))
+			return
+		}
+		ops = append(ops, dbclient.Op{Key: op.Key, Value: op.Value, Delete: op.Op == "delete"})
+	}
+	if rt.replicated != nil {
+		rt.replicatedBatch(rw, req, ops)
+		return
+	}
+
+	keys := make([]string, len(ops))
+	for i, op := range ops {
+		keys[i] = op.Key
+	}
+	owners, done, err := rt.owners(req.Context(), keys...)
+	if err != nil {
+		dbclient.WriteError(rw, http.StatusBadGateway, "bad_gateway", err.Error())
+		return
+	}
+	defer done()
+	byNode := make(map[string][]dbclient.Op)
+	var order []string
+	for i, op := range ops {
+		owner := owners[i]
+		if _, ok := byNode[owner]; !ok {
+			order = append(order, owner)
+		}
+		byNode[owner] = append(byNode[owner], op)
+	}
+	applied := 0
+	for _, owner := range order {
+		if err := rt.node(owner).client.Batch(req.Context(), byNode[owner]); err != nil {
+			writeNodeError(rw, owner, err)
+			return
+		}
+		applied += len(byNode[owner])
+	}
+	writeJSON(rw, http.StatusOK, map[string]int{"applied": applied})
+}
+
+// serveScan merges the pages of GET /db?prefix= of all the nodes.
+func (rt *router) serveScan(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		dbclient.WriteError(rw, http.StatusMethodNotAllowed, "method_not_allowed", fmt.Sprintf("method %s is not allowed", req.Method))
+		return
+	}
+	query := req.URL.Query()
+	if !query.Has("prefix") {
+		dbclient.WriteError(rw, http.StatusNotImplemented, "not_implemented", "only scans with prefix are supported by the router")
+		return
+	}
+	limit := defaultScanLimit
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxScanLimit {
+			dbclient.WriteError(rw, http.StatusBadRequest, "bad_request", fmt.Sprintf("limit must be from 1 to %d", maxScanLimit))
+			return
+		}
+		limit = n
+	}
+	res := struct {
+		Records []dbclient.Record `json:"records"`
+		Next    string            `json:"next,omitempty"`
+	}{Records: make([]dbclient.Record, 0, limit)}
+	if rt.replicated != nil {
+		records, next, err := rt.replicated.ScanPage(req.Context(), query.Get("prefix"), query.Get("after"), limit)
+		if err != nil {
+			writeReplicaError(rw, err)
+			return
+		}
+		res.Records = append(res.Records, records...)
+		res.Next = next
+		writeJSON(rw, http.StatusOK, res)
+		return
+	}
+
+	rt.mu.RLock()
+	nodes := rt.allNodes()
+	joining := rt.next
+	rt.mu.RUnlock()
+	found := make(map[string]int)
+	var records []dbclient.Record
+	more := false
+	for _, addr := range nodes {
+		page, next, err := rt.node(addr).client.ScanPage(req.Context(), query.Get("prefix"), query.Get("after"), limit)
+		if err != nil {
+			writeNodeError(rw, addr, err)
+			return
+		}
+		more = more || next != ""
+		for _, r := range page {
+			// A key being moved may be seen on both nodes, the value of the
+			// node which takes it over is the current one.
+			if i, ok := found[r.Key]; !ok {
+				found[r.Key] = len(records)
+				records = append(records, r)
+			} else if joining != nil && joining.Owner(r.Key) == addr {
+				records[i] = r
+			}
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	if len(records) > limit {
+		records, more = records[:limit], true
+	}
+	res.Records = append(res.Records, records...)
+	if more && len(records) > 0 {
+		res.Next = records[len(records)-1].Key
+	}
+	writeJSON(rw, http.StatusOK, res)
+}
+
+// ShardMap is the body of GET /cluster/shards.
+type ShardMap struct {
+	VirtualNodes int         `json:"virtual_nodes"`
+	Nodes        []NodeShare `json:"nodes"`
+	Migration    *migration  `json:"migration,omitempty"`
+	// Quorum is set if the keys have several replicas.
+	Quorum  *cluster.Quorum `json:"quorum,omitempty"`
+	Repairs int64           `json:"repairs,omitempty"`
+	// Owner is the node of the key query parameter, Replicas are all the
+	// nodes which store it.
+	Owner    string   `json:"owner,omitempty"`
+	Replicas []string `json:"replicas,omitempty"`
+}
+
+// NodeShare is a node with the part of the hash space it owns.
+type NodeShare struct {
+	Node  string  `json:"node"`
+	Share float64 `json:"share"`
+}
+
+func (rt *router) shardMap(key string) ShardMap {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	ring := rt.ring
+	m := ShardMap{VirtualNodes: ring.VirtualNodes()}
+	if rt.state.Node != "" {
+		state := rt.state
+		state.Moved = int(rt.moved.Load())
+		m.Migration = &state
+	}
+	if rt.next != nil {
+		// The keys are already served by the joining node.
+		ring = rt.next
+	}
+	shares := ring.Shares()
+	for _, n := range ring.Nodes() {
+		m.Nodes = append(m.Nodes, NodeShare{Node: n, Share: shares[n]})
+	}
+	if key != "" {
+		m.Owner = ring.Owner(key)
+	}
+	if rt.replicated != nil {
+		q := rt.replicated.Quorum()
+		m.Quorum = &q
+		m.Repairs = rt.replicated.Repairs()
+		if key != "" {
+			m.Replicas = ring.Owners(key, q.N)
+		}
+	}
+	return m
+}
+
+func (rt *router) serveShards(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		dbclient.WriteError(rw, http.StatusMethodNotAllowed, "method_not_allowed", fmt.Sprintf("method %s is not allowed", req.Method))
+		return
+	}
+	writeJSON(rw, http.StatusOK, rt.shardMap(req.URL.Query().Get("key")))
+}
+
+// serveNodes adds the node of POST /cluster/nodes and starts moving its keys.
+func (rt *router) serveNodes(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		dbclient.WriteError(rw, http.StatusMethodNotAllowed, "method_not_allowed", fmt.Sprintf("method %s is not allowed", req.Method))
+		return
+	}
+	var body struct {
+		Node string `json:"node"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		dbclient.WriteError(rw, http.StatusBadRequest, "bad_request", "bad request body: "+err.Error())
+		return
+	}
+	err := rt.addNode(body.Node)
+	switch {
+	case errors.Is(err, errReplicated):
+		dbclient.WriteError(rw, http.StatusNotImplemented, "not_implemented", err.Error())
+		return
+	case errors.Is(err, errMigrationRunning), errors.Is(err, errNodeExists):
+		dbclient.WriteError(rw, http.StatusConflict, "conflict", err.Error())
+		return
+	case err != nil:
+		dbclient.WriteError(rw, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	writeJSON(rw, http.StatusAccepted, rt.shardMap(""))
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(id)
+}
+
+func (rt *router) handler() http.Handler {
+	h := new(http.ServeMux)
+	h.HandleFunc("/db", rt.serveScan)
+	h.HandleFunc("/db/", rt.serveKey)
+	h.HandleFunc("/cluster/shards", rt.serveShards)
+	h.HandleFunc("/cluster/nodes", rt.serveNodes)
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// The request id is passed on to the nodes.
+		if req.Header.Get(dbclient.RequestIDHeader) == "" {
+			req.Header.Set(dbclient.RequestIDHeader, newRequestID())
+		}
+		rw.Header().Set(dbclient.RequestIDHeader, req.Header.Get(dbclient.RequestIDHeader))
+		h.ServeHTTP(rw, req)
+	})
+}
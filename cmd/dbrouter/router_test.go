@@ -0,0 +1,617 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hrystynaa/lab4-go/cluster"
+	"github.com/hrystynaa/lab4-go/datastore"
+	"github.com/hrystynaa/lab4-go/dbclient"
+)
+
+// testMetaPrefix is the prefix of the hidden keys cmd/db stores the metadata
+// of a key in.
+const testMetaPrefix = "\x00meta:"
+
+// testNode serves the part of the cmd/db API the router uses from a
+// MemStore.
+func testNode(t *testing.T) (*httptest.Server, *datastore.MemStore) {
+	db := datastore.NewMemStore()
+	notFound := func(rw http.ResponseWriter) {
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(dbclient.ErrorResponse{Code: "not_found", Message: "record does not exist"})
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		key := strings.TrimPrefix(req.URL.Path, "/db/")
+		switch {
+		case req.URL.Path == "/db":
+			q := req.URL.Query()
+			limit, _ := strconv.Atoi(q.Get("limit"))
+			res := struct {
+				Records []dbclient.Record `json:"records"`
+				Next    string            `json:"next,omitempty"`
+			}{Records: []dbclient.Record{}}
+			db.Scan(q.Get("prefix"), func(key, value string) error {
+				if key <= q.Get("after") || strings.HasPrefix(key, testMetaPrefix) {
+					return nil
+				}
+				if len(res.Records) == limit {
+					res.Next = res.Records[limit-1].Key
+					return errors.New("page is full")
+				}
+				res.Records = append(res.Records, dbclient.Record{Key: key, Value: value})
+				return nil
+			})
+			json.NewEncoder(rw).Encode(res)
+		case key == "_mget":
+			var body struct{ Keys []string }
+			json.NewDecoder(req.Body).Decode(&body)
+			values := make(map[string]mgetResult)
+			for _, key := range body.Keys {
+				value, err := db.Get(key)
+				values[key] = mgetResult{Found: err == nil, Value: value}
+			}
+			json.NewEncoder(rw).Encode(map[string]interface{}{"values": values})
+		case key == "_batch":
+			var body struct {
+				Ops []struct{ Op, Key, Value string }
+			}
+			json.NewDecoder(req.Body).Decode(&body)
+			var ops []datastore.BatchOp
+			for _, op := range body.Ops {
+				ops = append(ops, datastore.BatchOp{Key: op.Key, Value: op.Value, Delete: op.Op == "delete"})
+			}
+			db.WriteBatch(ops)
+			json.NewEncoder(rw).Encode(map[string]int{"applied": len(ops)})
+		case req.Method == http.MethodPost:
+			var body struct {
+				Value string
+				Meta  dbclient.Meta
+			}
+			json.NewDecoder(req.Body).Decode(&body)
+			ops := []datastore.BatchOp{{Key: key, Value: body.Value}}
+			if body.Meta == (dbclient.Meta{}) {
+				ops = append(ops, datastore.BatchOp{Key: testMetaPrefix + key, Delete: true})
+			} else {
+				meta, _ := json.Marshal(body.Meta)
+				ops = append(ops, datastore.BatchOp{Key: testMetaPrefix + key, Value: string(meta)})
+			}
+			db.WriteBatch(ops)
+			rw.WriteHeader(http.StatusCreated)
+		case req.Method == http.MethodDelete:
+			if db.Delete(key) != nil {
+				notFound(rw)
+				return
+			}
+			db.Delete(testMetaPrefix + key)
+			rw.WriteHeader(http.StatusNoContent)
+		default:
+			value, err := db.Get(key)
+			if err != nil {
+				notFound(rw)
+				return
+			}
+			res := struct {
+				Key   string         `json:"key"`
+				Value string         `json:"value"`
+				Meta  *dbclient.Meta `json:"meta,omitempty"`
+			}{Key: key, Value: value}
+			if req.URL.Query().Has("meta") {
+				res.Meta = new(dbclient.Meta)
+				if meta, err := db.Get(testMetaPrefix + key); err == nil {
+					json.Unmarshal([]byte(meta), res.Meta)
+				}
+			}
+			json.NewEncoder(rw).Encode(res)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, db
+}
+
+func testRouter(t *testing.T, nodes ...string) (*router, *dbclient.Client) {
+	ring, err := cluster.NewRing(cluster.DefaultVirtualNodes, nodes...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err := newRouter(ring, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(rt.handler())
+	t.Cleanup(server.Close)
+	c, err := dbclient.New(server.URL, dbclient.WithRetries(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rt, c
+}
+
+func TestRouter(t *testing.T) {
+	node1, db1 := testNode(t)
+	node2, db2 := testNode(t)
+	rt, c := testRouter(t, node1.URL, node2.URL)
+	ctx := context.Background()
+
+	for i := 0; i < 50; i++ {
+		if err := c.Put(ctx, fmt.Sprintf("key%02d", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	counts := map[string]int{node1.URL: 0, node2.URL: 0}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		owner := rt.ring.Owner(key)
+		counts[owner]++
+		db := db1
+		if owner == node2.URL {
+			db = db2
+		}
+		if value, err := db.Get(key); err != nil || value != fmt.Sprint(i) {
+			t.Errorf("Expected %s on its owner %s, got %q %v", key, owner, value, err)
+		}
+		if value, err := c.Get(ctx, key); err != nil || value != fmt.Sprint(i) {
+			t.Errorf("Unexpected value of %s %q %v", key, value, err)
+		}
+	}
+	if counts[node1.URL] == 0 || counts[node2.URL] == 0 {
+		t.Errorf("Expected the keys on both nodes, got %v", counts)
+	}
+	if _, err := c.Get(ctx, "missing"); !errors.Is(err, dbclient.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	err := c.Batch(ctx, []dbclient.Op{{Key: "key00", Delete: true}, {Key: "new1", Value: "a"}, {Key: "new2", Value: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := c.MGet(ctx, "key00", "key01", "new1", "new2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 3 || values["key01"] != "1" || values["new2"] != "b" {
+		t.Errorf("Unexpected values %v", values)
+	}
+
+	var keys []string
+	records, next, err := c.ScanPage(ctx, "key", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(records) > 0 {
+		for _, r := range records {
+			keys = append(keys, r.Key)
+		}
+		if next == "" {
+			break
+		}
+		if records, next, err = c.ScanPage(ctx, "key", next, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(keys) != 49 || keys[0] != "key01" || keys[48] != "key49" {
+		t.Errorf("Expected the 49 keys in order, got %d %v", len(keys), keys)
+	}
+
+	m := rt.shardMap("key01")
+	if len(m.Nodes) != 2 || m.Owner != rt.ring.Owner("key01") || m.Migration != nil {
+		t.Errorf("Unexpected shard map %+v", m)
+	}
+}
+
+func TestRouter_AddNode(t *testing.T) {
+	node1, db1 := testNode(t)
+	node2, db2 := testNode(t)
+	node3, db3 := testNode(t)
+	rt, c := testRouter(t, node1.URL, node2.URL)
+	ctx := context.Background()
+
+	const n = 300
+	for i := 0; i < n; i++ {
+		if err := c.Put(ctx, fmt.Sprintf("key%03d", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := rt.addNode(node1.URL); !errors.Is(err, errNodeExists) {
+		t.Errorf("Expected errNodeExists, got %v", err)
+	}
+	if err := rt.addNode(node3.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.addNode("http://other:8083"); !errors.Is(err, errMigrationRunning) {
+		t.Errorf("Expected errMigrationRunning, got %v", err)
+	}
+	// The keys are read while they are moved in background.
+	for i := 0; i < n; i += 7 {
+		key := fmt.Sprintf("key%03d", i)
+		if value, err := c.Get(ctx, key); err != nil || value != fmt.Sprint(i) {
+			t.Errorf("Unexpected value of %s during the migration %q %v", key, value, err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rt.shardMap("").Migration.State != migrationDone {
+		if time.Now().After(deadline) {
+			t.Fatalf("Migration did not finish: %+v", rt.shardMap("").Migration)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m := rt.shardMap("")
+	if len(m.Nodes) != 3 || m.Migration.Moved == 0 {
+		t.Errorf("Unexpected shard map %+v", m)
+	}
+	moved := 0
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		owner := rt.ring.Owner(key)
+		for addr, db := range map[string]*datastore.MemStore{node1.URL: db1, node2.URL: db2, node3.URL: db3} {
+			_, err := db.Get(key)
+			if addr == owner && err != nil {
+				t.Errorf("Expected %s on its owner %s", key, owner)
+			} else if addr != owner && err == nil {
+				t.Errorf("Expected %s to be only on %s, found on %s", key, owner, addr)
+			}
+		}
+		if owner == node3.URL {
+			moved++
+		}
+		if value, err := c.Get(ctx, key); err != nil || value != fmt.Sprint(i) {
+			t.Errorf("Unexpected value of %s %q %v", key, value, err)
+		}
+	}
+	if moved == 0 || moved != m.Migration.Moved {
+		t.Errorf("Expected %d moved keys, the migration reports %d", moved, m.Migration.Moved)
+	}
+}
+
+func TestRouter_AddNodeKeepsMeta(t *testing.T) {
+	node1, db1 := testNode(t)
+	node2, db2 := testNode(t)
+	rt, c := testRouter(t, node1.URL)
+	ctx := context.Background()
+
+	expires := time.Now().Add(time.Hour).UnixMilli()
+	const n = 50
+	for i := 0; i < n; i++ {
+		meta := dbclient.Meta{Flags: uint32(i + 1), Expires: expires}
+		if err := c.PutWithMeta(ctx, fmt.Sprintf("key%02d", i), fmt.Sprint(i), meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rt.addNode(node2.URL); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for rt.shardMap("").Migration.State != migrationDone {
+		if time.Now().After(deadline) {
+			t.Fatalf("Migration did not finish: %+v", rt.shardMap("").Migration)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	moved := 0
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		if rt.ring.Owner(key) != node2.URL {
+			continue
+		}
+		moved++
+		if _, err := db1.Get(testMetaPrefix + key); err != datastore.ErrNotFound {
+			t.Errorf("Expected the metadata of %s to be deleted from the old node, got %v", key, err)
+		}
+		var meta dbclient.Meta
+		if value, err := db2.Get(testMetaPrefix + key); err != nil {
+			t.Errorf("Expected the metadata of %s on the new node, got %v", key, err)
+		} else if err := json.Unmarshal([]byte(value), &meta); err != nil {
+			t.Error(err)
+		}
+		if meta != (dbclient.Meta{Flags: uint32(i + 1), Expires: expires}) {
+			t.Errorf("Unexpected metadata of %s %+v", key, meta)
+		}
+		if value, got, err := c.GetWithMeta(ctx, key); err != nil || value != fmt.Sprint(i) || got != meta {
+			t.Errorf("Unexpected value of %s %q %+v %v", key, value, got, err)
+		}
+	}
+	if moved == 0 {
+		t.Fatal("Expected some keys to move to the new node")
+	}
+}
+
+func TestRouter_Errors(t *testing.T) {
+	node, _ := testNode(t)
+	_, c := testRouter(t, node.URL)
+	rt, down := testRouter(t, "http://127.0.0.1:1")
+	ctx := context.Background()
+
+	var nodeErr *dbclient.Error
+	if _, err := down.Get(ctx, "key"); !errors.As(err, &nodeErr) || nodeErr.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502 for a node which is down, got %v", err)
+	}
+	if err := c.Watch(ctx, "", func(dbclient.Event) error { return nil }); !errors.Is(err, dbclient.ErrNotImplemented) {
+		t.Errorf("Expected watch to be not implemented, got %v", err)
+	}
+	if err := rt.addNode("db:8083"); err == nil {
+		t.Error("Expected an error for a node without a scheme")
+	}
+}
+
+func TestRouter_Replicated(t *testing.T) {
+	node1, db1 := testNode(t)
+	node2, db2 := testNode(t)
+	node3, db3 := testNode(t)
+	rt, c := testRouter(t, node1.URL, node2.URL, node3.URL)
+	if err := rt.replicate(cluster.Quorum{N: 2, R: 1, W: 3}); err == nil {
+		t.Error("Expected an error for a write quorum above the replicas")
+	}
+	if err := rt.replicate(cluster.Quorum{N: 2, R: 1, W: 2}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 30; i++ {
+		if err := c.Put(ctx, fmt.Sprintf("key%02d", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rt.replicated.Wait()
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		m := rt.shardMap(key)
+		if len(m.Replicas) != 2 || m.Replicas[0] != m.Owner || m.Quorum.N != 2 {
+			t.Fatalf("Unexpected shard map %+v", m)
+		}
+		found := 0
+		for addr, db := range map[string]*datastore.MemStore{node1.URL: db1, node2.URL: db2, node3.URL: db3} {
+			if _, err := db.Get(key); err == nil {
+				found++
+				if addr != m.Replicas[0] && addr != m.Replicas[1] {
+					t.Errorf("Expected %s only on %v, found on %s", key, m.Replicas, addr)
+				}
+			}
+		}
+		if found != 2 {
+			t.Errorf("Expected %s on 2 nodes, found on %d", key, found)
+		}
+		if value, err := c.Get(ctx, key); err != nil || value != fmt.Sprint(i) {
+			t.Errorf("Unexpected value of %s %q %v", key, value, err)
+		}
+	}
+
+	if err := c.Delete(ctx, "key00"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, "key00"); !errors.Is(err, dbclient.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+	}
+	if err := c.Batch(ctx, []dbclient.Op{{Key: "key01", Delete: true}, {Key: "new", Value: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	values, err := c.MGet(ctx, "key00", "key01", "key02", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values["key02"] != "2" || values["new"] != "a" {
+		t.Errorf("Unexpected values %v", values)
+	}
+	var keys []string
+	if err := c.Scan(ctx, "key", func(key, _ string) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 28 || keys[0] != "key02" {
+		t.Errorf("Expected the 28 keys left, got %v", keys)
+	}
+
+	rec := httptest.NewRecorder()
+	rt.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/db/counter/incr", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("Expected incr to be not implemented, got %d", rec.Code)
+	}
+	if err := rt.addNode("http://other:8083"); !errors.Is(err, errReplicated) {
+		t.Errorf("Expected errReplicated, got %v", err)
+	}
+}
+
+func waitMigration(t *testing.T, rt *router) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for m := rt.shardMap("").Migration; m == nil || m.State != migrationDone; m = rt.shardMap("").Migration {
+		if time.Now().After(deadline) {
+			t.Fatalf("Migration did not finish: %+v", m)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// keyOwnedBy returns a key which the node owns on the ring.
+func keyOwnedBy(t *testing.T, ring *cluster.Ring, node string) string {
+	for i := 0; i < 1000; i++ {
+		if key := fmt.Sprintf("key%03d", i); ring.Owner(key) == node {
+			return key
+		}
+	}
+	t.Fatalf("No key of %s", node)
+	return ""
+}
+
+func TestRouter_AddNodeDuringRequest(t *testing.T) {
+	backend, db1 := testNode(t)
+	node2, db2 := testNode(t)
+	target, _ := url.Parse(backend.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	entered, release := make(chan struct{}), make(chan struct{})
+	node1 := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			entered <- struct{}{}
+			<-release
+		}
+		proxy.ServeHTTP(rw, req)
+	}))
+	t.Cleanup(node1.Close)
+	rt, c := testRouter(t, node1.URL)
+	next, err := rt.ring.With(node2.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := keyOwnedBy(t, next, node2.URL)
+
+	put := make(chan error)
+	go func() {
+		put <- c.Put(context.Background(), key, "v")
+	}()
+	<-entered
+	// The node joins while the request to the old owner still runs.
+	added := make(chan error)
+	go func() {
+		added <- rt.addNode(node2.URL)
+	}()
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Adding a node waits for the requests to the nodes")
+	}
+	close(release)
+	if err := <-put; err != nil {
+		t.Fatal(err)
+	}
+	waitMigration(t, rt)
+
+	// The migration waited for the write, so the key is moved.
+	if value, err := db2.Get(key); err != nil || value != "v" {
+		t.Errorf("Expected %s on the new node, got %q %v", key, value, err)
+	}
+	if _, err := db1.Get(key); err == nil {
+		t.Errorf("Expected %s to be moved from the old node", key)
+	}
+}
+
+func TestRouter_ScanDuringMigration(t *testing.T) {
+	node1, db1 := testNode(t)
+	node2, db2 := testNode(t)
+	rt, c := testRouter(t, node1.URL)
+	next, err := rt.ring.With(node2.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := newNode(node2.URL, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A key being moved is on both nodes, the joining one has the current
+	// value.
+	key := keyOwnedBy(t, next, node2.URL)
+	db1.Put(key, "old")
+	db2.Put(key, "new")
+	rt.mu.Lock()
+	rt.nodes[node2.URL] = n
+	rt.next = next
+	rt.mu.Unlock()
+
+	records, _, err := c.ScanPage(context.Background(), "key", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Value != "new" {
+		t.Errorf("Expected the value of the joining node, got %v", records)
+	}
+}
+
+func TestRouter_RingFile(t *testing.T) {
+	node1, _ := testNode(t)
+	node2, _ := testNode(t)
+	node3, db3 := testNode(t)
+	dir, err := ioutil.TempDir("", "test-router")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ring.json")
+	ctx := context.Background()
+
+	rt, c := testRouter(t, node1.URL, node2.URL)
+	if err := rt.restore(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := c.Put(ctx, fmt.Sprintf("key%03d", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rt.addNode(node3.URL); err != nil {
+		t.Fatal(err)
+	}
+	waitMigration(t, rt)
+
+	// The joined node must be passed to the next router.
+	rt, _ = testRouter(t, node1.URL, node2.URL)
+	if err := rt.restore(path); !errors.Is(err, errMissingNode) {
+		t.Errorf("Expected errMissingNode, got %v", err)
+	}
+	rt, c = testRouter(t, node1.URL, node2.URL, node3.URL)
+	if err := rt.restore(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		if value, err := c.Get(ctx, key); err != nil || value != fmt.Sprint(i) {
+			t.Errorf("Unexpected value of %s %q %v", key, value, err)
+		}
+	}
+
+	// A migration which was cut short by a restart is resumed.
+	data, err := json.Marshal(ringState{
+		VirtualNodes: cluster.DefaultVirtualNodes,
+		Nodes:        []string{node1.URL, node2.URL},
+		Joining:      node3.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	key := keyOwnedBy(t, rt.ring, node3.URL)
+	moved, err := db3.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db3.Delete(key)
+	rt, c = testRouter(t, node1.URL, node2.URL)
+	for addr, n := range rt.nodes {
+		if addr == rt.ring.Owner(key) {
+			if err := n.client.Put(ctx, key, moved); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := rt.restore(path); err != nil {
+		t.Fatal(err)
+	}
+	waitMigration(t, rt)
+	if !rt.ring.Has(node3.URL) {
+		t.Error("Expected the joining node on the ring")
+	}
+	if value, err := db3.Get(key); err != nil || value != moved {
+		t.Errorf("Expected %s to be moved to the joining node, got %q %v", key, value, err)
+	}
+}
@@ -1,36 +1,40 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
-	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
 
+	"github.com/hrystynaa/lab4-go/dbclient"
 	"github.com/hrystynaa/lab4-go/httptools"
 	"github.com/hrystynaa/lab4-go/signal"
 )
 
-var port = flag.Int("port", 8080, "server port")
+var (
+	port   = flag.Int("port", 8080, "server port")
+	dbAddr = flag.String("db", "http://db:8083", "base URL of the db server")
+)
 
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
 
-type Request struct {
-	Value string "json:\"value\""
-}
-
 type Response struct {
 	Key   string "json:\"key\""
 	Value string "json:\"value\""
 }
 
 func main() {
-	client := http.DefaultClient
+	flag.Parse()
+	client, err := dbclient.New(*dbAddr, dbclient.WithTimeout(3*time.Second), dbclient.WithRetries(3, 200*time.Millisecond))
+	if err != nil {
+		log.Fatalf("Bad db address: %s", err)
+	}
 	h := new(http.ServeMux)
 
 	h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
@@ -53,15 +57,12 @@ func main() {
 			return
 		}
 
-		response, err := client.Get(fmt.Sprintf("http://db:8083/db/%s", key))
-		if err != nil {
-			log.Println(err)
+		value, err := client.Get(r.Context(), key)
+		if errors.Is(err, dbclient.ErrNotFound) {
+			rw.WriteHeader(http.StatusNotFound)
 			return
-		}
-
-		statusOk := response.StatusCode >= 200 && response.StatusCode < 300
-
-		if !statusOk {
+		} else if err != nil {
+			log.Printf("Cannot get %s: %s", key, err)
 			rw.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -73,14 +74,12 @@ func main() {
 
 		report.Process(r)
 
-		var body Response
-		json.NewDecoder(response.Body).Decode(&body)
-
 		rw.Header().Set("content-type", "application/json")
 		rw.WriteHeader(http.StatusOK)
-		_ = json.NewEncoder(rw).Encode(body)
-
-		defer response.Body.Close()
+		_ = json.NewEncoder(rw).Encode(Response{
+			Key:   key,
+			Value: value,
+		})
 	})
 
 	h.HandleFunc("/api/v1/some-data2", func(rw http.ResponseWriter, r *http.Request) {
@@ -117,18 +116,8 @@ func main() {
 
 	server := httptools.CreateServer(*port, h)
 	server.Start()
-	buff := new(bytes.Buffer)
-	body := Request{Value: time.Now().Format(time.RFC3339)}
-	if err := json.NewEncoder(buff).Encode(body); err != nil {
-		fmt.Println("Failed to encode body:", err)
-		return
-	}
-
-	res, err := client.Post(fmt.Sprintf("http://db:8083/db/codequeens"), "application/json", buff)
-	if err != nil {
-		fmt.Println("Failed to send POST request:", err)
-		return
+	if err := client.Put(context.Background(), "codequeens", time.Now().Format(time.RFC3339)); err != nil {
+		log.Printf("Cannot store the start time: %s", err)
 	}
-	defer res.Body.Close()
 	signal.WaitForTerminationSignal()
 }
@@ -0,0 +1,166 @@
+package datastore
+
+import (
+	"bufio"
+	"io"
+)
+
+// BatchOp is a write of a batch: a put of the value or, if Delete is set, a
+// delete of the key.
+type BatchOp struct {
+	Key    string
+	Value  string
+	Delete bool
+}
+
+func checkBatch(ops []BatchOp) error {
+	for _, op := range ops {
+		if err := checkSize(op.Key, op.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchEntries returns the records which apply the operations. Deletes of
+// the keys which don't exist, in the store or after the earlier operations,
+// are skipped.
+func batchEntries(ops []BatchOp, exists func(key string) (bool, error)) ([]entry, error) {
+	live := make(map[string]bool, len(ops))
+	entries := make([]entry, 0, len(ops))
+	for _, op := range ops {
+		if !op.Delete {
+			entries = append(entries, entry{key: op.Key, value: op.Value})
+			live[op.Key] = true
+			continue
+		}
+		ok, seen := live[op.Key]
+		if !seen {
+			var err error
+			if ok, err = exists(op.Key); err != nil {
+				return nil, err
+			}
+		}
+		if ok {
+			entries = append(entries, entry{key: op.Key, flags: flagTombstone})
+		}
+		live[op.Key] = false
+	}
+	return entries, nil
+}
+
+// encodeBatch encodes the records to be written with a single write. Every
+// record but the last one has flagBatch, so the last one commits the batch
+// and readCommitted drops a batch cut short by a crash.
+func encodeBatch(entries []entry) []byte {
+	var data []byte
+	for i, e := range entries {
+		if i < len(entries)-1 {
+			e.flags |= flagBatch
+		}
+		data = append(data, e.Encode()...)
+	}
+	return data
+}
+
+// readCommitted calls fn with every record of the log and its offset, the
+// records of a batch only once its last record is read. It returns the size
+// of the records passed to fn, which leaves out a record or a batch cut
+// short at the end of the log.
+func readCommitted(in *bufio.Reader, fn func(e entry, offset int64)) (int64, error) {
+	var pending []entry
+	var size int64
+	for {
+		e, err := readEntry(in)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return size, nil
+		} else if err != nil {
+			return 0, err
+		}
+		batched := e.flags&flagBatch != 0
+		e.flags &^= flagBatch
+		pending = append(pending, e)
+		if batched {
+			continue
+		}
+		for _, e := range pending {
+			fn(e, size)
+			size += e.length()
+		}
+		pending = pending[:0]
+	}
+}
+
+// WriteBatch appends the records of the batch with a single write on the
+// put routine. Readers see either none or all of them, and a batch cut
+// short by a crash is dropped on recovery.
+func (db *Db) WriteBatch(ops []BatchOp) error {
+	if err := checkBatch(ops); err != nil {
+		return err
+	}
+	db.putOps <- func() error {
+		return db.writeBatch(ops)
+	}
+	return <-db.putDone
+}
+
+// writeBatch writes the records of the batch. It must run on the put
+// routine.
+func (db *Db) writeBatch(ops []BatchOp) error {
+	entries, err := batchEntries(ops, db.exists)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	encoded := make([]entry, len(entries))
+	for i, e := range entries {
+		if encoded[i], err = db.encodeValue(e); err != nil {
+			return err
+		}
+	}
+	if err := db.appendEntries(encoded...); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		db.publish(e)
+	}
+	return nil
+}
+
+// WriteBatch appends the records of the batch to the write ahead log with a
+// single write and applies them under the lock.
+func (l *LSM) WriteBatch(ops []BatchOp) error {
+	if err := checkBatch(ops); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries, err := batchEntries(ops, func(key string) (bool, error) {
+		e, err := l.get(key)
+		if err == ErrNotFound {
+			return false, nil
+		}
+		return err == nil && e.flags&flagTombstone == 0, err
+	})
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	return l.write(entries...)
+}
+
+func (m *MemStore) WriteBatch(ops []BatchOp) error {
+	if err := checkBatch(ops); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, op := range ops {
+		if op.Delete {
+			delete(m.data, op.Key)
+			continue
+		}
+		m.data[op.Key] = op.Value
+		m.stats.rawValueBytes.Add(int64(len(op.Value)))
+		m.stats.storedValueBytes.Add(int64(len(op.Value)))
+	}
+	return nil
+}
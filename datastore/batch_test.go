@@ -0,0 +1,200 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestDb_WriteBatchAtomic(t *testing.T) {
+	configs := map[string][]Option{
+		"hash":      nil,
+		"cache":     {WithCache(1024)},
+		"value log": {WithValueLog(150)},
+	}
+	for name, opts := range configs {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			fs := newFaultFS()
+			// Compaction is off, so every write comes from the batches.
+			db, err := NewDb(dir, 200, append([]Option{WithFS(fs), WithCompactionThreshold(0)}, opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if err := db.WriteBatch([]BatchOp{{Key: "x", Value: "0"}, {Key: "y", Value: "0"}}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Once the records of a batch are written but not yet indexed,
+			// reads still see all of the previous batch and none of this one.
+			var prev string
+			fs.setAfterWrite(func() {
+				x, errX := db.Get("x")
+				y, errY := db.Get("y")
+				if errX != nil || errY != nil || x != prev || y != prev {
+					t.Errorf("Expected x=y=%s before the batch is indexed, got x=%s %v, y=%s %v", prev, x, errX, y, errY)
+				}
+			})
+			for i := 1; i <= 20; i++ {
+				prev = strconv.Itoa(i - 1)
+				v := strconv.Itoa(i)
+				if err := db.WriteBatch([]BatchOp{{Key: "x", Value: v}, {Key: "y", Value: v}}); err != nil {
+					t.Fatal(err)
+				}
+				if x, _ := db.Get("x"); x != v {
+					t.Errorf("Expected x=%s after the batch, got %s", v, x)
+				}
+			}
+			fs.setAfterWrite(nil)
+		})
+	}
+}
+
+func TestDb_WriteBatchCrash(t *testing.T) {
+	ops := []BatchOp{
+		{Key: "a", Value: "batched"},
+		{Key: "b", Value: "batched"},
+		{Key: "c", Delete: true},
+	}
+	entries := []entry{{key: "a", value: "batched"}, {key: "b", value: "batched"}, {key: "c", flags: flagTombstone}}
+	size := int64(len(encodeBatch(entries)))
+
+	for crashAt := int64(0); crashAt <= size; crashAt += 5 {
+		dir, err := ioutil.TempDir("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs := newFaultFS()
+		db, err := NewDb(dir, 1000, WithFS(fs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("c", "before"); err != nil {
+			t.Fatal(err)
+		}
+		fs.budget = crashAt
+		if err := db.WriteBatch(ops); err == nil && crashAt < size {
+			t.Fatalf("Expected the batch to fail at byte %d", crashAt)
+		}
+		fs.crash()
+		db.Close()
+
+		db, err = NewDb(dir, 1000)
+		if err != nil {
+			t.Fatalf("Cannot recover after crash at byte %d: %s", crashAt, err)
+		}
+		if _, err := db.Get("a"); err != ErrNotFound {
+			t.Errorf("Expected no record of a batch cut at byte %d, got %v", crashAt, err)
+		}
+		if value, err := db.Get("c"); err != nil || value != "before" {
+			t.Errorf("Expected the delete of a batch cut at byte %d to be dropped, got %q %v", crashAt, value, err)
+		}
+		// The records written next must not commit the dropped batch.
+		if err := db.Put("d", "after"); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		db, err = NewDb(dir, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("b"); err != ErrNotFound {
+			t.Errorf("Expected the batch cut at byte %d to stay dropped, got %v", crashAt, err)
+		}
+		if value, err := db.Get("d"); err != nil || value != "after" {
+			t.Errorf("Unexpected value of d %q %v", value, err)
+		}
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDb_WriteBatchShortWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := newFaultFS()
+	db, err := NewDb(dir, 1000, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	changes, cancel := db.Watch("", 8)
+	defer cancel()
+	fs.shortWrite = true
+	if err := db.WriteBatch([]BatchOp{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}); err == nil {
+		t.Fatal("Expected an error on a short write")
+	}
+	if _, err := db.Get("a"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a failed batch, got %v", err)
+	}
+	if err := db.Put("c", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if change := <-changes; change.Key != "c" {
+		t.Errorf("Expected no changes of a failed batch, got %+v", change)
+	}
+}
+
+func TestLSM_WriteBatchRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-lsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := NewLSM(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put("a", "before"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.WriteBatch([]BatchOp{{Key: "a", Value: "batched"}, {Key: "b", Value: "batched"}}); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// A crash in the middle of the batch leaves only a part of it.
+	wal := filepath.Join(dir, lsmWalFileName)
+	stat, err := os.Stat(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(wal, stat.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	l, err = NewLSM(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := l.Get("a"); err != nil || value != "before" {
+		t.Errorf("Expected the batch to be dropped, got %q %v", value, err)
+	}
+	if err := l.Put("c", "after"); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	l, err = NewLSM(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := l.Get("b"); err != ErrNotFound {
+		t.Errorf("Expected the batch to stay dropped, got %v", err)
+	}
+	if value, err := l.Get("c"); err != nil || value != "after" {
+		t.Errorf("Unexpected value of c %q %v", value, err)
+	}
+}
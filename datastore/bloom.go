@@ -0,0 +1,89 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+const bloomFilterSuffix = ".bloom"
+
+// bloomFilter answers whether a key may be present in a set. It never gives
+// false negatives and gives false positives at roughly the rate it was
+// sized for.
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint32
+}
+
+func newBloomFilter(n int, fpRate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits:   make([]uint64, (int(m)+63)/64),
+		hashes: uint32(k),
+	}
+}
+
+// locations uses double hashing to derive the bit positions of the key.
+func (bf *bloomFilter) locations(key string, fn func(bit uint64)) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+	m := uint64(len(bf.bits) * 64)
+	for i := uint32(0); i < bf.hashes; i++ {
+		fn(uint64(h1+i*h2) % m)
+	}
+}
+
+func (bf *bloomFilter) add(key string) {
+	bf.locations(key, func(bit uint64) {
+		bf.bits[bit/64] |= 1 << (bit % 64)
+	})
+}
+
+func (bf *bloomFilter) mayContain(key string) bool {
+	res := true
+	bf.locations(key, func(bit uint64) {
+		if bf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			res = false
+		}
+	})
+	return res
+}
+
+// write stores the filter as the number of hashes followed by the bit set.
+func (bf *bloomFilter) write(fs FS, path string) error {
+	res := make([]byte, 4+8*len(bf.bits))
+	binary.LittleEndian.PutUint32(res, bf.hashes)
+	for i, word := range bf.bits {
+		binary.LittleEndian.PutUint64(res[4+8*i:], word)
+	}
+	return writeFileAtomic(fs, path, res)
+}
+
+func readBloomFilter(fs FS, path string) (*bloomFilter, error) {
+	data, err := readFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 12 || (len(data)-4)%8 != 0 {
+		return nil, fmt.Errorf("corrupted bloom filter %s", path)
+	}
+	bf := &bloomFilter{
+		hashes: binary.LittleEndian.Uint32(data),
+		bits:   make([]uint64, (len(data)-4)/8),
+	}
+	for i := range bf.bits {
+		bf.bits[i] = binary.LittleEndian.Uint64(data[4+8*i:])
+	}
+	return bf, nil
+}
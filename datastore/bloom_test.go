@@ -0,0 +1,129 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	bf := newBloomFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		bf.add(fmt.Sprintf("key%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !bf.mayContain(fmt.Sprintf("key%d", i)) {
+			t.Fatalf("False negative for key%d", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if bf.mayContain(fmt.Sprintf("missing%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("Too many false positives: %d of 10000", falsePositives)
+	}
+
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "filter"+bloomFilterSuffix)
+	if err := bf.write(OSFS{}, path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := readBloomFilter(OSFS{}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bf, loaded) {
+		t.Error("Loaded bloom filter differs from the written one")
+	}
+}
+
+func TestDb_BloomFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 200, WithBloomFilter(0.01), WithCompactionDelay(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := db.Get(fmt.Sprintf("key%d", i)); err != nil {
+			t.Errorf("Cannot get key%d: %s", i, err)
+		}
+	}
+	if _, err := db.Get("missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, segment := range db.segments[:len(db.segments)-1] {
+		if segment.bloom == nil {
+			t.Errorf("Expected sealed segment %s to have a bloom filter", segment.filePath)
+		}
+		if _, err := os.Stat(segment.filePath + bloomFilterSuffix); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func benchmarkDbMiss(b *testing.B, opts ...Option) {
+	dir, err := ioutil.TempDir("", "bench-db")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 4096, append(opts, WithCompactionDelay(0))...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 1000; i++ {
+		if err := db.Put(benchKey(i), "value"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Get(fmt.Sprintf("missing%d", i)); err != ErrNotFound {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDb_Miss(b *testing.B) {
+	b.Run("hash", func(b *testing.B) {
+		benchmarkDbMiss(b)
+	})
+	b.Run("hash+bloom", func(b *testing.B) {
+		benchmarkDbMiss(b, WithBloomFilter(0.01))
+	})
+	b.Run("table", func(b *testing.B) {
+		benchmarkDbMiss(b, WithTableIndex(16))
+	})
+	b.Run("table+bloom", func(b *testing.B) {
+		benchmarkDbMiss(b, WithTableIndex(16), WithBloomFilter(0.01))
+	})
+}
@@ -0,0 +1,93 @@
+package datastore
+
+import (
+	"container/list"
+	"sync"
+)
+
+type cacheItem struct {
+	key, value string
+}
+
+// valueCache is an LRU cache of decoded values bounded by the total size of
+// keys and values it holds.
+type valueCache struct {
+	mu     sync.Mutex
+	budget int64
+	size   int64
+	items  map[string]*list.Element
+	order  *list.List
+	epoch  uint64
+	hits   int64
+	misses int64
+}
+
+func newValueCache(budget int64) *valueCache {
+	return &valueCache{
+		budget: budget,
+		items:  make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// get returns the cached value and the current epoch, which has to be passed
+// to add when the value is read from disk.
+func (c *valueCache) get(key string) (string, bool, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.order.MoveToFront(el)
+		c.hits++
+		return el.Value.(*cacheItem).value, true, c.epoch
+	}
+	c.misses++
+	return "", false, c.epoch
+}
+
+// add caches the value unless the cache was invalidated since epoch.
+func (c *valueCache) add(key, value string, epoch uint64) {
+	size := int64(len(key) + len(value))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if epoch != c.epoch || size > c.budget {
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+	c.items[key] = c.order.PushFront(&cacheItem{key, value})
+	c.size += size
+	for c.size > c.budget {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *valueCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *valueCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+	c.size = 0
+}
+
+func (c *valueCache) removeElement(el *list.Element) {
+	item := c.order.Remove(el).(*cacheItem)
+	delete(c.items, item.key)
+	c.size -= int64(len(item.key) + len(item.value))
+}
+
+func (c *valueCache) counters() (hits, misses, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.size
+}
@@ -0,0 +1,173 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestValueCache(t *testing.T) {
+	c := newValueCache(20)
+
+	_, ok, epoch := c.get("key1")
+	if ok {
+		t.Fatal("Unexpected hit in an empty cache")
+	}
+	c.add("key1", "value1", epoch)
+	c.add("key2", "value2", epoch)
+	if value, ok, _ := c.get("key1"); !ok || value != "value1" {
+		t.Errorf("Expected key1 to be cached, got %q %t", value, ok)
+	}
+
+	c.add("key3", "value3", epoch)
+	if _, ok, _ := c.get("key2"); ok {
+		t.Error("Expected least recently used key2 to be evicted")
+	}
+	if _, ok, _ := c.get("key1"); !ok {
+		t.Error("Expected key1 to stay cached")
+	}
+
+	_, _, epoch = c.get("key4")
+	c.invalidate("key1")
+	c.add("key4", "value4", epoch)
+	if _, ok, _ := c.get("key4"); ok {
+		t.Error("Value read before invalidation must not be cached")
+	}
+	if _, ok, _ := c.get("key1"); ok {
+		t.Error("Expected key1 to be invalidated")
+	}
+
+	hits, misses, size := c.counters()
+	if hits != 2 || misses != 5 || size != 10 {
+		t.Errorf("Unexpected counters hits=%d misses=%d size=%d", hits, misses, size)
+	}
+}
+
+func TestDb_Cache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 500, WithCache(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("codequeens", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		value, err := db.Get("codequeens")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "value1" {
+			t.Errorf("Bad value returned expected value1, got %s", value)
+		}
+	}
+	if err := db.Put("codequeens", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	value, err := db.Get("codequeens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "value2" {
+		t.Errorf("Bad value returned expected value2, got %s", value)
+	}
+
+	stats := db.Stats()
+	if stats.CacheHits != 2 || stats.CacheMisses != 2 {
+		t.Errorf("Unexpected cache counters hits=%d misses=%d", stats.CacheHits, stats.CacheMisses)
+	}
+	if stats.CacheBytes != int64(len("codequeens")+len("value2")) {
+		t.Errorf("Unexpected cache size %d", stats.CacheBytes)
+	}
+}
+
+func TestDb_CacheConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 4096, WithCache(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const writes = 500
+	if err := db.Put("counter", "0"); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := 0
+			for last < writes {
+				value, err := db.Get("counter")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n, _ := strconv.Atoi(value)
+				if n < last {
+					t.Errorf("Read %d after %d", n, last)
+					return
+				}
+				last = n
+			}
+		}()
+	}
+	for i := 1; i <= writes; i++ {
+		if err := db.Put("counter", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	if value, _ := db.Get("counter"); value != strconv.Itoa(writes) {
+		t.Errorf("Expected the last value to be cached, got %s", value)
+	}
+}
+
+func TestDb_CacheReadDuringWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := newFaultFS()
+	db, err := NewDb(dir, 4096, WithCache(1024), WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key", "old"); err != nil {
+		t.Fatal(err)
+	}
+	// A read which misses while the new record is written must not cache
+	// the old value for good.
+	fs.setAfterWrite(func() {
+		if value, err := db.Get("key"); err != nil || value != "old" {
+			t.Errorf("Unexpected value during the write %q %v", value, err)
+		}
+	})
+	if err := db.Put("key", "new"); err != nil {
+		t.Fatal(err)
+	}
+	fs.setAfterWrite(nil)
+	if value, err := db.Get("key"); err != nil || value != "new" {
+		t.Errorf("Expected the new value, got %q %v", value, err)
+	}
+}
@@ -0,0 +1,50 @@
+package datastore
+
+import "fmt"
+
+// encodeValue transforms the value of a record before it is written to disk.
+func (db *Db) encodeValue(e entry) (entry, error) {
+	if e.flags&flagTombstone != 0 {
+		return e, nil
+	}
+	raw := len(e.value)
+	if db.compressMin > 0 && raw >= db.compressMin {
+		compressed, err := compress(e.value)
+		if err != nil {
+			return entry{}, err
+		}
+		if len(compressed) < raw {
+			e.value = compressed
+			e.flags |= flagCompressed
+		}
+	}
+	db.stats.rawValueBytes.Add(int64(raw))
+	db.stats.storedValueBytes.Add(int64(len(e.value)))
+	if db.keys != nil {
+		sealed, err := db.keys.seal(e.key, e.value)
+		if err != nil {
+			return entry{}, err
+		}
+		e.value = sealed
+		e.flags |= flagEncrypted
+	}
+	return e, nil
+}
+
+// decodeValue reverts encodeValue for a record read from disk.
+func (db *Db) decodeValue(e entry) (string, error) {
+	if e.flags&flagEncrypted != 0 {
+		if db.keys == nil {
+			return "", fmt.Errorf("record %s is encrypted but no encryption key is configured", e.key)
+		}
+		value, err := db.keys.open(e.key, e.value)
+		if err != nil {
+			return "", err
+		}
+		e.value = value
+	}
+	if e.flags&flagCompressed != 0 {
+		return decompress(e.value)
+	}
+	return e.value, nil
+}
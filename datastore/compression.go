@@ -0,0 +1,32 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+)
+
+func compress(value string) (string, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(w, value); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func decompress(value string) (string, error) {
+	r := flate.NewReader(bytes.NewReader([]byte(value)))
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
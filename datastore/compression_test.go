@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDb_Compression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 4096, WithCompression(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	large := strings.Repeat(`{"status":"active","name":"codequeens"}`, 20)
+	pairs := [][]string{
+		{"small", "value"},
+		{"large", large},
+	}
+
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatalf("Cannot put %s: %s", pair[0], err)
+		}
+	}
+	for _, pair := range pairs {
+		value, err := db.Get(pair[0])
+		if err != nil {
+			t.Fatalf("Cannot get %s: %s", pair[0], err)
+		}
+		if value != pair[1] {
+			t.Errorf("Bad value returned for %s", pair[0])
+		}
+	}
+
+	small, err := db.lookupEntry("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if small.flags&flagCompressed != 0 {
+		t.Error("Values below the threshold must be stored raw")
+	}
+
+	stats := db.Stats()
+	if stats.RawValueBytes != int64(len("value")+len(large)) {
+		t.Errorf("Unexpected raw bytes %d", stats.RawValueBytes)
+	}
+	if stats.CompressionRatio <= 1 {
+		t.Errorf("Expected compression ratio above 1, got %f", stats.CompressionRatio)
+	}
+}
+
+func TestDb_CompressionWithValueLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 500, WithCompression(16), WithValueLog(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	large := strings.Repeat("value", 100)
+	if err := db.Put("key", large); err != nil {
+		t.Fatal(err)
+	}
+	value, err := db.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != large {
+		t.Errorf("Bad value returned expected %d bytes, got %d", len(large), len(value))
+	}
+}
@@ -0,0 +1,50 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+var (
+	ErrNotInteger = errors.New("value is not an integer")
+	ErrOverflow   = errors.New("integer overflow")
+)
+
+func parseInt64(key, value string) (int64, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrNotInteger, key)
+	}
+	return n, nil
+}
+
+// incr adds delta to the decimal integer stored at the key. A missing key
+// counts as zero.
+func incr(s Store, key string, delta int64) (int64, error) {
+	var res int64
+	err := s.Update(key, func(value string, ok bool) (string, error) {
+		var n int64
+		if ok {
+			var err error
+			if n, err = parseInt64(key, value); err != nil {
+				return "", err
+			}
+		}
+		if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+			return "", fmt.Errorf("%w: %s", ErrOverflow, key)
+		}
+		res = n + delta
+		return strconv.FormatInt(res, 10), nil
+	})
+	return res, err
+}
+
+func getInt64(s Store, key string) (int64, error) {
+	value, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return parseInt64(key, value)
+}
@@ -3,26 +3,33 @@ package datastore
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	outFileName = "current-data"
-	bufSize     = 8192
+	outFileName         = "current-data"
+	mergedSegmentSuffix = "m"
+	bufSize             = 8192
+	valueLogMaxSealed   = 2
+
+	defaultCompactionDelay     = time.Second
+	defaultCompactionThreshold = 3
 )
 
 var ErrNotFound = fmt.Errorf("record does not exist")
 
-type hashIndex map[string]int64
-
-type IndexOp struct {
-	isWrite bool
-	key     string
-	index   int64
-}
+var ErrCompactionRunning = errors.New("compaction is already running")
 
 type KeyPosition struct {
 	segment  *Segment
@@ -30,304 +37,988 @@ type KeyPosition struct {
 }
 
 type Db struct {
-	segments      []*Segment
-	out           *os.File
-	outPath       string
-	outOffset     int64
-	dir           string
-	segmentSize   int64
-	segmentIndex  int
-	indexOps      chan IndexOp
-	keyPositions  chan *KeyPosition
-	putOps        chan entry
-	putDone       chan error
-	workerRequest chan WorkerRequest
-	workerResult  chan WorkerResult
+	// mu guards the segment list. The list is never changed in place, a
+	// reader copies it under the lock and uses it without holding it.
+	mu           sync.RWMutex
+	segments     []*Segment
+	fs           FS
+	out          File
+	outPath      string
+	outOffset    int64
+	dir          string
+	segmentSize  int64
+	segmentIndex int
+	activeIndex  *shardedIndex
+	tableFences  int
+	bloomFPRate  float64
+	compactDelay time.Duration
+	compactAt    int
+	syncWrites   bool
+	syncInterval time.Duration
+	syncStop     chan struct{}
+	dirty        bool
+	syncErr      error
+	compacting   atomic.Bool
+	compactions  sync.WaitGroup
+	seq          atomic.Uint64
+	pinMu        sync.Mutex
+	pins         int
+	unusedFiles  []string
+	backups      atomic.Int64
+	putOps       chan func() error
+	putDone      chan error
+	valueLogSize int64
+	vlog         *valueLog
+	compressMin  int
+	keys         *keyRing
+	cache        *valueCache
+	secondary    *secondaryIndex
+	watchers     watchers
+	stats        dbStats
 }
 
+// Segment is a segment file with its index. A sealed segment is replaced by
+// a new Segment, so the fields don't change once it is in the list.
 type Segment struct {
-	index    hashIndex
+	index    segmentIndex
+	bloom    *bloomFilter
 	filePath string
 }
 
-type WorkerResult struct {
-	Value string
-	Err   error
-}
-
-type WorkerRequest struct {
-	Key        string
-	ResultChan chan WorkerResult
-}
-
 func (db *Db) addSegment() error {
 	filePath := filepath.Join(db.dir, fmt.Sprintf("%s%d", outFileName, db.segmentIndex))
-	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0777)
+	f, err := db.fs.OpenFile(filePath, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0777)
 	if err != nil {
 		return err
 	}
+	var sealed *Segment
+	if active := db.activeSegment(); active != nil {
+		if db.syncWrites {
+			err = db.out.Sync()
+		}
+		if err == nil {
+			sealed, err = db.seal(active)
+		}
+		if err != nil {
+			// The new file is removed so that the active segment, which is
+			// still written to, stays the last one on recovery.
+			f.Close()
+			db.fs.Remove(filePath)
+			return err
+		}
+		db.out.Close()
+	}
 	db.out = f
 	db.outOffset = 0
 	db.outPath = filePath
+	db.activeIndex = newShardedIndex()
 	segment := &Segment{
 		filePath: filePath,
-		index:    make(hashIndex),
+		index:    db.activeIndex,
 	}
-	db.segments = append(db.segments, segment)
-	if len(db.segments) >= 3 {
-		db.compact()
+	db.mu.Lock()
+	segments := make([]*Segment, len(db.segments), len(db.segments)+1)
+	copy(segments, db.segments)
+	if sealed != nil {
+		segments[len(segments)-1] = sealed
 	}
+	db.segments = append(segments, segment)
+	count := len(db.segments)
+	db.mu.Unlock()
 	db.segmentIndex++
+	if db.compactAt > 0 && count >= db.compactAt && db.compacting.CompareAndSwap(false, true) {
+		db.compact(count - 1)
+	}
 	return err
 }
 
-func NewDb(dir string, segmentSize int64) (*Db, error) {
-	db := &Db{
-		segments:      make([]*Segment, 0),
-		dir:           dir,
-		segmentSize:   segmentSize,
-		indexOps:      make(chan IndexOp),
-		keyPositions:  make(chan *KeyPosition),
-		putOps:        make(chan entry),
-		putDone:       make(chan error),
-		workerRequest: make(chan WorkerRequest),
-		workerResult:  make(chan WorkerResult),
+// seal builds the bloom filter of a segment that is no longer written to and
+// replaces its in-memory index with a table index, if they are enabled. It
+// returns the sealed copy of the segment.
+func (db *Db) seal(segment *Segment) (*Segment, error) {
+	var bloom *bloomFilter
+	if db.bloomFPRate > 0 {
+		keys, err := segment.index.keys()
+		if err != nil {
+			return nil, err
+		}
+		bloom = newBloomFilter(len(keys), db.bloomFPRate)
+		for _, key := range keys {
+			bloom.add(key)
+		}
+		if err := bloom.write(db.fs, segment.filePath+bloomFilterSuffix); err != nil {
+			return nil, err
+		}
 	}
-
-	numWorkers := 10 // Кількість виконавців в пулі
-	for i := 0; i < numWorkers; i++ {
-		go db.worker()
+	index := segment.index
+	if db.tableFences > 0 {
+		t, err := writeTableIndex(db.fs, segment.filePath, segment.index, db.tableFences)
+		if err != nil {
+			return nil, err
+		}
+		index = t
 	}
+	return &Segment{
+		index:    index,
+		bloom:    bloom,
+		filePath: segment.filePath,
+	}, nil
+}
 
-	if err := db.addSegment(); err != nil {
-		return nil, err
+func NewDb(dir string, segmentSize int64, opts ...Option) (*Db, error) {
+	db := &Db{
+		segments:     make([]*Segment, 0),
+		fs:           OSFS{},
+		dir:          dir,
+		segmentSize:  segmentSize,
+		compactDelay: defaultCompactionDelay,
+		compactAt:    defaultCompactionThreshold,
+		putOps:       make(chan func() error),
+		putDone:      make(chan error),
+	}
+	for _, opt := range opts {
+		if err := opt(db); err != nil {
+			return nil, err
+		}
+	}
+	if db.valueLogSize > 0 {
+		vlog, err := openValueLog(db.fs, dir, db.valueLogSize)
+		if err != nil {
+			return nil, err
+		}
+		vlog.sync = db.syncWrites
+		db.vlog = vlog
+	}
+	if db.keys != nil {
+		if err := db.keys.verify(db.fs, dir); err != nil {
+			return nil, err
+		}
 	}
 
-	if err := db.recover(); err != nil && err != io.EOF {
+	if err := db.recover(); err != nil {
 		return nil, err
 	}
-	db.startIndexRoutine()
+	if db.secondary != nil {
+		if err := db.rebuildSecondaryIndex(); err != nil {
+			return nil, err
+		}
+	}
 	db.startPutRoutine()
+	if db.syncWrites && db.syncInterval > 0 {
+		db.syncStop = make(chan struct{})
+		go db.syncPeriodically()
+	}
 
 	return db, nil
 }
 
-func (db *Db) worker() {
-	for key := range db.workerRequest {
-		op := IndexOp{
-			isWrite: false,
-			key:     key.Key,
+func (db *Db) get(key string) (string, error) {
+	if db.cache == nil {
+		return db.load(key)
+	}
+	value, ok, epoch := db.cache.get(key)
+	if ok {
+		return value, nil
+	}
+	value, err := db.load(key)
+	if err == nil {
+		db.cache.add(key, value, epoch)
+	}
+	return value, err
+}
+
+// load reads and decodes the newest value of the key from disk.
+func (db *Db) load(key string) (string, error) {
+	e, err := db.lookupEntry(key)
+	if err != nil {
+		return "", err
+	}
+	return db.resolve(e)
+}
+
+// resolve reads the value of a record pointing to the value log and decodes
+// it.
+func (db *Db) resolve(e entry) (string, error) {
+	key := e.key
+	if e.flags&flagValuePointer != 0 {
+		if db.vlog == nil {
+			return "", fmt.Errorf("value of %s is stored in a value log which is not enabled", key)
+		}
+		p, err := decodeValuePointer(e.value)
+		if err != nil {
+			return "", err
+		}
+		e, err = db.vlog.read(p)
+		if err != nil {
+			return "", err
 		}
-		db.indexOps <- op
-		keyPos := <-db.keyPositions
+	}
+	return db.decodeValue(e)
+}
 
+// lookupEntry returns the newest record stored for the key as it is on disk.
+// Deleted keys are reported as ErrNotFound.
+func (db *Db) lookupEntry(key string) (entry, error) {
+	e, _, err := db.lookupRecord(key)
+	return e, err
+}
+
+// lookupRecord is lookupEntry which also returns the position of the record.
+func (db *Db) lookupRecord(key string) (entry, *KeyPosition, error) {
+	keyPos, file, err := db.openRecord(key)
+	if err != nil {
+		return entry{}, nil, err
+	}
+	defer file.Close()
+	e, err := readEntryAt(file, keyPos.position)
+	return e, keyPos, err
+}
+
+// openRecord finds the newest record of the key and opens its segment file.
+// It returns ErrNotFound if the key has no record.
+func (db *Db) openRecord(key string) (*KeyPosition, File, error) {
+	var keyPos *KeyPosition
+	var file File
+	err := db.withSegments(func(segments []*Segment) error {
+		var err error
+		keyPos, err = lookupSegments(segments, key)
+		if err != nil {
+			return err
+		}
 		if keyPos == nil {
-			continue
+			return ErrNotFound
 		}
+		file, err = db.fs.Open(keyPos.segment.filePath)
+		return err
+	})
+	return keyPos, file, err
+}
 
-		file, err := os.Open(keyPos.segment.filePath)
-		if err != nil {
-			db.workerResult <- WorkerResult{"", err}
-			continue
+// segmentList returns the current segments, oldest first.
+func (db *Db) segmentList() []*Segment {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.segments
+}
+
+// withSegments calls fn with the current segments without holding db.mu.
+// Compaction may remove the files of the segments meanwhile, so if fn fails
+// with a missing file after the list has changed, it is called again with
+// the new list.
+func (db *Db) withSegments(fn func(segments []*Segment) error) error {
+	for {
+		segments := db.segmentList()
+		err := fn(segments)
+		if !errors.Is(err, os.ErrNotExist) || sameSegments(segments, db.segmentList()) {
+			return err
 		}
-		defer file.Close()
+	}
+}
 
-		_, err = file.Seek(keyPos.position, 0)
-		if err != nil {
-			db.workerResult <- WorkerResult{"", err}
-			continue
+func sameSegments(a, b []*Segment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
+	}
+	return true
+}
 
-		reader := bufio.NewReader(file)
-		value, err := readValue(reader)
-		if err != nil {
-			db.workerResult <- WorkerResult{"", err}
+// readEntryAt reads the record at the position of the segment file. Deleted
+// keys are reported as ErrNotFound.
+func readEntryAt(file File, position int64) (entry, error) {
+	if _, err := file.Seek(position, 0); err != nil {
+		return entry{}, err
+	}
+	e, err := readEntry(bufio.NewReader(file))
+	if err != nil {
+		return entry{}, err
+	}
+	if e.flags&flagTombstone != 0 {
+		return entry{}, ErrNotFound
+	}
+	return e, nil
+}
+
+func lookupSegments(segments []*Segment, key string) (*KeyPosition, error) {
+	for i := len(segments) - 1; i >= 0; i-- {
+		segment := segments[i]
+		if segment.bloom != nil && !segment.bloom.mayContain(key) {
 			continue
 		}
-
-		db.workerResult <- WorkerResult{value, nil}
+		position, ok, err := segment.index.get(key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return &KeyPosition{
+				segment,
+				position,
+			}, nil
+		}
 	}
+	return nil, nil
 }
 
-func (db *Db) startIndexRoutine() {
+// compact merges the first count segments into a new one in background.
+// It starts after compactDelay so that it does not compete with the burst of
+// writes that has just filled the segments. Only one compaction runs at a time.
+func (db *Db) compact(count int) {
+	db.mu.RLock()
+	merged := append([]*Segment(nil), db.segments[:count]...)
+	db.mu.RUnlock()
+	db.compactions.Add(1)
 	go func() {
-		for {
-			op := <-db.indexOps
-			if op.isWrite {
-				db.segments[len(db.segments)-1].index[op.key] = db.outOffset
-				db.outOffset += op.index
-			} else {
-				var err error
-				for i := len(db.segments) - 1; i >= 0; i-- {
-					segment := db.segments[i]
-					position, ok := segment.index[op.key]
-					if ok {
-						db.keyPositions <- &KeyPosition{
-							segment,
-							position,
-						}
-						err = nil
-						break
-					} else {
-						err = ErrNotFound
-					}
-				}
-				if err != nil {
-					db.keyPositions <- nil
-				}
-			}
+		defer db.compactions.Done()
+		defer db.compacting.Store(false)
+		time.Sleep(db.compactDelay)
+		// The segments are kept, so the next compaction merges them again.
+		if err := db.merge(merged); err != nil {
+			log.Printf("Cannot compact segments: %s", err)
 		}
 	}()
 }
 
-func (db *Db) compact() {
-	go func() {
+// Compacter is a Store whose compaction can be started on demand.
+type Compacter interface {
+	Compact() error
+}
+
+var _ Compacter = (*Db)(nil)
+
+// Compact merges all the sealed segments into one right away and waits for
+// it. It returns ErrCompactionRunning if a compaction is already running.
+func (db *Db) Compact() error {
+	if !db.compacting.CompareAndSwap(false, true) {
+		return ErrCompactionRunning
+	}
+	defer db.compacting.Store(false)
+	db.compactions.Add(1)
+	defer db.compactions.Done()
+
+	db.mu.RLock()
+	merged := append([]*Segment(nil), db.segments[:len(db.segments)-1]...)
+	db.mu.RUnlock()
+	// A single merged segment has nothing left to drop.
+	if len(merged) == 0 || len(merged) == 1 && strings.HasSuffix(merged[0].filePath, mergedSegmentSuffix) {
+		return nil
+	}
+	return db.merge(merged)
+}
+
+// merge writes the live records of the segments to a new segment which
+// replaces them. The new segment is named after the newest merged one with
+// mergedSegmentSuffix, so on recovery it supersedes all the segments it was
+// built from even if the process stopped before they were removed.
+func (db *Db) merge(merged []*Segment) error {
+	filePath := merged[len(merged)-1].filePath + mergedSegmentSuffix
+	index := newShardedIndex()
+	err := createFileAtomic(db.fs, filePath, func(f io.Writer) error {
+		w := bufio.NewWriterSize(f, bufSize)
 		var offset int64
-		filePath := filepath.Join(db.dir, fmt.Sprintf("%s%d", outFileName, db.segmentIndex))
-		db.segmentIndex++
-		segment := &Segment{
-			filePath: filePath,
-			index:    make(hashIndex),
-		}
-		f, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
-		if err != nil {
-			return
-		}
-		segmentIndex := len(db.segments) - 2
-		for i := 0; i <= segmentIndex; i++ {
-			s := db.segments[i]
-			for key := range s.index {
-				if i < segmentIndex && db.checkKey(key, db.segments[i+1:segmentIndex+1]) {
+		last := len(merged) - 1
+		for i, s := range merged {
+			keys, err := s.index.keys()
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				if i < last && db.checkKey(key, merged[i+1:]) {
 					continue
 				}
-				value, _ := db.Get(key)
-				e := entry{
-					key:   key,
-					value: value,
+				e, pos, err := db.lookupRecord(key)
+				if err == ErrNotFound {
+					continue
+				} else if err != nil {
+					return err
+				}
+				e.seq = recordVersion(e, pos)
+				e, err = db.rekey(e)
+				if err != nil {
+					return err
 				}
-				n, err := f.Write(e.Encode())
-				if err == nil {
-					segment.index[key] = offset
-					offset += int64(n)
+				// The records of a batch are merged one by one.
+				e.flags &^= flagBatch
+				n, err := w.Write(e.Encode())
+				if err != nil {
+					return err
 				}
+				index.set(key, offset)
+				offset += int64(n)
 			}
 		}
-		db.segments = append([]*Segment{segment}, db.segments[len(db.segments)-1])
-	}()
+		return w.Flush()
+	})
+	if err != nil {
+		db.fs.Remove(filePath + tmpFileSuffix)
+		return err
+	}
+	segment, err := db.seal(&Segment{
+		filePath: filePath,
+		index:    index,
+	})
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	db.segments = append([]*Segment{segment}, db.segments[len(merged):]...)
+	db.mu.Unlock()
+	if db.cache != nil {
+		db.cache.purge()
+	}
+	for _, s := range merged {
+		if err := db.removeSegment(s.filePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeSegment deletes the segment file together with its index and bloom
+// filter files.
+func (db *Db) removeSegment(filePath string) error {
+	return db.removeFiles(filePath, filePath+tableIndexSuffix, filePath+bloomFilterSuffix)
+}
+
+// removeFiles deletes files that are no longer used by the Db. While read
+// snapshots are open the files are kept until the last one is released.
+func (db *Db) removeFiles(paths ...string) error {
+	db.pinMu.Lock()
+	if db.pins > 0 {
+		db.unusedFiles = append(db.unusedFiles, paths...)
+		db.pinMu.Unlock()
+		return nil
+	}
+	db.pinMu.Unlock()
+	for _, path := range paths {
+		if err := db.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
 }
 
 func (db *Db) checkKey(key string, segments []*Segment) bool {
 	for _, s := range segments {
-		if _, ok := s.index[key]; ok {
+		if _, ok, err := s.index.get(key); ok || err != nil {
 			return true
 		}
 	}
 	return false
 }
 
+// segmentFile is a segment file name parsed by parseSegmentName.
+type segmentFile struct {
+	path   string
+	id     int
+	merged bool
+}
+
+func parseSegmentName(path string) (segmentFile, bool) {
+	name := strings.TrimPrefix(filepath.Base(path), outFileName)
+	merged := strings.HasSuffix(name, mergedSegmentSuffix)
+	id, err := strconv.Atoi(strings.TrimSuffix(name, mergedSegmentSuffix))
+	if err != nil || id < 0 {
+		return segmentFile{}, false
+	}
+	return segmentFile{path, id, merged}, true
+}
+
+// recover opens the segments left in the directory. Files of an interrupted
+// compaction or superseded by a merged segment are removed, and a record
+// partially written to the last segment is truncated.
 func (db *Db) recover() error {
-	var err error
-	var buf [bufSize]byte
+	if err := db.removeBackupDirs(); err != nil {
+		return err
+	}
+	paths, err := listFiles(db.fs, db.dir, outFileName)
+	if err != nil {
+		return err
+	}
+	var files []segmentFile
+	supersededBy := -1
+	for _, path := range paths {
+		if strings.HasSuffix(path, tmpFileSuffix) {
+			if err := db.fs.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+		f, ok := parseSegmentName(path)
+		if !ok {
+			continue
+		}
+		if f.merged && f.id > supersededBy {
+			supersededBy = f.id
+		}
+		files = append(files, f)
+	}
+
+	var live []segmentFile
+	for _, f := range files {
+		if f.id < supersededBy || f.id == supersededBy && !f.merged {
+			if err := db.removeSegment(f.path); err != nil {
+				return err
+			}
+			continue
+		}
+		live = append(live, f)
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].id < live[j].id
+	})
+	if len(live) == 0 {
+		return db.addSegment()
+	}
+	db.segmentIndex = live[len(live)-1].id + 1
 
-	for _, segment := range db.segments {
-		file, err := os.Open(segment.filePath)
+	for _, f := range live[:len(live)-1] {
+		segment, err := db.openSegment(f.path)
 		if err != nil {
 			return err
 		}
-		defer file.Close()
-
-		reader := bufio.NewReaderSize(file, bufSize)
-		for err == nil {
-			var (
-				header, data []byte
-				n            int
-			)
-			header, err = reader.Peek(bufSize)
-			if err == io.EOF {
-				if len(header) == 0 {
-					break
-				}
-			} else if err != nil {
+		db.segments = append(db.segments, segment)
+	}
+	return db.openActiveSegment(live[len(live)-1].path)
+}
+
+// removeBackupDirs removes the backups left staged by a stopped process.
+func (db *Db) removeBackupDirs() error {
+	entries, err := db.fs.ReadDir(db.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), backupDirPrefix) {
+			if err := removeDir(db.fs, filepath.Join(db.dir, e.Name())); err != nil {
 				return err
 			}
-			size := binary.LittleEndian.Uint32(header)
+		}
+	}
+	return nil
+}
 
-			if size < bufSize {
-				data = buf[:size]
-			} else {
-				data = make([]byte, size)
-			}
-			n, err = io.ReadFull(reader, data)
+// openSegment loads a sealed segment, reusing its persisted index and bloom
+// filter when they exist.
+func (db *Db) openSegment(filePath string) (*Segment, error) {
+	segment := &Segment{filePath: filePath}
+	if db.tableFences > 0 {
+		t, err := openTableIndex(db.fs, filePath, db.tableFences)
+		if err == nil {
+			segment.index = t
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if db.bloomFPRate > 0 {
+		bloom, err := readBloomFilter(db.fs, filePath+bloomFilterSuffix)
+		if err == nil {
+			segment.bloom = bloom
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if segment.index != nil && (db.bloomFPRate == 0 || segment.bloom != nil) {
+		return segment, nil
+	}
 
-			if err == nil {
-				if n != int(size) {
-					return fmt.Errorf("corrupted file")
-				}
+	index, size, err := db.scanSegment(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if stat, err := db.fs.Stat(filePath); err != nil {
+		return nil, err
+	} else if stat.Size() != size {
+		return nil, fmt.Errorf("corrupted segment %s", filePath)
+	}
+	segment.index = index
+	return db.seal(segment)
+}
 
-				var e entry
-				e.Decode(data)
-				segment.index[e.key] = db.outOffset
-				db.outOffset += int64(n)
-			}
-		}
+// openActiveSegment reopens the last segment for writing.
+func (db *Db) openActiveSegment(filePath string) error {
+	index, size, err := db.scanSegment(filePath)
+	if err != nil {
+		return err
 	}
+	f, err := db.fs.OpenFile(filePath, os.O_APPEND|os.O_RDWR, 0777)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	db.out = f
+	db.outPath = filePath
+	db.outOffset = size
+	db.activeIndex = index
+	db.segments = append(db.segments, &Segment{
+		filePath: filePath,
+		index:    index,
+	})
+	return nil
+}
 
-	return err
+// scanSegment indexes the records of the segment file. It stops at a
+// partially written record or batch and returns the size of the complete
+// ones.
+func (db *Db) scanSegment(filePath string) (*shardedIndex, int64, error) {
+	file, err := db.fs.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	index := newShardedIndex()
+	size, err := readCommitted(bufio.NewReaderSize(file, bufSize), func(e entry, offset int64) {
+		index.set(e.key, offset)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return index, size, nil
 }
 
+// Close waits for a running compaction and closes the files.
 func (db *Db) Close() error {
+	db.compactions.Wait()
+	if db.syncStop != nil {
+		close(db.syncStop)
+	}
+	if db.syncWrites {
+		db.putOps <- db.sync
+		if err := <-db.putDone; err != nil {
+			return err
+		}
+	}
+	if db.vlog != nil {
+		if err := db.vlog.close(); err != nil {
+			return err
+		}
+	}
 	return db.out.Close()
 }
 
-func (db *Db) Get(key string) (string, error) {
-	resultChan := make(chan WorkerResult)
-	db.workerRequest <- WorkerRequest{Key: key, ResultChan: resultChan}
-
-	go func() {
-		result := <-db.workerResult
-		resultChan <- result
-	}()
+// sync flushes the written records of the active files to disk. It must run
+// on the put routine.
+func (db *Db) sync() error {
+	if !db.dirty {
+		return nil
+	}
+	if db.vlog != nil {
+		if err := db.vlog.out.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := db.out.Sync(); err != nil {
+		return err
+	}
+	db.dirty = false
+	return nil
+}
 
-	result := <-resultChan
+// syncPeriodically syncs the files every syncInterval. A failed sync is
+// reported by the next write.
+func (db *Db) syncPeriodically() {
+	ticker := time.NewTicker(db.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.syncStop:
+			return
+		case <-ticker.C:
+			db.putOps <- func() error {
+				if err := db.sync(); err != nil {
+					db.syncErr = err
+				}
+				return nil
+			}
+			<-db.putDone
+		}
+	}
+}
 
-	return result.Value, result.Err
+// Get returns the value of the key. Reads run on the calling goroutine and
+// take no lock shared with the writes but the one of the key's index shard.
+func (db *Db) Get(key string) (string, error) {
+	return db.get(key)
 }
 
 func (db *Db) startPutRoutine() {
 	go func() {
 		for {
-			e := <-db.putOps
-			length := e.length()
-			stat, err := db.out.Stat()
-			if err != nil {
-				db.putDone <- err
-				continue
+			op := <-db.putOps
+			err := op()
+			if err == nil && db.vlog != nil && len(db.vlog.sealed) >= valueLogMaxSealed {
+				err = db.collectValueLog()
 			}
-			if stat.Size()+length > db.segmentSize {
-				err := db.addSegment()
-				if err != nil {
-					db.putDone <- err
-					continue
-				}
+			if err == nil && db.syncWrites && db.syncInterval == 0 {
+				err = db.sync()
 			}
-			n, err := db.out.Write(e.Encode())
-			if err == nil {
-				db.indexOps <- IndexOp{
-					isWrite: true,
-					key:     e.key,
-					index:   int64(n),
-				}
+			if err == nil && db.syncErr != nil {
+				err, db.syncErr = db.syncErr, nil
 			}
-			db.putDone <- nil
+			db.putDone <- err
 		}
 	}()
 }
 
+// writeEntry encodes the value of the record and appends it to the active
+// segment. It must run on the put routine.
+func (db *Db) writeEntry(e entry) error {
+	encoded, err := db.encodeValue(e)
+	if err != nil {
+		return err
+	}
+	if err := db.appendEntries(encoded); err != nil {
+		return err
+	}
+	db.publish(e)
+	return nil
+}
+
+// publish passes a written record to the watchers and the secondary index.
+func (db *Db) publish(e entry) {
+	seq := db.seq.Add(1)
+	deleted := e.flags&flagTombstone != 0
+	db.watchers.publish(Change{Seq: seq, Key: e.key, Value: e.value, Deleted: deleted})
+	if db.secondary != nil {
+		db.secondary.update(e.key, e.value, deleted)
+	}
+}
+
+// appendEntries appends already encoded records to the active segment with
+// a single write, several records as a batch which is not split between
+// segments.
+func (db *Db) appendEntries(entries ...entry) error {
+	var size int64
+	for i, e := range entries {
+		if db.vlog != nil && e.flags&(flagValuePointer|flagTombstone) == 0 {
+			p, err := db.vlog.append(entry{key: e.key, value: e.value, flags: e.flags})
+			if err != nil {
+				return err
+			}
+			entries[i] = entry{
+				key:   e.key,
+				value: p.encode(),
+				flags: flagValuePointer,
+				seq:   e.seq,
+			}
+		}
+		size += entries[i].length()
+	}
+	if db.outOffset+size > db.segmentSize {
+		err := db.addSegment()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := db.out.Write(encodeBatch(entries))
+	if err != nil {
+		// Drop the partially written records so the segment stays readable.
+		db.out.Truncate(db.outOffset)
+		return err
+	}
+	// The records are indexed together, so readers see either none or all
+	// of them. The cache is invalidated only once the index points to the
+	// new records, otherwise a concurrent miss could cache an old value
+	// under the new epoch.
+	keys := make([]string, len(entries))
+	positions := make([]int64, len(entries))
+	offset := db.outOffset
+	for i, e := range entries {
+		keys[i], positions[i] = e.key, offset
+		offset += e.length()
+	}
+	db.activeIndex.setAll(keys, positions)
+	if db.cache != nil {
+		for _, key := range keys {
+			db.cache.invalidate(key)
+		}
+	}
+	db.outOffset += int64(n)
+	db.dirty = true
+	return nil
+}
+
+func (db *Db) activeSegment() *Segment {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if len(db.segments) == 0 {
+		return nil
+	}
+	return db.segments[len(db.segments)-1]
+}
+
+// Put stores the value of the key. Keys and values over MaxKeySize and
+// MaxValueSize are rejected with ErrKeyTooLarge and ErrValueTooLarge.
 func (db *Db) Put(key, value string) error {
+	if err := checkSize(key, value); err != nil {
+		return err
+	}
 	e := entry{
 		key:   key,
 		value: value,
 	}
-	db.putOps <- e
+	db.putOps <- func() error {
+		return db.writeEntry(e)
+	}
 	return <-db.putDone
 }
+
+func (db *Db) Update(key string, fn func(value string, ok bool) (string, error)) error {
+	db.putOps <- func() error {
+		value, err := db.get(key)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		value, err = fn(value, err == nil)
+		if err != nil {
+			return err
+		}
+		if err := checkSize(key, value); err != nil {
+			return err
+		}
+		return db.writeEntry(entry{
+			key:   key,
+			value: value,
+		})
+	}
+	return <-db.putDone
+}
+
+func (db *Db) Incr(key string, delta int64) (int64, error) {
+	return incr(db, key, delta)
+}
+
+func (db *Db) GetInt64(key string) (int64, error) {
+	return getInt64(db, key)
+}
+
+// Delete removes the key by writing a tombstone record. It returns
+// ErrNotFound if the key does not exist.
+func (db *Db) Delete(key string) error {
+	db.putOps <- func() error {
+		if _, err := db.lookupEntry(key); err != nil {
+			return err
+		}
+		return db.writeEntry(entry{
+			key:   key,
+			flags: flagTombstone,
+		})
+	}
+	return <-db.putDone
+}
+
+// Scan calls fn in key order for every key with the given prefix. Keys
+// written or deleted while scanning may or may not be visited.
+func (db *Db) Scan(prefix string, fn func(key, value string) error) error {
+	keys, err := db.listKeys(prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		value, err := db.Get(key)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeyScanner is a Store which lists its keys without reading the values.
+type KeyScanner interface {
+	// ScanKeys calls fn in key order for every key with the prefix which
+	// sorts after the key after.
+	ScanKeys(prefix, after string, fn func(key string) error) error
+}
+
+var _ KeyScanner = (*Db)(nil)
+
+// ScanKeys reads only the record headers, to skip the deleted keys. Keys
+// written or deleted while scanning may or may not be visited.
+func (db *Db) ScanKeys(prefix, after string, fn func(key string) error) error {
+	keys, err := db.listKeys(prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys[sort.SearchStrings(keys, after):] {
+		if key == after {
+			continue
+		}
+		ok, err := db.exists(key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exists reports whether the newest record of the key is not a tombstone.
+// Only the header of the record is read.
+func (db *Db) exists(key string) (bool, error) {
+	keyPos, file, err := db.openRecord(key)
+	if err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	header := make([]byte, entryHeaderSize+len(key))
+	if _, err := file.ReadAt(header, keyPos.position); err != nil {
+		return false, err
+	}
+	if kl := binary.LittleEndian.Uint32(header[4:]); int(kl) != len(key) {
+		return false, fmt.Errorf("%w: key length %d of %s", ErrCorruptedRecord, kl, key)
+	}
+	return binary.LittleEndian.Uint32(header[len(key)+8:])&flagTombstone == 0, nil
+}
+
+// listKeys returns the sorted keys with the prefix indexed by the current
+// segments.
+func (db *Db) listKeys(prefix string) ([]string, error) {
+	var keys []string
+	err := db.withSegments(func(segments []*Segment) error {
+		var err error
+		keys, err = segmentKeys(segments, prefix)
+		return err
+	})
+	return keys, err
+}
+
+// segmentKeys returns the sorted keys with the prefix indexed by the segments.
+func segmentKeys(segments []*Segment, prefix string) ([]string, error) {
+	seen := make(map[string]struct{})
+	var keys []string
+	for _, segment := range segments {
+		indexKeys, err := segment.index.keys()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range indexKeys {
+			if _, ok := seen[key]; ok || !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
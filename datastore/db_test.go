@@ -1,6 +1,7 @@
 package datastore
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -172,7 +173,9 @@ func TestDb_Segmentation(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			expectedSize := int64(69)
+			// The three merged records keep the sequence numbers of their
+			// writes.
+			expectedSize := int64(69 + 3*entrySeqSize)
 			if outInfo.Size() != expectedSize {
 				t.Errorf("Unexpected size (%d vs %d)", expectedSize, outInfo.Size())
 			}
@@ -194,3 +197,105 @@ func TestDb_Segmentation(t *testing.T) {
 		})
 	})
 }
+
+func TestDb_CompactionThreshold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	segments := func(db *Db) int {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		return len(db.segments)
+	}
+
+	db, err := NewDb(dir, 50, WithCompactionThreshold(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put("key", fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	if n := segments(db); n < 5 {
+		t.Errorf("Expected no compaction, got %d segments", n)
+	}
+
+	db, err = NewDb(dir, 50, WithCompactionThreshold(4), WithCompactionDelay(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, value := range []string{"value10", "value11", "last"} {
+		if err := db.Put("key", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.compactions.Wait()
+	if n := segments(db); n > 3 {
+		t.Errorf("Expected the segments to be compacted, got %d", n)
+	}
+	if value, err := db.Get("key"); err != nil || value != "last" {
+		t.Errorf("Unexpected value %s %v", value, err)
+	}
+
+	if _, err := NewDb(dir, 50, WithCompactionThreshold(1)); err == nil {
+		t.Error("Expected an error for a threshold of 1")
+	}
+}
+
+func TestDb_Compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 50, WithCompactionThreshold(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Compact(); err != nil {
+		t.Errorf("Expected nothing to compact, got %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%3), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.mu.RLock()
+	n := len(db.segments)
+	db.mu.RUnlock()
+	if n != 2 {
+		t.Errorf("Expected a merged and an active segment, got %d segments", n)
+	}
+	if err := db.Compact(); err != nil {
+		t.Errorf("Expected a merged segment to be left alone, got %v", err)
+	}
+	for key, want := range map[string]string{"key1": "value7", "key2": "value8"} {
+		if value, err := db.Get(key); err != nil || value != want {
+			t.Errorf("Unexpected value of %s %q %v", key, value, err)
+		}
+	}
+	if _, err := db.Get("key0"); err != ErrNotFound {
+		t.Errorf("Expected key0 to stay deleted, got %v", err)
+	}
+
+	db.compacting.Store(true)
+	if err := db.Compact(); err != ErrCompactionRunning {
+		t.Errorf("Expected ErrCompactionRunning, got %v", err)
+	}
+	db.compacting.Store(false)
+}
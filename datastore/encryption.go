@@ -0,0 +1,170 @@
+package datastore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	encryptionCheckFileName = "encryption-key"
+	encryptionCheckText     = "lab4-go datastore"
+)
+
+var (
+	ErrWrongEncryptionKey   = errors.New("wrong encryption key")
+	ErrUnknownEncryptionKey = errors.New("unknown encryption key")
+)
+
+// EncryptionKey is an AES key (16, 24 or 32 bytes) tagged with the id stored
+// next to every record it encrypts.
+type EncryptionKey struct {
+	ID  uint8
+	Key []byte
+}
+
+// ReadEncryptionKey loads a hex encoded key from a file.
+func ReadEncryptionKey(id uint8, path string) (EncryptionKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return EncryptionKey{}, err
+	}
+	return parseEncryptionKey(id, string(data))
+}
+
+// EncryptionKeyFromEnv loads a hex encoded key from an environment variable.
+func EncryptionKeyFromEnv(id uint8, name string) (EncryptionKey, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return EncryptionKey{}, fmt.Errorf("environment variable %s is not set", name)
+	}
+	return parseEncryptionKey(id, value)
+}
+
+func parseEncryptionKey(id uint8, value string) (EncryptionKey, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return EncryptionKey{}, fmt.Errorf("bad encryption key %d: %w", id, err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return EncryptionKey{}, fmt.Errorf("bad encryption key %d: length %d", id, len(key))
+	}
+	return EncryptionKey{ID: id, Key: key}, nil
+}
+
+type keyRing struct {
+	current uint8
+	ciphers map[uint8]cipher.AEAD
+}
+
+func newKeyRing(current EncryptionKey, previous []EncryptionKey) (*keyRing, error) {
+	kr := &keyRing{
+		current: current.ID,
+		ciphers: make(map[uint8]cipher.AEAD),
+	}
+	for _, k := range append([]EncryptionKey{current}, previous...) {
+		if _, ok := kr.ciphers[k.ID]; ok {
+			return nil, fmt.Errorf("duplicate encryption key id %d", k.ID)
+		}
+		block, err := aes.NewCipher(k.Key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		kr.ciphers[k.ID] = aead
+	}
+	return kr, nil
+}
+
+// seal encrypts the value with the current key. The result is the key id,
+// the nonce and the cipher text. The record key is authenticated as well.
+func (kr *keyRing) seal(key, value string) (string, error) {
+	aead := kr.ciphers[kr.current]
+	res := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(value)+aead.Overhead())
+	res[0] = kr.current
+	if _, err := io.ReadFull(rand.Reader, res[1:]); err != nil {
+		return "", err
+	}
+	res = aead.Seal(res, res[1:], []byte(value), []byte(key))
+	return string(res), nil
+}
+
+func (kr *keyRing) open(key, value string) (string, error) {
+	if len(value) == 0 {
+		return "", fmt.Errorf("record %s: empty encrypted value", key)
+	}
+	id := value[0]
+	aead, ok := kr.ciphers[id]
+	if !ok {
+		return "", fmt.Errorf("record %s: %w %d", key, ErrUnknownEncryptionKey, id)
+	}
+	if len(value) < 1+aead.NonceSize() {
+		return "", fmt.Errorf("record %s: truncated encrypted value", key)
+	}
+	nonce := []byte(value[1 : 1+aead.NonceSize()])
+	data, err := aead.Open(nil, nonce, []byte(value[1+aead.NonceSize():]), []byte(key))
+	if err != nil {
+		return "", fmt.Errorf("record %s: %w %d", key, ErrWrongEncryptionKey, id)
+	}
+	return string(data), nil
+}
+
+// verify checks every key against the check file written when the key was
+// first used with the directory, creating the missing ones.
+func (kr *keyRing) verify(fs FS, dir string) error {
+	for id, aead := range kr.ciphers {
+		path := filepath.Join(dir, fmt.Sprintf("%s%d", encryptionCheckFileName, id))
+		data, err := readFile(fs, path)
+		if os.IsNotExist(err) {
+			nonce := make([]byte, aead.NonceSize())
+			if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+				return err
+			}
+			data = aead.Seal(nonce, nonce, []byte(encryptionCheckText), nil)
+			if err := writeFileAtomic(fs, path, data); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if len(data) < aead.NonceSize() {
+			return fmt.Errorf("corrupted encryption check file %s", path)
+		}
+		text, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+		if err != nil || !bytes.Equal(text, []byte(encryptionCheckText)) {
+			return fmt.Errorf("%w %d for %s", ErrWrongEncryptionKey, id, dir)
+		}
+	}
+	return nil
+}
+
+// rekey re-encrypts the record with the current key if it was encrypted with
+// an older one.
+func (db *Db) rekey(e entry) (entry, error) {
+	if db.keys == nil || e.flags&flagEncrypted == 0 || len(e.value) == 0 || e.value[0] == db.keys.current {
+		return e, nil
+	}
+	value, err := db.keys.open(e.key, e.value)
+	if err != nil {
+		return entry{}, err
+	}
+	e.value, err = db.keys.seal(e.key, value)
+	if err != nil {
+		return entry{}, err
+	}
+	return e, nil
+}
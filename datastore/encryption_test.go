@@ -0,0 +1,138 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKey(t *testing.T, id uint8, b byte) EncryptionKey {
+	key, err := parseEncryptionKey(id, strings.Repeat(string("0123456789abcdef"[b%16]), 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestEncryptionKey_Load(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "key")
+	if err := os.WriteFile(path, []byte(strings.Repeat("ab", 32)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := ReadEncryptionKey(1, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ID != 1 || len(key.Key) != 32 {
+		t.Errorf("Unexpected key %d of length %d", key.ID, len(key.Key))
+	}
+
+	t.Setenv("TEST_DB_KEY", strings.Repeat("cd", 16))
+	key, err = EncryptionKeyFromEnv(2, "TEST_DB_KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ID != 2 || len(key.Key) != 16 {
+		t.Errorf("Unexpected key %d of length %d", key.ID, len(key.Key))
+	}
+
+	if _, err := parseEncryptionKey(3, "abcd"); err == nil {
+		t.Error("Expected error for a short key")
+	}
+}
+
+func TestDb_Encryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key1 := testKey(t, 1, 1)
+	key2 := testKey(t, 2, 2)
+
+	db, err := NewDb(dir, 150, WithEncryption(key1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("put/get", func(t *testing.T) {
+		if err := db.Put("customer", "secret-value"); err != nil {
+			t.Fatal(err)
+		}
+		value, err := db.Get("customer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "secret-value" {
+			t.Errorf("Bad value returned expected secret-value, got %s", value)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, outFileName+"0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("secret-value")) {
+			t.Error("Value is stored in plain text")
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("wrong key", func(t *testing.T) {
+		_, err := NewDb(dir, 150, WithEncryption(EncryptionKey{ID: 1, Key: key2.Key}))
+		if !errors.Is(err, ErrWrongEncryptionKey) {
+			t.Errorf("Expected ErrWrongEncryptionKey, got %v", err)
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		db, err = NewDb(dir, 150, WithEncryption(key2, key1), WithCompactionDelay(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		value, err := db.Get("customer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "secret-value" {
+			t.Errorf("Bad value returned expected secret-value, got %s", value)
+		}
+
+		for _, key := range []string{"key1", "key2", "key3", "key4", "key5"} {
+			if err := db.Put(key, "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		e, err := db.lookupEntry("customer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.value[0] != key2.ID {
+			t.Errorf("Expected record to be re-encrypted with key %d, got %d", key2.ID, e.value[0])
+		}
+		value, err = db.Get("customer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "secret-value" {
+			t.Errorf("Bad value returned expected secret-value, got %s", value)
+		}
+	})
+}
@@ -3,71 +3,151 @@ package datastore
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 )
 
+// The upper bits of the value length word are used as record flags.
+// flagBatch marks the records of a batch which are followed by more records
+// of it, see encodeBatch. flagSequence marks the records whose value is
+// preceded by the sequence number of the write.
+const (
+	valueSizeMask    = 1<<26 - 1
+	flagValuePointer = 1 << 31
+	flagCompressed   = 1 << 30
+	flagEncrypted    = 1 << 29
+	flagTombstone    = 1 << 28
+	flagBatch        = 1 << 27
+	flagSequence     = 1 << 26
+)
+
+const (
+	// MaxKeySize and MaxValueSize limit the records accepted by Put.
+	MaxKeySize   = 1 << 16
+	MaxValueSize = 1 << 24
+
+	entryHeaderSize = 12
+	entrySeqSize    = 8
+	// maxValueOverhead bounds the growth of a value by encryption.
+	maxValueOverhead = 64
+	maxEntrySize     = entryHeaderSize + entrySeqSize + MaxKeySize + MaxValueSize + maxValueOverhead
+)
+
+var (
+	ErrKeyTooLarge     = errors.New("key is too large")
+	ErrValueTooLarge   = errors.New("value is too large")
+	ErrCorruptedRecord = errors.New("corrupted record")
+)
+
+// checkSize reports whether the record fits into the size limits.
+func checkSize(key, value string) error {
+	if len(key) > MaxKeySize {
+		return fmt.Errorf("%w: %d bytes, at most %d allowed", ErrKeyTooLarge, len(key), MaxKeySize)
+	}
+	if len(value) > MaxValueSize {
+		return fmt.Errorf("%w: %d bytes, at most %d allowed", ErrValueTooLarge, len(value), MaxValueSize)
+	}
+	return nil
+}
+
 type entry struct {
 	key, value string
+	flags      uint32
+	// seq is the sequence number of the write of a record moved by
+	// compaction or value log collection, see recordVersion.
+	seq uint64
 }
 
 func (e *entry) Encode() []byte {
 	kl := len(e.key)
 	vl := len(e.value)
-	size := kl + vl + 12
-	res := make([]byte, size)
-	binary.LittleEndian.PutUint32(res, uint32(size))
+	res := make([]byte, e.length())
+	binary.LittleEndian.PutUint32(res, uint32(len(res)))
 	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
 	copy(res[8:], e.key)
-	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
-	copy(res[kl+12:], e.value)
+	flags, value := e.flags, res[kl+12:]
+	if e.seq != 0 {
+		flags |= flagSequence
+		binary.LittleEndian.PutUint64(value, e.seq)
+		value = value[entrySeqSize:]
+	}
+	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl)|flags)
+	copy(value, e.value)
 	return res
 }
 
-func (e *entry) Decode(input []byte) {
-	kl := binary.LittleEndian.Uint32(input[4:])
-	keyBuf := make([]byte, kl)
-	copy(keyBuf, input[8:kl+8])
-	e.key = string(keyBuf)
-
-	vl := binary.LittleEndian.Uint32(input[kl+8:])
-	valBuf := make([]byte, vl)
-	copy(valBuf, input[kl+12:kl+12+vl])
-	e.value = string(valBuf)
+// Decode parses a record produced by Encode. Lengths that do not match the
+// size of the input are reported as ErrCorruptedRecord.
+func (e *entry) Decode(input []byte) error {
+	if len(input) < entryHeaderSize {
+		return fmt.Errorf("%w: %d bytes is too short", ErrCorruptedRecord, len(input))
+	}
+	if size := binary.LittleEndian.Uint32(input); uint64(size) != uint64(len(input)) {
+		return fmt.Errorf("%w: size %d of %d bytes", ErrCorruptedRecord, size, len(input))
+	}
+	kl := uint64(binary.LittleEndian.Uint32(input[4:]))
+	if kl > uint64(len(input)-entryHeaderSize) {
+		return fmt.Errorf("%w: key length %d of %d bytes", ErrCorruptedRecord, kl, len(input))
+	}
+	vw := binary.LittleEndian.Uint32(input[kl+8:])
+	vl := uint64(vw & valueSizeMask)
+	var sl uint64
+	if vw&flagSequence != 0 {
+		sl = entrySeqSize
+	}
+	if kl+sl+vl+entryHeaderSize != uint64(len(input)) {
+		return fmt.Errorf("%w: value length %d of %d bytes", ErrCorruptedRecord, vl, len(input))
+	}
+	e.key = string(input[8 : kl+8])
+	e.flags = vw &^ (valueSizeMask | flagSequence)
+	e.seq = 0
+	if sl > 0 {
+		if e.seq = binary.LittleEndian.Uint64(input[kl+12:]); e.seq == 0 {
+			return fmt.Errorf("%w: zero sequence number", ErrCorruptedRecord)
+		}
+	}
+	e.value = string(input[kl+12+sl:])
+	return nil
 }
 
-func readValue(in *bufio.Reader) (string, error) {
-	header, err := in.Peek(8)
+func readEntry(in *bufio.Reader) (entry, error) {
+	header, err := in.Peek(4)
 	if err != nil {
-		return "", err
+		return entry{}, err
 	}
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
-	if err != nil {
-		return "", err
+	size := int(binary.LittleEndian.Uint32(header))
+	if size < entryHeaderSize || size > maxEntrySize {
+		return entry{}, fmt.Errorf("%w: bad size %d", ErrCorruptedRecord, size)
 	}
-
-	header, err = in.Peek(4)
+	data := make([]byte, size)
+	n, err := io.ReadFull(in, data)
 	if err != nil {
-		return "", err
+		return entry{}, err
 	}
-	valSize := int(binary.LittleEndian.Uint32(header))
-	_, err = in.Discard(4)
-	if err != nil {
-		return "", err
+	if n != size {
+		return entry{}, fmt.Errorf("can't read record bytes (read %d, expected %d)", n, size)
+	}
+
+	var e entry
+	if err := e.Decode(data); err != nil {
+		return entry{}, err
 	}
+	return e, nil
+}
 
-	data := make([]byte, valSize)
-	n, err := in.Read(data)
+func readValue(in *bufio.Reader) (string, error) {
+	e, err := readEntry(in)
 	if err != nil {
 		return "", err
 	}
-	if n != valSize {
-		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
-	}
-
-	return string(data), nil
+	return e.value, nil
 }
 
 func (e *entry) length() int64 {
-	return int64(len(e.key) + len(e.value) + 12)
+	n := int64(len(e.key) + len(e.value) + entryHeaderSize)
+	if e.seq != 0 {
+		n += entrySeqSize
+	}
+	return n
 }
@@ -3,22 +3,33 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
 	"testing"
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", "value"}
-	e.Decode(e.Encode())
+	e := entry{key: "key", value: "value"}
+	if err := e.Decode(e.Encode()); err != nil {
+		t.Fatal(err)
+	}
 	if e.key != "key" {
 		t.Error("incorrect key")
 	}
 	if e.value != "value" {
 		t.Error("incorrect value")
 	}
+
+	e = entry{key: "key", value: "value", flags: flagTombstone, seq: 42}
+	var decoded entry
+	if err := decoded.Decode(e.Encode()); err != nil || decoded != e {
+		t.Errorf("Decoded %+v with sequence number, %v", decoded, err)
+	}
 }
 
 func TestReadValue(t *testing.T) {
-	e := entry{"key", "test-value"}
+	e := entry{key: "key", value: "test-value"}
 	data := e.Encode()
 	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
 	if err != nil {
@@ -28,3 +39,91 @@ func TestReadValue(t *testing.T) {
 		t.Errorf("Got bat value [%s]", v)
 	}
 }
+
+func TestEntry_DecodeCorrupted(t *testing.T) {
+	e := entry{key: "key", value: "value"}
+	valid := e.Encode()
+	corrupt := func(offset int, v uint32) []byte {
+		data := append([]byte(nil), valid...)
+		binary.LittleEndian.PutUint32(data[offset:], v)
+		return data
+	}
+	cases := map[string][]byte{
+		"empty":        nil,
+		"short":        valid[:8],
+		"truncated":    valid[:len(valid)-1],
+		"size":         corrupt(0, 1000),
+		"key length":   corrupt(4, 1<<31),
+		"value length": corrupt(11, 3),
+	}
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			var e entry
+			if err := e.Decode(data); !errors.Is(err, ErrCorruptedRecord) {
+				t.Errorf("Expected ErrCorruptedRecord, got %v", err)
+			}
+		})
+	}
+
+	t.Run("read huge size", func(t *testing.T) {
+		_, err := readEntry(bufio.NewReader(bytes.NewReader(corrupt(0, 1<<31))))
+		if !errors.Is(err, ErrCorruptedRecord) {
+			t.Errorf("Expected ErrCorruptedRecord, got %v", err)
+		}
+	})
+	t.Run("read truncated", func(t *testing.T) {
+		_, err := readEntry(bufio.NewReader(bytes.NewReader(valid[:len(valid)-1])))
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+		}
+	})
+}
+
+func FuzzEntry_Encode(f *testing.F) {
+	f.Add("key", "value", uint32(0), uint64(0))
+	f.Add("", "", uint32(flagTombstone), uint64(1))
+	f.Add("k", "compressed", uint32(flagCompressed|flagEncrypted), uint64(1<<41))
+	f.Fuzz(func(t *testing.T, key, value string, flags uint32, seq uint64) {
+		if len(value) > valueSizeMask {
+			t.Skip()
+		}
+		e := entry{key: key, value: value, flags: flags &^ (valueSizeMask | flagSequence), seq: seq}
+		var decoded entry
+		if err := decoded.Decode(e.Encode()); err != nil {
+			t.Fatal(err)
+		}
+		if decoded != e {
+			t.Errorf("Decoded %+v, expected %+v", decoded, e)
+		}
+	})
+}
+
+func FuzzEntry_Decode(f *testing.F) {
+	for _, e := range []entry{{key: "key", value: "value"}, {key: "deleted", flags: flagTombstone}, {key: "seq", value: "value", seq: 7}} {
+		f.Add(e.Encode())
+	}
+	f.Add([]byte{12, 0, 0, 0, 255, 255, 255, 255})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var e entry
+		if err := e.Decode(data); err != nil {
+			return
+		}
+		if !bytes.Equal(e.Encode(), data) {
+			t.Errorf("Record %+v decoded from %x encodes differently", e, data)
+		}
+	})
+}
+
+func FuzzReadEntry(f *testing.F) {
+	e := entry{key: "key", value: "value"}
+	f.Add(append(e.Encode(), e.Encode()...))
+	f.Add([]byte{255, 255, 255, 127})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := bufio.NewReader(bytes.NewReader(data))
+		for {
+			if _, err := readEntry(reader); err != nil {
+				return
+			}
+		}
+	})
+}
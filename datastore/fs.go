@@ -0,0 +1,177 @@
+package datastore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const tmpFileSuffix = ".tmp"
+
+// FS is the part of the file system used by Db.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Open(name string) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	Link(oldname, newname string) error
+	ReadDir(name string) ([]os.DirEntry, error)
+	MkdirAll(path string, perm os.FileMode) error
+}
+
+// File is an open file of an FS.
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// OSFS is the FS of the operating system.
+type OSFS struct{}
+
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (OSFS) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (OSFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (OSFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (OSFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func readFile(fs FS, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// writeFileAtomic writes the data to a temporary file and renames it to name
+// once it is synced, so name never holds partial data.
+func writeFileAtomic(fs FS, name string, data []byte) error {
+	return createFileAtomic(fs, name, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func createFileAtomic(fs FS, name string, write func(w io.Writer) error) error {
+	tmp := name + tmpFileSuffix
+	f, err := fs.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return fs.Rename(tmp, name)
+}
+
+// syncDir syncs the entries of the directory, so the files created or
+// renamed in it survive a crash.
+func syncDir(fs FS, dir string) error {
+	d, err := fs.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// copyFile copies the first size bytes of src to dst.
+func copyFile(fs FS, src, dst string, size int64) error {
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return createFileAtomic(fs, dst, func(w io.Writer) error {
+		_, err := io.CopyN(w, in, size)
+		return err
+	})
+}
+
+// linkFile hard-links src to dst, falling back to a copy when the file
+// system does not support links.
+func linkFile(fs FS, src, dst string) error {
+	if err := fs.Link(src, dst); err == nil || os.IsNotExist(err) {
+		return err
+	}
+	info, err := fs.Stat(src)
+	if err != nil {
+		return err
+	}
+	return copyFile(fs, src, dst, info.Size())
+}
+
+// removeDir removes a directory of files, if it exists.
+func removeDir(fs FS, dir string) error {
+	entries, err := fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := fs.Remove(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return fs.Remove(dir)
+}
+
+// listFiles returns the sorted paths of the files in dir with the prefix.
+func listFiles(fs FS, dir, prefix string) ([]string, error) {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), prefix) {
+			res = append(res, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
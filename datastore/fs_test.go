@@ -0,0 +1,471 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var errCrashed = errors.New("process crashed")
+
+// faultFS wraps OSFS to inject failures. With a byte budget it simulates a
+// crash: the write that exceeds the budget is cut short and every later
+// change of the file system fails. A short write makes only the next write
+// partial. Open errors are returned for the files matched by openErr and
+// the hook set by setAfterWrite runs after every write.
+type faultFS struct {
+	OSFS
+	mu         sync.Mutex
+	budget     int64
+	written    int64
+	crashed    bool
+	shortWrite bool
+	syncs      int
+	openErr    func(name string) error
+	afterWrite atomic.Pointer[func()]
+}
+
+func newFaultFS() *faultFS {
+	return &faultFS{budget: -1}
+}
+
+// change runs a change of the file system that writes no data unless the
+// process has crashed.
+func (fs *faultFS) change(op func() error) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.crashed || fs.budget == 0 {
+		fs.crashed = true
+		return errCrashed
+	}
+	return op()
+}
+
+// write writes as much of p to f as the faults allow.
+func (fs *faultFS) write(f *os.File, p []byte) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var faultErr error
+	switch {
+	case fs.crashed:
+		return 0, errCrashed
+	case fs.budget >= 0 && int64(len(p)) > fs.budget:
+		p = p[:fs.budget]
+		fs.crashed = true
+		faultErr = syscall.ENOSPC
+	case fs.shortWrite && len(p) > 1:
+		p = p[:len(p)/2]
+		fs.shortWrite = false
+		faultErr = syscall.ENOSPC
+	}
+	if fs.budget > 0 {
+		fs.budget -= int64(len(p))
+	}
+	fs.written += int64(len(p))
+	n, err := f.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, faultErr
+}
+
+// setAfterWrite sets the hook run after every write, which may come from a
+// background compaction. A nil fn removes it.
+func (fs *faultFS) setAfterWrite(fn func()) {
+	if fn == nil {
+		fs.afterWrite.Store(nil)
+		return
+	}
+	fs.afterWrite.Store(&fn)
+}
+
+// crash makes every later change fail, as if the process has stopped.
+func (fs *faultFS) crash() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.crashed = true
+}
+
+func (fs *faultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if fs.openErr != nil {
+		if err := fs.openErr(name); err != nil {
+			return nil, err
+		}
+	}
+	var f *os.File
+	open := func() (err error) {
+		f, err = os.OpenFile(name, flag, perm)
+		return err
+	}
+	var err error
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		err = fs.change(open)
+	} else {
+		err = open()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{f, fs}, nil
+}
+
+func (fs *faultFS) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *faultFS) Remove(name string) error {
+	return fs.change(func() error {
+		return os.Remove(name)
+	})
+}
+
+func (fs *faultFS) Rename(oldpath, newpath string) error {
+	return fs.change(func() error {
+		return os.Rename(oldpath, newpath)
+	})
+}
+
+type faultFile struct {
+	*os.File
+	fs *faultFS
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	n, err := f.fs.write(f.File, p)
+	if hook := f.fs.afterWrite.Load(); hook != nil {
+		(*hook)()
+	}
+	return n, err
+}
+
+// ReadFrom hides the one of os.File, so io.Copy to the file goes through
+// Write and its faults.
+func (f *faultFile) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{f}, r)
+}
+
+func (f *faultFile) Sync() error {
+	return f.fs.change(func() error {
+		f.fs.syncs++
+		return f.File.Sync()
+	})
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	return f.fs.change(func() error {
+		return f.File.Truncate(size)
+	})
+}
+
+// crashOp is a put of value or, if del is set, a delete of the key.
+type crashOp struct {
+	key, value string
+	del        bool
+}
+
+func crashWorkload() []crashOp {
+	var ops []crashOp
+	present := make(map[string]bool)
+	for i := 0; i < 60; i++ {
+		key := fmt.Sprintf("key%d", i%7)
+		if i%5 == 4 && present[key] {
+			ops = append(ops, crashOp{key: key, del: true})
+			present[key] = false
+			continue
+		}
+		ops = append(ops, crashOp{key: key, value: strings.Repeat(fmt.Sprint(i), i%4+1)})
+		present[key] = true
+	}
+	return ops
+}
+
+// runCrashWorkload applies the operations until one of them fails. It
+// returns the values of the acknowledged operations and the failed one.
+func runCrashWorkload(db *Db, ops []crashOp) (map[string]*string, *crashOp) {
+	state := make(map[string]*string)
+	for i := range ops {
+		op := &ops[i]
+		var err error
+		if op.del {
+			err = db.Delete(op.key)
+		} else {
+			err = db.Put(op.key, op.value)
+		}
+		if err != nil {
+			return state, op
+		}
+		if op.del {
+			state[op.key] = nil
+		} else {
+			value := op.value
+			state[op.key] = &value
+		}
+	}
+	return state, nil
+}
+
+func checkCrashState(t *testing.T, db *Db, ops []crashOp, state map[string]*string, failed *crashOp) {
+	t.Helper()
+	for _, op := range ops {
+		value, err := db.Get(op.key)
+		if err != nil && err != ErrNotFound {
+			t.Fatalf("Cannot get %s: %s", op.key, err)
+		}
+		var got *string
+		if err == nil {
+			got = &value
+		}
+		same := func(want *string) bool {
+			return want == nil && got == nil || want != nil && got != nil && *want == *got
+		}
+		if same(state[op.key]) {
+			continue
+		}
+		if failed != nil && failed.key == op.key {
+			if failed.del && got == nil || !failed.del && got != nil && *got == failed.value {
+				continue
+			}
+		}
+		t.Fatalf("Bad value of %s after recovery: %v", op.key, value)
+	}
+}
+
+func TestDb_CrashConsistency(t *testing.T) {
+	configs := map[string][]Option{
+		"hash":      nil,
+		"table":     {WithTableIndex(2), WithBloomFilter(0.01)},
+		"value log": {WithValueLog(150)},
+	}
+	// The compactions cut short by the crashes are expected to fail.
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	ops := crashWorkload()
+	for name, opts := range configs {
+		t.Run(name, func(t *testing.T) {
+			open := func(dir string, fs FS) (*Db, error) {
+				return NewDb(dir, 120, append([]Option{WithFS(fs), WithCompactionDelay(0)}, opts...)...)
+			}
+
+			dir, err := ioutil.TempDir("", "test-db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs := newFaultFS()
+			db, err := open(dir, fs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, failed := runCrashWorkload(db, ops); failed != nil {
+				t.Fatalf("Workload failed without faults at %+v", *failed)
+			}
+			db.Close()
+			os.RemoveAll(dir)
+			total := fs.written
+
+			for crashAt := int64(0); crashAt < total+100; crashAt += 9 {
+				dir, err := ioutil.TempDir("", "test-db")
+				if err != nil {
+					t.Fatal(err)
+				}
+				fs := newFaultFS()
+				fs.budget = crashAt
+
+				state := make(map[string]*string)
+				var failed *crashOp
+				if db, err := open(dir, fs); err == nil {
+					state, failed = runCrashWorkload(db, ops)
+					db.Close()
+				}
+				// A compaction still running in background must not touch
+				// the files of the recovered Db.
+				fs.crash()
+
+				db, err := open(dir, OSFS{})
+				if err != nil {
+					t.Fatalf("Cannot recover after crash at byte %d: %s", crashAt, err)
+				}
+				checkCrashState(t, db, ops, state, failed)
+
+				// The recovered Db must stay writable.
+				if err := db.Put("key0", "recovered"); err != nil {
+					t.Fatal(err)
+				}
+				db.Close()
+				db, err = open(dir, OSFS{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if value, err := db.Get("key0"); err != nil || value != "recovered" {
+					t.Fatalf("Bad value after a put to the recovered Db: %s, %v", value, err)
+				}
+				db.Close()
+				os.RemoveAll(dir)
+			}
+		})
+	}
+}
+
+func TestDb_ShortWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := newFaultFS()
+	db, err := NewDb(dir, 1000, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	fs.shortWrite = true
+	if err := db.Put("key2", "value2"); err == nil {
+		t.Error("Expected an error on a short write")
+	}
+	if err := db.Put("key3", "value3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key2"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for the failed put, got %v", err)
+	}
+	db.Close()
+
+	db, err = NewDb(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for key, want := range map[string]string{"key1": "value1", "key3": "value3"} {
+		value, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != want {
+			t.Errorf("Bad value of %s: expected %s, got %s", key, want, value)
+		}
+	}
+}
+
+func TestDb_OpenError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := newFaultFS()
+	fs.openErr = func(name string) error {
+		if filepath.Base(name) == outFileName+"0" {
+			return syscall.EACCES
+		}
+		return nil
+	}
+	if _, err := NewDb(dir, 1000, WithFS(fs)); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("Expected the open error, got %v", err)
+	}
+}
+
+func TestDb_CompactionError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	fs := newFaultFS()
+	fs.openErr = func(name string) error {
+		if strings.HasSuffix(name, mergedSegmentSuffix+tmpFileSuffix) {
+			return syscall.EACCES
+		}
+		return nil
+	}
+	db, err := NewDb(dir, 50, WithFS(fs), WithCompactionThreshold(4), WithCompactionDelay(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		if err := db.Put("key", fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.compactions.Wait()
+	if !strings.Contains(logged.String(), "Cannot compact segments") {
+		t.Errorf("Expected the compaction error to be logged, got %q", logged.String())
+	}
+	if value, err := db.Get("key"); err != nil || value != "value9" {
+		t.Errorf("Unexpected value %s %v", value, err)
+	}
+}
+
+func TestDb_Sync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	syncs := func(fs *faultFS) int {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		return fs.syncs
+	}
+
+	fs := newFaultFS()
+	db, err := NewDb(dir, 1000, WithFS(fs), WithSync(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := syncs(fs)
+	for i := 0; i < 3; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Get("key1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := syncs(fs) - before; n != 3 {
+		t.Errorf("Expected a sync after every write, got %d", n)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = newFaultFS()
+	db, err = NewDb(dir, 1000, WithFS(fs), WithSync(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before = syncs(fs)
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for syncs(fs) == before {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a periodic sync")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+const indexShards = 32
+
+type hashIndex map[string]int64
+
+// shardedIndex is a hashIndex split into lock-striped shards by key hash, so
+// lookups of different keys do not wait for each other or for writes.
+type shardedIndex struct {
+	shards [indexShards]indexShard
+}
+
+type indexShard struct {
+	mu    sync.RWMutex
+	index hashIndex
+}
+
+func newShardedIndex() *shardedIndex {
+	idx := &shardedIndex{}
+	for i := range idx.shards {
+		idx.shards[i].index = make(hashIndex)
+	}
+	return idx
+}
+
+func (idx *shardedIndex) shardIndex(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32() % indexShards
+}
+
+func (idx *shardedIndex) shard(key string) *indexShard {
+	return &idx.shards[idx.shardIndex(key)]
+}
+
+func (idx *shardedIndex) get(key string) (int64, bool, error) {
+	s := idx.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	position, ok := s.index[key]
+	return position, ok, nil
+}
+
+func (idx *shardedIndex) set(key string, position int64) {
+	s := idx.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index[key] = position
+}
+
+// setAll sets the positions of several keys at once. Their shards are locked
+// together, so a reader sees either none or all of the new positions.
+func (idx *shardedIndex) setAll(keys []string, positions []int64) {
+	var locked [indexShards]bool
+	for _, key := range keys {
+		locked[idx.shardIndex(key)] = true
+	}
+	// The shards are locked in order, so concurrent calls can't deadlock.
+	for i := range locked {
+		if locked[i] {
+			idx.shards[i].mu.Lock()
+			defer idx.shards[i].mu.Unlock()
+		}
+	}
+	for i, key := range keys {
+		idx.shards[idx.shardIndex(key)].index[key] = positions[i]
+	}
+}
+
+// clone returns a copy of the index which is not changed by later sets.
+func (idx *shardedIndex) clone() *shardedIndex {
+	res := newShardedIndex()
+	for i := range idx.shards {
+		s := &idx.shards[i]
+		s.mu.RLock()
+		for key, position := range s.index {
+			res.shards[i].index[key] = position
+		}
+		s.mu.RUnlock()
+	}
+	return res
+}
+
+// keys returns a copy of all indexed keys.
+func (idx *shardedIndex) keys() ([]string, error) {
+	var res []string
+	for i := range idx.shards {
+		s := &idx.shards[i]
+		s.mu.RLock()
+		for key := range s.index {
+			res = append(res, key)
+		}
+		s.mu.RUnlock()
+	}
+	return res, nil
+}
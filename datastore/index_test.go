@@ -0,0 +1,192 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestShardedIndex(t *testing.T) {
+	idx := newShardedIndex()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				idx.set(fmt.Sprintf("key%d-%d", i, j), int64(j))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if position, ok, _ := idx.get("key3-42"); !ok || position != 42 {
+		t.Errorf("Unexpected position %d %t", position, ok)
+	}
+	if _, ok, _ := idx.get("missing"); ok {
+		t.Error("Unexpected position for a missing key")
+	}
+	keys, _ := idx.keys()
+	if len(keys) != 800 {
+		t.Errorf("Expected 800 keys, got %d", len(keys))
+	}
+	sort.Strings(keys)
+	if keys[0] != "key0-0" {
+		t.Errorf("Unexpected first key %s", keys[0])
+	}
+}
+
+// channelIndex reproduces the previous design where a single goroutine owned
+// the index and served reads and writes through unbuffered channels.
+type channelIndex struct {
+	ops       chan channelIndexOp
+	positions chan int64
+}
+
+type channelIndexOp struct {
+	isWrite  bool
+	key      string
+	position int64
+}
+
+func newChannelIndex() *channelIndex {
+	idx := &channelIndex{
+		ops:       make(chan channelIndexOp),
+		positions: make(chan int64),
+	}
+	go func() {
+		index := make(hashIndex)
+		for op := range idx.ops {
+			if op.isWrite {
+				index[op.key] = op.position
+			} else {
+				idx.positions <- index[op.key]
+			}
+		}
+	}()
+	return idx
+}
+
+func (idx *channelIndex) get(key string) int64 {
+	idx.ops <- channelIndexOp{key: key}
+	return <-idx.positions
+}
+
+func (idx *channelIndex) set(key string, position int64) {
+	idx.ops <- channelIndexOp{isWrite: true, key: key, position: position}
+}
+
+const benchKeys = 10000
+
+func benchKey(i int) string {
+	return fmt.Sprintf("key%d", i%benchKeys)
+}
+
+func BenchmarkIndex_ChannelParallel(b *testing.B) {
+	idx := newChannelIndex()
+	defer close(idx.ops)
+	for i := 0; i < benchKeys; i++ {
+		idx.set(benchKey(i), int64(i))
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			i := r.Intn(benchKeys)
+			if i%10 == 0 {
+				idx.set(benchKey(i), int64(i))
+			} else {
+				idx.get(benchKey(i))
+			}
+		}
+	})
+}
+
+func BenchmarkIndex_ShardedParallel(b *testing.B) {
+	idx := newShardedIndex()
+	for i := 0; i < benchKeys; i++ {
+		idx.set(benchKey(i), int64(i))
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			i := r.Intn(benchKeys)
+			if i%10 == 0 {
+				idx.set(benchKey(i), int64(i))
+			} else {
+				idx.get(benchKey(i))
+			}
+		}
+	})
+}
+
+func BenchmarkDb_GetParallel(b *testing.B) {
+	dir, err := ioutil.TempDir("", "bench-db")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1<<20)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 1000; i++ {
+		if err := db.Put(benchKey(i), "value"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			if _, err := db.Get(benchKey(r.Intn(1000))); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDb_GetParallelWithWrites(b *testing.B) {
+	dir, err := ioutil.TempDir("", "bench-db")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1<<20)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 1000; i++ {
+		if err := db.Put(benchKey(i), "value"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			i := r.Intn(1000)
+			var err error
+			if i%10 == 0 {
+				err = db.Put(benchKey(i), "value")
+			} else {
+				_, err = db.Get(benchKey(i))
+			}
+			if err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,441 @@
+package datastore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	lsmWalFileName = "lsm-wal"
+	lsmL0Tables    = 4
+	lsmLevelRatio  = 10
+)
+
+// LSM is a Store built as a log-structured merge tree. Writes go to a write
+// ahead log and an in-memory table which is flushed to a sorted table on
+// level 0 once it reaches the configured size. Level 0 tables are merged into
+// level 1 and every other level is merged into the next one once it outgrows
+// lsmLevelRatio times the previous level. Every write is synced to the log
+// before it is acknowledged.
+type LSM struct {
+	mu       sync.RWMutex
+	dir      string
+	memtable map[string]entry
+	memSize  int64
+	memLimit int64
+	wal      *os.File
+	levels   [][]*sstable
+	seq      int
+	fs       FS
+	remove   func(name string) error
+}
+
+var _ Store = (*LSM)(nil)
+
+func NewLSM(dir string, memtableSize int64) (*LSM, error) {
+	l := &LSM{
+		dir:      dir,
+		memtable: make(map[string]entry),
+		memLimit: memtableSize,
+		fs:       OSFS{},
+		remove:   os.Remove,
+	}
+	if err := l.openTables(); err != nil {
+		return nil, err
+	}
+	if err := l.replayWal(); err != nil {
+		return nil, err
+	}
+	wal, err := os.OpenFile(filepath.Join(dir, lsmWalFileName), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	l.wal = wal
+	return l, nil
+}
+
+// openTables opens the tables left in the directory. The temporary files
+// of a flush or a merge cut short are removed.
+func (l *LSM) openTables() error {
+	names, err := filepath.Glob(filepath.Join(l.dir, sstFileName+"-*"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, tmpFileSuffix) {
+			if err := l.fs.Remove(name); err != nil {
+				return err
+			}
+			continue
+		}
+		var level, seq int
+		if _, err := fmt.Sscanf(filepath.Base(name), sstFileName+"-%d-%d", &level, &seq); err != nil {
+			continue
+		}
+		t, err := openSSTable(l.dir, level, seq)
+		if err != nil {
+			return err
+		}
+		l.addTable(t)
+		if seq >= l.seq {
+			l.seq = seq + 1
+		}
+	}
+	return nil
+}
+
+func (l *LSM) replayWal() error {
+	path := filepath.Join(l.dir, lsmWalFileName)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	size, err := readCommitted(bufio.NewReaderSize(file, bufSize), func(e entry, _ int64) {
+		l.setMem(e)
+	})
+	if err != nil {
+		return err
+	}
+	// A record or a batch cut short is dropped, so that the records written
+	// next don't commit it.
+	return os.Truncate(path, size)
+}
+
+// addTable inserts the table into its level keeping the newest table first.
+func (l *LSM) addTable(t *sstable) {
+	for len(l.levels) <= t.level {
+		l.levels = append(l.levels, nil)
+	}
+	level := append(l.levels[t.level], t)
+	sort.Slice(level, func(i, j int) bool {
+		return level[i].seq > level[j].seq
+	})
+	l.levels[t.level] = level
+}
+
+func (l *LSM) removeTables(tables []*sstable) error {
+	for _, t := range tables {
+		level := l.levels[t.level]
+		for i, lt := range level {
+			if lt == t {
+				l.levels[t.level] = append(level[:i], level[i+1:]...)
+				break
+			}
+		}
+		if err := l.remove(t.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *LSM) setMem(e entry) {
+	if old, ok := l.memtable[e.key]; ok {
+		l.memSize -= old.length()
+	}
+	l.memtable[e.key] = e
+	l.memSize += e.length()
+}
+
+func (l *LSM) get(key string) (entry, error) {
+	if e, ok := l.memtable[key]; ok {
+		return e, nil
+	}
+	for _, level := range l.levels {
+		for _, t := range level {
+			e, ok, err := t.get(key)
+			if err != nil {
+				return entry{}, err
+			}
+			if ok {
+				return e, nil
+			}
+		}
+	}
+	return entry{}, ErrNotFound
+}
+
+func (l *LSM) Get(key string) (string, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	e, err := l.get(key)
+	if err != nil {
+		return "", err
+	}
+	if e.flags&flagTombstone != 0 {
+		return "", ErrNotFound
+	}
+	return e.value, nil
+}
+
+// write appends the records to the write ahead log with a single write,
+// several records as a batch, syncs it and adds them to the memtable.
+func (l *LSM) write(entries ...entry) error {
+	if _, err := l.wal.Write(encodeBatch(entries)); err != nil {
+		return err
+	}
+	if err := l.wal.Sync(); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		l.setMem(e)
+	}
+	if l.memSize < l.memLimit {
+		return nil
+	}
+	if err := l.flush(); err != nil {
+		return err
+	}
+	return l.compact()
+}
+
+func (l *LSM) Put(key, value string) error {
+	if err := checkSize(key, value); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.write(entry{
+		key:   key,
+		value: value,
+	})
+}
+
+func (l *LSM) Update(key string, fn func(value string, ok bool) (string, error)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, err := l.get(key)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	ok := err == nil && e.flags&flagTombstone == 0
+	if !ok {
+		e.value = ""
+	}
+	value, err := fn(e.value, ok)
+	if err != nil {
+		return err
+	}
+	if err := checkSize(key, value); err != nil {
+		return err
+	}
+	return l.write(entry{
+		key:   key,
+		value: value,
+	})
+}
+
+func (l *LSM) Incr(key string, delta int64) (int64, error) {
+	return incr(l, key, delta)
+}
+
+func (l *LSM) GetInt64(key string) (int64, error) {
+	return getInt64(l, key)
+}
+
+func (l *LSM) Delete(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, err := l.get(key)
+	if err != nil {
+		return err
+	}
+	if e.flags&flagTombstone != 0 {
+		return ErrNotFound
+	}
+	return l.write(entry{
+		key:   key,
+		flags: flagTombstone,
+	})
+}
+
+// flush writes the memtable to a new level 0 table and resets the log. The
+// log is truncated only after the table is synced and renamed into place,
+// so the records of a flush cut short are replayed from the log.
+func (l *LSM) flush() error {
+	entries := make([]entry, 0, len(l.memtable))
+	for _, e := range l.memtable {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	t, err := writeSSTable(l.fs, l.dir, 0, l.seq, entries)
+	if err != nil {
+		return err
+	}
+	l.seq++
+	l.addTable(t)
+
+	l.memtable = make(map[string]entry)
+	l.memSize = 0
+	return l.wal.Truncate(0)
+}
+
+func (l *LSM) levelLimit(level int) int64 {
+	limit := l.memLimit * lsmL0Tables
+	for i := 1; i < level; i++ {
+		limit *= lsmLevelRatio
+	}
+	return limit
+}
+
+func (l *LSM) compact() error {
+	if len(l.levels[0]) >= lsmL0Tables {
+		if err := l.merge(l.levels[0], 1); err != nil {
+			return err
+		}
+	}
+	for level := 1; level < len(l.levels); level++ {
+		var size int64
+		for _, t := range l.levels[level] {
+			size += t.size
+		}
+		if size > l.levelLimit(level) {
+			// The oldest table of the level is pushed down.
+			oldest := l.levels[level][len(l.levels[level])-1]
+			if err := l.merge([]*sstable{oldest}, level+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// merge rewrites the input tables together with the overlapping tables of
+// the target level into new tables on that level.
+func (l *LSM) merge(inputs []*sstable, target int) error {
+	inputs = append([]*sstable(nil), inputs...)
+	first, last := inputs[0].first, inputs[0].last
+	for _, t := range inputs {
+		if t.first < first {
+			first = t.first
+		}
+		if t.last > last {
+			last = t.last
+		}
+	}
+	var overlapping []*sstable
+	if target < len(l.levels) {
+		for _, t := range l.levels[target] {
+			if t.overlaps(first, last) {
+				overlapping = append(overlapping, t)
+			}
+		}
+	}
+
+	// Older tables are applied first so that newer records win.
+	sources := append(append([]*sstable(nil), inputs...), overlapping...)
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].level != sources[j].level {
+			return sources[i].level > sources[j].level
+		}
+		return sources[i].seq < sources[j].seq
+	})
+	merged := make(map[string]entry)
+	for _, t := range sources {
+		if err := t.scan(func(e entry) error {
+			merged[e.key] = e
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	bottom := true
+	for level := target + 1; level < len(l.levels); level++ {
+		if len(l.levels[level]) > 0 {
+			bottom = false
+		}
+	}
+	entries := make([]entry, 0, len(merged))
+	for _, e := range merged {
+		if bottom && e.flags&flagTombstone != 0 {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	var outputs []*sstable
+	for len(entries) > 0 {
+		n := 0
+		var size int64
+		for n < len(entries) && size < l.memLimit {
+			size += entries[n].length()
+			n++
+		}
+		t, err := writeSSTable(l.fs, l.dir, target, l.seq, entries[:n])
+		if err != nil {
+			return err
+		}
+		l.seq++
+		outputs = append(outputs, t)
+		entries = entries[n:]
+	}
+	for _, t := range outputs {
+		l.addTable(t)
+	}
+	// The outputs are synced by now. The sources are removed oldest first,
+	// so if the process stops midway the tables left over are newer than
+	// the removed ones and hold the same records as the outputs, and no
+	// older table shadows a record the outputs have updated or deleted.
+	return l.removeTables(sources)
+}
+
+func (l *LSM) Scan(prefix string, fn func(key, value string) error) error {
+	l.mu.RLock()
+	merged := make(map[string]entry)
+	for level := len(l.levels) - 1; level >= 0; level-- {
+		tables := l.levels[level]
+		for i := len(tables) - 1; i >= 0; i-- {
+			err := tables[i].scan(func(e entry) error {
+				if strings.HasPrefix(e.key, prefix) {
+					merged[e.key] = e
+				}
+				return nil
+			})
+			if err != nil {
+				l.mu.RUnlock()
+				return err
+			}
+		}
+	}
+	for key, e := range l.memtable {
+		if strings.HasPrefix(key, prefix) {
+			merged[key] = e
+		}
+	}
+	l.mu.RUnlock()
+
+	keys := make([]string, 0, len(merged))
+	for key, e := range merged {
+		if e.flags&flagTombstone == 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, merged[key].value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *LSM) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.wal.Close()
+}
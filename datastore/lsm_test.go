@@ -0,0 +1,203 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLSM_Compaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := NewLSM(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 500; i++ {
+		if err := l.Put(fmt.Sprintf("key%03d", i%150), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 150; i += 3 {
+		if err := l.Delete(fmt.Sprintf("key%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("levels", func(t *testing.T) {
+		if len(l.levels[0]) >= lsmL0Tables {
+			t.Errorf("Expected level 0 to be compacted, got %d tables", len(l.levels[0]))
+		}
+		if len(l.levels) < 3 {
+			t.Errorf("Expected data to reach level 2, got %d levels", len(l.levels))
+		}
+		for level := 1; level < len(l.levels); level++ {
+			tables := l.levels[level]
+			for i := range tables {
+				for j := i + 1; j < len(tables); j++ {
+					if tables[i].overlaps(tables[j].first, tables[j].last) {
+						t.Errorf("Tables %s and %s overlap", tables[i].path, tables[j].path)
+					}
+				}
+			}
+		}
+	})
+
+	check := func(t *testing.T, l *LSM) {
+		for i := 350; i < 500; i++ {
+			key := fmt.Sprintf("key%03d", i%150)
+			value, err := l.Get(key)
+			if i%150%3 == 0 {
+				if err != ErrNotFound {
+					t.Errorf("Expected %s to be deleted, got %s %v", key, value, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != fmt.Sprintf("value%d", i) {
+				t.Errorf("Bad value returned for %s expected value%d, got %s", key, i, value)
+			}
+		}
+	}
+	t.Run("get", func(t *testing.T) {
+		check(t, l)
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+		l, err = NewLSM(dir, 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		check(t, l)
+	})
+}
+
+func TestLSM_MergeInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Every write fills the memtable, so every put makes a level 0 table and
+	// the fourth one merges them into level 1.
+	l, err := NewLSM(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := 0
+	l.remove = func(name string) error {
+		if removed == 1 {
+			return errCrashed
+		}
+		removed++
+		return os.Remove(name)
+	}
+	for i, kv := range [][2]string{{"a", "1"}, {"a", "2"}, {"b", "x"}} {
+		if err := l.Put(kv[0], kv[1]); err != nil {
+			t.Fatalf("Put %d: %s", i, err)
+		}
+	}
+	if err := l.Put("a", "3"); err != errCrashed {
+		t.Fatalf("Expected the merge to stop after a removal, got %v", err)
+	}
+	l.Close()
+
+	l, err = NewLSM(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if value, err := l.Get("a"); err != nil || value != "3" {
+		t.Errorf("Expected the newest value after an interrupted merge, got %q %v", value, err)
+	}
+	if value, err := l.Get("b"); err != nil || value != "x" {
+		t.Errorf("Unexpected value of b %q %v", value, err)
+	}
+}
+
+func TestLSM_TableWriteInterrupted(t *testing.T) {
+	for name, c := range map[string]struct {
+		puts   [][2]string
+		crash  func(*faultFS)
+		logged bool // the last put is only in the log
+	}{
+		// The table of the put is cut short, its record is only in the log.
+		"flush": {
+			puts: [][2]string{{"a", "1"}},
+			crash: func(fs *faultFS) {
+				fs.budget = 2
+			},
+			logged: true,
+		},
+		// The fourth table is written and the merge into level 1 is cut
+		// short in its first output.
+		"merge": {
+			puts: [][2]string{{"a", "1"}, {"a", "2"}, {"b", "x"}, {"a", "3"}},
+			crash: func(fs *faultFS) {
+				last := entry{key: "a", value: "3"}
+				fs.budget = int64(len(last.Encode())) + 2
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			l, err := NewLSM(dir, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs := newFaultFS()
+			l.fs = fs
+			last := len(c.puts) - 1
+			for _, kv := range c.puts[:last] {
+				if err := l.Put(kv[0], kv[1]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c.crash(fs)
+			if err := l.Put(c.puts[last][0], c.puts[last][1]); err == nil {
+				t.Fatal("Expected the table write to fail")
+			}
+			l.Close()
+			if info, err := os.Stat(filepath.Join(dir, lsmWalFileName)); c.logged && (err != nil || info.Size() == 0) {
+				t.Fatalf("Expected the log to keep the record of the failed flush, got %v", err)
+			}
+
+			l, err = NewLSM(dir, 1)
+			if err != nil {
+				t.Fatalf("Cannot open the tables after a crash: %s", err)
+			}
+			defer l.Close()
+			want := make(map[string]string)
+			for _, kv := range c.puts {
+				want[kv[0]] = kv[1]
+			}
+			for key, value := range want {
+				if got, err := l.Get(key); err != nil || got != value {
+					t.Errorf("Expected %s of %s, got %q %v", value, key, got, err)
+				}
+			}
+			if tmp, _ := filepath.Glob(filepath.Join(dir, "*"+tmpFileSuffix)); len(tmp) != 0 {
+				t.Errorf("Unexpected temporary files %v", tmp)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package datastore
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemStore is a Store that keeps everything in memory. It is meant for tests
+// and throwaway environments, its content is lost on Close.
+type MemStore struct {
+	mu    sync.RWMutex
+	data  map[string]string
+	stats dbStats
+}
+
+var _ Store = (*MemStore)(nil)
+var _ KeyScanner = (*MemStore)(nil)
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		data: make(map[string]string),
+	}
+}
+
+func (m *MemStore) Get(key string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	value, ok := m.data[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (m *MemStore) Put(key, value string) error {
+	if err := checkSize(key, value); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = value
+	m.stats.rawValueBytes.Add(int64(len(value)))
+	m.stats.storedValueBytes.Add(int64(len(value)))
+	return nil
+}
+
+func (m *MemStore) Update(key string, fn func(value string, ok bool) (string, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.data[key]
+	value, err := fn(value, ok)
+	if err != nil {
+		return err
+	}
+	if err := checkSize(key, value); err != nil {
+		return err
+	}
+	m.data[key] = value
+	m.stats.rawValueBytes.Add(int64(len(value)))
+	m.stats.storedValueBytes.Add(int64(len(value)))
+	return nil
+}
+
+func (m *MemStore) Incr(key string, delta int64) (int64, error) {
+	return incr(m, key, delta)
+}
+
+func (m *MemStore) GetInt64(key string) (int64, error) {
+	return getInt64(m, key)
+}
+
+func (m *MemStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data[key]; !ok {
+		return ErrNotFound
+	}
+	delete(m.data, key)
+	return nil
+}
+
+func (m *MemStore) Scan(prefix string, fn func(key, value string) error) error {
+	m.mu.RLock()
+	var keys []string
+	values := make(map[string]string)
+	for key, value := range m.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+			values[key] = value
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) ScanKeys(prefix, after string, fn func(key string) error) error {
+	m.mu.RLock()
+	var keys []string
+	for key := range m.data {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats reports the same counters as Db.Stats. Values are never compressed
+// or cached.
+func (m *MemStore) Stats() Stats {
+	return Stats{
+		RawValueBytes:    m.stats.rawValueBytes.Load(),
+		StoredValueBytes: m.stats.storedValueBytes.Load(),
+		CompressionRatio: 1,
+	}
+}
+
+func (m *MemStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data = make(map[string]string)
+	return nil
+}
@@ -0,0 +1,148 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+)
+
+// Option configures optional Db features in NewDb.
+type Option func(db *Db) error
+
+// WithValueLog enables key/value separation: segments keep only keys and
+// pointers while values go to value log files of up to fileSize bytes.
+func WithValueLog(fileSize int64) Option {
+	return func(db *Db) error {
+		if fileSize <= 0 {
+			return fmt.Errorf("bad value log file size %d", fileSize)
+		}
+		db.valueLogSize = fileSize
+		return nil
+	}
+}
+
+// WithCompression compresses values of at least threshold bytes with flate.
+// Values that do not get smaller are stored as is.
+func WithCompression(threshold int) Option {
+	return func(db *Db) error {
+		if threshold <= 0 {
+			return fmt.Errorf("bad compression threshold %d", threshold)
+		}
+		db.compressMin = threshold
+		return nil
+	}
+}
+
+// WithEncryption encrypts values with AES-GCM using the current key. The
+// previous keys are only used to read older records, which are re-encrypted
+// with the current key during compaction.
+func WithEncryption(current EncryptionKey, previous ...EncryptionKey) Option {
+	return func(db *Db) error {
+		keys, err := newKeyRing(current, previous)
+		if err != nil {
+			return err
+		}
+		db.keys = keys
+		return nil
+	}
+}
+
+// WithCache keeps recently read values in an LRU cache of up to budget bytes.
+func WithCache(budget int64) Option {
+	return func(db *Db) error {
+		if budget <= 0 {
+			return fmt.Errorf("bad cache budget %d", budget)
+		}
+		db.cache = newValueCache(budget)
+		return nil
+	}
+}
+
+// WithCompactionDelay sets how long compaction waits after it is triggered.
+func WithCompactionDelay(d time.Duration) Option {
+	return func(db *Db) error {
+		if d < 0 {
+			return fmt.Errorf("bad compaction delay %s", d)
+		}
+		db.compactDelay = d
+		return nil
+	}
+}
+
+// WithTableIndex keeps the indexes of sealed segments on disk as sorted
+// tables with every fenceInterval-th key held in memory.
+func WithTableIndex(fenceInterval int) Option {
+	return func(db *Db) error {
+		if fenceInterval <= 0 {
+			return fmt.Errorf("bad fence interval %d", fenceInterval)
+		}
+		db.tableFences = fenceInterval
+		return nil
+	}
+}
+
+// WithBloomFilter gives every sealed segment a bloom filter with the given
+// false positive rate which is consulted before the segment index.
+func WithBloomFilter(fpRate float64) Option {
+	return func(db *Db) error {
+		if fpRate <= 0 || fpRate >= 1 {
+			return fmt.Errorf("bad bloom filter false positive rate %f", fpRate)
+		}
+		db.bloomFPRate = fpRate
+		return nil
+	}
+}
+
+// WithFS makes the Db keep its files in fs instead of the file system of the
+// operating system.
+func WithFS(fs FS) Option {
+	return func(db *Db) error {
+		if fs == nil {
+			return fmt.Errorf("nil file system")
+		}
+		db.fs = fs
+		return nil
+	}
+}
+
+// WithSecondaryIndex indexes the values of JSON documents at the fields, so
+// they can be queried with FindBy. Nested fields are separated with dots.
+func WithSecondaryIndex(fields ...string) Option {
+	return func(db *Db) error {
+		if len(fields) == 0 {
+			return fmt.Errorf("no fields to index")
+		}
+		for _, field := range fields {
+			if field == "" {
+				return fmt.Errorf("empty field to index")
+			}
+		}
+		db.secondary = newSecondaryIndex(fields)
+		return nil
+	}
+}
+
+// WithCompactionThreshold sets how many segments trigger a compaction of all
+// but the active one. Zero disables compaction.
+func WithCompactionThreshold(segments int) Option {
+	return func(db *Db) error {
+		if segments < 0 || segments == 1 {
+			return fmt.Errorf("bad compaction threshold %d", segments)
+		}
+		db.compactAt = segments
+		return nil
+	}
+}
+
+// WithSync makes writes durable by syncing the files to disk. A zero
+// interval syncs after every write, otherwise the files are synced every
+// interval and a crash loses at most the writes of the last interval.
+func WithSync(interval time.Duration) Option {
+	return func(db *Db) error {
+		if interval < 0 {
+			return fmt.Errorf("bad sync interval %s", interval)
+		}
+		db.syncWrites = true
+		db.syncInterval = interval
+		return nil
+	}
+}
@@ -0,0 +1,128 @@
+package datastore
+
+import "sync"
+
+// Snapshot is a read-only view of the Db pinned at a sequence number. It
+// sees the state after exactly Seq writes however many writes follow. The
+// files it reads are kept on disk until Release is called.
+type Snapshot struct {
+	db       *Db
+	seq      uint64
+	segments []*Segment
+	release  sync.Once
+}
+
+// NewSnapshot returns a view of the current state of the Db. It must be
+// released once it is no longer used.
+func (db *Db) NewSnapshot() *Snapshot {
+	var s *Snapshot
+	db.putOps <- func() error {
+		s = db.newSnapshot()
+		return nil
+	}
+	<-db.putDone
+	return s
+}
+
+// newSnapshot must run on the put routine so that no write is half applied.
+func (db *Db) newSnapshot() *Snapshot {
+	s := &Snapshot{
+		db:  db,
+		seq: db.seq.Load(),
+	}
+	for _, segment := range db.pinSegments() {
+		copied := *segment
+		if segment.index == db.activeIndex {
+			copied.index = db.activeIndex.clone()
+		}
+		s.segments = append(s.segments, &copied)
+	}
+	return s
+}
+
+// Seq returns the number of writes visible to the snapshot.
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// Get returns the value of the key at the moment the snapshot was taken.
+func (s *Snapshot) Get(key string) (string, error) {
+	keyPos, err := lookupSegments(s.segments, key)
+	if err != nil {
+		return "", err
+	}
+	if keyPos == nil {
+		return "", ErrNotFound
+	}
+	file, err := s.db.fs.Open(keyPos.segment.filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	e, err := readEntryAt(file, keyPos.position)
+	if err != nil {
+		return "", err
+	}
+	return s.db.resolve(e)
+}
+
+// Scan calls fn in key order for every key with the given prefix as it was
+// when the snapshot was taken.
+func (s *Snapshot) Scan(prefix string, fn func(key, value string) error) error {
+	keys, err := segmentKeys(s.segments, prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		value, err := s.Get(key)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release unpins the files of the snapshot. Files the Db no longer uses are
+// removed when the last snapshot is released.
+func (s *Snapshot) Release() error {
+	var err error
+	s.release.Do(func() {
+		err = s.db.unpin()
+	})
+	return err
+}
+
+// pinSegments pins the files of the Db and returns the current segments.
+// The files are pinned under the lock, so compaction either has not
+// swapped the segments yet or sees the pin when it removes them.
+func (db *Db) pinSegments() []*Segment {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	db.pin()
+	return db.segments
+}
+
+// pin keeps the files the Db no longer uses on disk until unpin is called.
+func (db *Db) pin() {
+	db.pinMu.Lock()
+	defer db.pinMu.Unlock()
+	db.pins++
+}
+
+// unpin releases a pin, removing the unused files once the last one is
+// released.
+func (db *Db) unpin() error {
+	db.pinMu.Lock()
+	db.pins--
+	var unused []string
+	if db.pins == 0 {
+		unused, db.unusedFiles = db.unusedFiles, nil
+	}
+	db.pinMu.Unlock()
+	return db.removeFiles(unused...)
+}
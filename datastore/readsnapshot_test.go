@@ -0,0 +1,127 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDb_NewSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 500, WithCache(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, key+"1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := db.NewSnapshot()
+	defer s.Release()
+	if s.Seq() != 3 {
+		t.Errorf("Expected sequence number 3, got %d", s.Seq())
+	}
+	if err := db.Put("a", "a2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("d", "d1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string]string{"a": "a1", "b": "b1", "c": "c1"} {
+		value, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != expected {
+			t.Errorf("Bad snapshot value of %s: expected %s, got %s", key, expected, value)
+		}
+	}
+	if _, err := s.Get("d"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a key written after the snapshot, got %v", err)
+	}
+	if value, err := db.Get("a"); err != nil || value != "a2" {
+		t.Errorf("Unexpected current value %s %v", value, err)
+	}
+
+	var keys []string
+	err = s.Scan("", func(key, value string) error {
+		keys = append(keys, key+"="+value)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a=a1", "b=b1", "c=c1"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Unexpected snapshot scan %v", keys)
+	}
+}
+
+func TestDb_NewSnapshotKeepsFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 100, WithCompactionDelay(0), WithValueLog(100), WithTableIndex(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("old%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := db.NewSnapshot()
+	for i := 0; i < 40; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%10), fmt.Sprintf("new%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.CollectValueLog(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		value, err := s.Get(fmt.Sprintf("key%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != fmt.Sprintf("old%d", i) {
+			t.Errorf("Bad snapshot value of key%d: %s", i, value)
+		}
+	}
+
+	db.pinMu.Lock()
+	unused := append([]string(nil), db.unusedFiles...)
+	db.pinMu.Unlock()
+	if len(unused) == 0 {
+		t.Fatal("Expected files kept for the snapshot")
+	}
+	if err := s.Release(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range unused {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed after release, got %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrNotIndexed = errors.New("field is not indexed")
+
+// Finder is a Store that can look keys up by the fields of JSON values.
+type Finder interface {
+	FindBy(field, value string) ([]string, error)
+}
+
+var _ Finder = (*Db)(nil)
+
+// secondaryIndex maps the values of JSON fields to the keys holding them.
+// Fields are dotted paths into JSON objects, only scalar values are indexed.
+type secondaryIndex struct {
+	mu     sync.RWMutex
+	fields map[string]map[string]map[string]struct{}
+	// indexed holds the field values of every indexed key, so the old
+	// entries can be dropped without reading the old value.
+	indexed map[string]map[string]string
+}
+
+func newSecondaryIndex(fields []string) *secondaryIndex {
+	idx := &secondaryIndex{
+		fields:  make(map[string]map[string]map[string]struct{}),
+		indexed: make(map[string]map[string]string),
+	}
+	for _, field := range fields {
+		idx.fields[field] = make(map[string]map[string]struct{})
+	}
+	return idx
+}
+
+// fieldValue returns the text of a scalar JSON value at the dotted path.
+func fieldValue(doc interface{}, field string) (string, bool) {
+	for _, name := range strings.Split(field, ".") {
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if doc, ok = obj[name]; !ok {
+			return "", false
+		}
+	}
+	switch v := doc.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return fmt.Sprint(v), true
+	case nil:
+		return "null", true
+	}
+	return "", false
+}
+
+// update replaces the entries of the key with the fields of its new value.
+// Deleted keys and values which are not JSON objects have no entries.
+func (idx *secondaryIndex) update(key, value string, deleted bool) {
+	values := make(map[string]string)
+	if !deleted {
+		dec := json.NewDecoder(bytes.NewReader([]byte(value)))
+		dec.UseNumber()
+		var doc interface{}
+		if dec.Decode(&doc) == nil {
+			for field := range idx.fields {
+				if v, ok := fieldValue(doc, field); ok {
+					values[field] = v
+				}
+			}
+		}
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for field, v := range idx.indexed[key] {
+		keys := idx.fields[field][v]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(idx.fields[field], v)
+		}
+	}
+	delete(idx.indexed, key)
+	if len(values) == 0 {
+		return
+	}
+	for field, v := range values {
+		keys := idx.fields[field][v]
+		if keys == nil {
+			keys = make(map[string]struct{})
+			idx.fields[field][v] = keys
+		}
+		keys[key] = struct{}{}
+	}
+	idx.indexed[key] = values
+}
+
+func (idx *secondaryIndex) find(field, value string) ([]string, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	values, ok := idx.fields[field]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotIndexed, field)
+	}
+	res := make([]string, 0, len(values[value]))
+	for key := range values[value] {
+		res = append(res, key)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// rebuildSecondaryIndex indexes every stored value. It is used on recovery.
+func (db *Db) rebuildSecondaryIndex() error {
+	return db.Scan("", func(key, value string) error {
+		db.secondary.update(key, value, false)
+		return nil
+	})
+}
+
+// FindBy returns the sorted keys whose JSON value has the value at the
+// field. Numbers, booleans and null match their JSON text. The field must
+// be declared with WithSecondaryIndex, otherwise ErrNotIndexed is returned.
+func (db *Db) FindBy(field, value string) ([]string, error) {
+	if db.secondary == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotIndexed, field)
+	}
+	return db.secondary.find(field, value)
+}
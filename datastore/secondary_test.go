@@ -0,0 +1,79 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDb_FindBy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := []Option{WithCompactionDelay(0), WithSecondaryIndex("status", "owner.team", "priority")}
+	db, err := NewDb(dir, 150, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{
+		"task1": `{"status":"active","owner":{"team":"core"},"priority":1}`,
+		"task2": `{"status":"done","owner":{"team":"core"},"priority":2}`,
+		"task3": `{"status":"active","owner":{"team":"web"},"priority":1}`,
+		"task4": `not json`,
+		"task5": `{"status":["active"]}`,
+	}
+	for key, value := range values {
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(db *Db, field, value string, expected ...string) {
+		t.Helper()
+		keys, err := db.FindBy(field, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(expected) == 0 {
+			expected = []string{}
+		}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Unexpected keys with %s=%s: %v", field, value, keys)
+		}
+	}
+	check(db, "status", "active", "task1", "task3")
+	check(db, "owner.team", "core", "task1", "task2")
+	check(db, "priority", "1", "task1", "task3")
+	check(db, "status", "missing")
+
+	if err := db.Put("task1", `{"status":"done"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("task2"); err != nil {
+		t.Fatal(err)
+	}
+	check(db, "status", "active", "task3")
+	check(db, "status", "done", "task1")
+	check(db, "owner.team", "core")
+
+	if _, err := db.FindBy("other", "x"); !errors.Is(err, ErrNotIndexed) {
+		t.Errorf("Expected ErrNotIndexed, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 150, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db, "status", "active", "task3")
+	check(db, "status", "done", "task1")
+	check(db, "priority", "1", "task3")
+}
@@ -0,0 +1,251 @@
+package datastore
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Snapshotter is a Store that can write a consistent copy of itself.
+type Snapshotter interface {
+	Snapshot(dir string) error
+}
+
+var _ Snapshotter = (*Db)(nil)
+
+// Snapshot writes a point-in-time copy of the Db to dir, which must be empty
+// or not exist. The copy can be opened with NewDb using the same options.
+// Sealed files are hard-linked, the active segment and value log file are
+// copied up to the last written record. Only the list of the files is taken
+// on the put routine, writes go on while they are copied.
+func (db *Db) Snapshot(dir string) error {
+	if err := db.fs.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if files, err := db.fs.ReadDir(dir); err != nil {
+		return err
+	} else if len(files) > 0 {
+		return fmt.Errorf("snapshot directory %s is not empty", dir)
+	}
+
+	var files *snapshotFiles
+	db.putOps <- func() error {
+		var err error
+		files, err = db.snapshotFiles()
+		return err
+	}
+	if err := <-db.putDone; err != nil {
+		return err
+	}
+	err := files.write(db.fs, dir)
+	if unpinErr := db.unpin(); err == nil {
+		err = unpinErr
+	}
+	return err
+}
+
+// snapshotFiles are the files of a snapshot: the sealed ones are linked and
+// the active ones are copied up to their size at the time of the snapshot.
+type snapshotFiles struct {
+	linked []string
+	copied []copiedFile
+	checks map[string][]byte
+}
+
+type copiedFile struct {
+	path string
+	size int64
+}
+
+// snapshotFiles lists the files of the current state and pins them, so
+// compaction and value log collection keep them until unpin is called. It
+// must run on the put routine so that no write is half applied.
+func (db *Db) snapshotFiles() (*snapshotFiles, error) {
+	files := &snapshotFiles{checks: make(map[string][]byte)}
+	checks, err := listFiles(db.fs, db.dir, encryptionCheckFileName)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range checks {
+		data, err := readFile(db.fs, path)
+		if err != nil {
+			return nil, err
+		}
+		files.checks[path] = data
+	}
+
+	for _, s := range db.pinSegments() {
+		if s.filePath == db.outPath {
+			files.copied = append(files.copied, copiedFile{s.filePath, db.outOffset})
+			continue
+		}
+		files.linked = append(files.linked, s.filePath)
+		for _, path := range []string{s.filePath + tableIndexSuffix, s.filePath + bloomFilterSuffix} {
+			if _, err := db.fs.Stat(path); err == nil {
+				files.linked = append(files.linked, path)
+			}
+		}
+	}
+	if db.vlog != nil {
+		for _, id := range db.vlog.sealed {
+			files.linked = append(files.linked, db.vlog.filePath(id))
+		}
+		files.copied = append(files.copied, copiedFile{db.vlog.filePath(db.vlog.outID), db.vlog.outOffset})
+	}
+	return files, nil
+}
+
+func (files *snapshotFiles) write(fs FS, dir string) error {
+	target := func(path string) string {
+		return filepath.Join(dir, filepath.Base(path))
+	}
+	for _, path := range files.linked {
+		if err := linkFile(fs, path, target(path)); err != nil {
+			return err
+		}
+	}
+	for _, f := range files.copied {
+		if err := copyFile(fs, f.path, target(f.path), f.size); err != nil {
+			return err
+		}
+	}
+	for path, data := range files.checks {
+		if err := writeFileAtomic(fs, target(path), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupDirPrefix names the directories inside the data directory where the
+// backups are staged.
+const backupDirPrefix = "backup-"
+
+// backupStager is a Snapshotter which stages the backups on its own file
+// system, so that the sealed files are hard-linked rather than copied.
+type backupStager interface {
+	Snapshotter
+	backupDir() (FS, string, error)
+}
+
+var _ backupStager = (*Db)(nil)
+
+// backupDir returns a new empty directory for a backup inside the data
+// directory. A directory left by a backup that has not been closed is
+// removed.
+func (db *Db) backupDir() (FS, string, error) {
+	dir := filepath.Join(db.dir, fmt.Sprintf("%s%d", backupDirPrefix, db.backups.Add(1)))
+	if err := removeDir(db.fs, dir); err != nil {
+		return nil, "", err
+	}
+	return db.fs, dir, nil
+}
+
+// Backup is a snapshot of a store in a staging directory, taken before
+// anything is written so that a failed snapshot can still be reported.
+type Backup struct {
+	fs  FS
+	dir string
+}
+
+// NewBackup takes a snapshot of the store. Its files are removed by Close.
+// The Db stages it inside its data directory, other stores in a temporary
+// directory.
+func NewBackup(s Snapshotter) (*Backup, error) {
+	b := &Backup{fs: OSFS{}}
+	var err error
+	if stager, ok := s.(backupStager); ok {
+		b.fs, b.dir, err = stager.backupDir()
+	} else {
+		b.dir, err = os.MkdirTemp("", "db-backup")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Snapshot(b.dir); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// Write writes the snapshot to w as a tar archive.
+func (b *Backup) Write(w io.Writer) error {
+	files, err := b.fs.ReadDir(b.dir)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		info, err := f.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		in, err := b.fs.Open(filepath.Join(b.dir, f.Name()))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func (b *Backup) Close() error {
+	return removeDir(b.fs, b.dir)
+}
+
+// WriteBackup writes a snapshot of the store to w as a tar archive.
+func WriteBackup(s Snapshotter, w io.Writer) error {
+	b, err := NewBackup(s)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	return b.Write(w)
+}
+
+// RestoreBackup extracts an archive written by WriteBackup to dir, which
+// must be empty or not exist.
+func RestoreBackup(r io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if files, err := os.ReadDir(dir); err != nil {
+		return err
+	} else if len(files) > 0 {
+		return fmt.Errorf("restore directory %s is not empty", dir)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg || filepath.Base(header.Name) != header.Name || header.Name == ".." {
+			return fmt.Errorf("unexpected entry %s in backup", header.Name)
+		}
+		err = createFileAtomic(OSFS{}, filepath.Join(dir, header.Name), func(w io.Writer) error {
+			_, err := io.Copy(w, tr)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDb_Snapshot(t *testing.T) {
+	configs := map[string][]Option{
+		"hash":      nil,
+		"table":     {WithTableIndex(4), WithBloomFilter(0.01)},
+		"value log": {WithValueLog(200)},
+	}
+	for name, opts := range configs {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			opts := append([]Option{WithCompactionDelay(0)}, opts...)
+
+			if err := os.Mkdir(filepath.Join(dir, "db"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			db, err := NewDb(filepath.Join(dir, "db"), 150, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for i := 0; i < 30; i++ {
+				if err := db.Put(fmt.Sprintf("key%d", i%10), fmt.Sprintf("value%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Delete("key3"); err != nil {
+				t.Fatal(err)
+			}
+
+			snapshotDir := filepath.Join(dir, "snapshot")
+			if err := db.Snapshot(snapshotDir); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Snapshot(snapshotDir); err == nil {
+				t.Error("Expected an error for a non-empty snapshot directory")
+			}
+
+			// Later writes and compactions must not change the snapshot.
+			for i := 0; i < 30; i++ {
+				if err := db.Put(fmt.Sprintf("key%d", i%10), "changed"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			snapshot, err := NewDb(snapshotDir, 150, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer snapshot.Close()
+			for i := 0; i < 10; i++ {
+				key := fmt.Sprintf("key%d", i)
+				value, err := snapshot.Get(key)
+				if i == 3 {
+					if err != ErrNotFound {
+						t.Errorf("Expected ErrNotFound for the deleted key, got %v", err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if expected := fmt.Sprintf("value%d", i+20); value != expected {
+					t.Errorf("Bad value of %s in snapshot: expected %s, got %s", key, expected, value)
+				}
+			}
+		})
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "db"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDb(filepath.Join(dir, "db"), 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var backup bytes.Buffer
+	if err := WriteBackup(db, &backup); err != nil {
+		t.Fatal(err)
+	}
+	restoreDir := filepath.Join(dir, "restored")
+	if err := RestoreBackup(bytes.NewReader(backup.Bytes()), restoreDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreBackup(bytes.NewReader(backup.Bytes()), restoreDir); err == nil {
+		t.Error("Expected an error restoring to a non-empty directory")
+	}
+
+	restored, err := NewDb(restoreDir, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	for i := 0; i < 20; i++ {
+		value, err := restored.Get(fmt.Sprintf("key%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Bad restored value of key%d: %s", i, value)
+		}
+	}
+}
+
+func TestDb_BackupStaging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := newFaultFS()
+	db, err := NewDb(dir, 100, WithFS(fs), WithCompactionThreshold(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The files are copied after the put routine is released, so a write
+	// made while they are copied does not wait for the backup.
+	var wrote atomic.Bool
+	fs.setAfterWrite(func() {
+		if !wrote.CompareAndSwap(false, true) {
+			return
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- db.Put("during", "backup")
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(time.Second):
+			t.Error("A write waits for the backup")
+		}
+	})
+	b, err := NewBackup(db)
+	fs.setAfterWrite(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wrote.Load() {
+		t.Error("Expected the active segment to be copied")
+	}
+
+	if filepath.Dir(b.dir) != dir {
+		t.Errorf("Expected the backup to be staged in %s, got %s", dir, b.dir)
+	}
+	sealed := db.segmentList()[0].filePath
+	original, err := os.Stat(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged, err := os.Stat(filepath.Join(b.dir, filepath.Base(sealed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(original, staged) {
+		t.Error("Expected the sealed segment to be hard-linked")
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(b.dir); !os.IsNotExist(err) {
+		t.Errorf("Expected the staging directory to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package datastore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	sstFileName      = "sst"
+	sstFenceInterval = 16
+	sstBloomFPRate   = 0.01
+)
+
+// sstable is an immutable file of records sorted by key. A sparse index of
+// fences and a bloom filter are kept in memory.
+type sstable struct {
+	path        string
+	level       int
+	seq         int
+	size        int64
+	first, last string
+	fences      []fence
+	bloom       *bloomFilter
+}
+
+func sstPath(dir string, level, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%d-%d", sstFileName, level, seq))
+}
+
+// writeSSTable stores records that are already sorted by key. The table is
+// written to a temporary file which is synced and renamed into place, and
+// the rename is synced with the directory, so a table left by a crash is
+// either complete or has the temporary name.
+func writeSSTable(fs FS, dir string, level, seq int, entries []entry) (*sstable, error) {
+	t := &sstable{
+		path:  sstPath(dir, level, seq),
+		level: level,
+		seq:   seq,
+		bloom: newBloomFilter(len(entries), sstBloomFPRate),
+	}
+	err := createFileAtomic(fs, t.path, func(f io.Writer) error {
+		w := bufio.NewWriterSize(f, bufSize)
+		for i, e := range entries {
+			t.add(e, i)
+			n, err := w.Write(e.Encode())
+			if err != nil {
+				return err
+			}
+			t.size += int64(n)
+		}
+		return w.Flush()
+	})
+	if err != nil {
+		fs.Remove(t.path + tmpFileSuffix)
+		return nil, err
+	}
+	return t, syncDir(fs, dir)
+}
+
+func openSSTable(dir string, level, seq int) (*sstable, error) {
+	t := &sstable{
+		path:  sstPath(dir, level, seq),
+		level: level,
+		seq:   seq,
+	}
+	var entries []entry
+	if err := t.scan(func(e entry) error {
+		entries = append(entries, e)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	t.bloom = newBloomFilter(len(entries), sstBloomFPRate)
+	for i, e := range entries {
+		t.add(e, i)
+		t.size += e.length()
+	}
+	return t, nil
+}
+
+// add registers the i-th record of the table written at offset t.size.
+func (t *sstable) add(e entry, i int) {
+	if i == 0 {
+		t.first = e.key
+	}
+	t.last = e.key
+	if i%sstFenceInterval == 0 {
+		t.fences = append(t.fences, fence{e.key, t.size})
+	}
+	t.bloom.add(e.key)
+}
+
+func (t *sstable) get(key string) (entry, bool, error) {
+	if len(t.fences) == 0 || key < t.first || key > t.last || !t.bloom.mayContain(key) {
+		return entry{}, false, nil
+	}
+	i := sort.Search(len(t.fences), func(i int) bool {
+		return t.fences[i].key > key
+	}) - 1
+	end := t.size
+	if i+1 < len(t.fences) {
+		end = t.fences[i+1].offset
+	}
+
+	file, err := os.Open(t.path)
+	if err != nil {
+		return entry{}, false, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(io.NewSectionReader(file, t.fences[i].offset, end-t.fences[i].offset))
+	for {
+		e, err := readEntry(reader)
+		if err == io.EOF {
+			return entry{}, false, nil
+		} else if err != nil {
+			return entry{}, false, err
+		}
+		if e.key == key {
+			return e, true, nil
+		} else if e.key > key {
+			return entry{}, false, nil
+		}
+	}
+}
+
+func (t *sstable) scan(fn func(e entry) error) error {
+	file, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, bufSize)
+	for {
+		e, err := readEntry(reader)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+func (t *sstable) overlaps(first, last string) bool {
+	return t.first <= last && first <= t.last
+}
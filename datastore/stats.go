@@ -0,0 +1,48 @@
+package datastore
+
+import "sync/atomic"
+
+// Stats is a point-in-time view of the Db counters.
+type Stats struct {
+	// RawValueBytes is the size of the values written since the Db was opened.
+	RawValueBytes int64
+	// StoredValueBytes is how many bytes those values took after compression.
+	StoredValueBytes int64
+	// CompressionRatio is RawValueBytes / StoredValueBytes, 1 when nothing was written.
+	CompressionRatio float64
+	// CacheHits and CacheMisses count Get calls served with and without the
+	// value cache, CacheBytes is its current size.
+	CacheHits   int64
+	CacheMisses int64
+	CacheBytes  int64
+}
+
+// StatsReporter is a Store which reports its counters.
+type StatsReporter interface {
+	Stats() Stats
+}
+
+var (
+	_ StatsReporter = (*Db)(nil)
+	_ StatsReporter = (*MemStore)(nil)
+)
+
+type dbStats struct {
+	rawValueBytes    atomic.Int64
+	storedValueBytes atomic.Int64
+}
+
+func (db *Db) Stats() Stats {
+	s := Stats{
+		RawValueBytes:    db.stats.rawValueBytes.Load(),
+		StoredValueBytes: db.stats.storedValueBytes.Load(),
+		CompressionRatio: 1,
+	}
+	if db.cache != nil {
+		s.CacheHits, s.CacheMisses, s.CacheBytes = db.cache.counters()
+	}
+	if s.StoredValueBytes > 0 {
+		s.CompressionRatio = float64(s.RawValueBytes) / float64(s.StoredValueBytes)
+	}
+	return s
+}
@@ -0,0 +1,34 @@
+package datastore
+
+// Store is a key/value storage engine.
+type Store interface {
+	// Get returns the value of the key or ErrNotFound.
+	Get(key string) (string, error)
+	// Put stores the value or returns ErrKeyTooLarge or ErrValueTooLarge if
+	// the record exceeds MaxKeySize or MaxValueSize.
+	Put(key, value string) error
+	// Delete removes the key or returns ErrNotFound if it does not exist.
+	Delete(key string) error
+	// Update atomically replaces the value of the key with the result of fn,
+	// which gets the current value and whether the key exists. No other
+	// write happens while fn runs, so it must not use the store. An error
+	// returned by fn is returned as is and nothing is written.
+	Update(key string, fn func(value string, ok bool) (string, error)) error
+	// WriteBatch applies the operations in order and atomically: readers
+	// see either none or all of them, and a batch which fails or is cut
+	// short by a crash is not applied at all. Deleting a missing key is not
+	// an error.
+	WriteBatch(ops []BatchOp) error
+	// Incr atomically adds delta to the decimal integer stored at the key,
+	// a missing key counts as zero. It returns the new value, ErrNotInteger
+	// or ErrOverflow.
+	Incr(key string, delta int64) (int64, error)
+	// GetInt64 returns the value of the key parsed as a decimal integer.
+	GetInt64(key string) (int64, error)
+	// Scan calls fn in key order for every key with the given prefix and
+	// stops at the first error returned by fn.
+	Scan(prefix string, fn func(key, value string) error) error
+	Close() error
+}
+
+var _ Store = (*Db)(nil)
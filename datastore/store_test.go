@@ -0,0 +1,258 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testStore checks the behaviour every Store implementation must share.
+func testStore(t *testing.T, store Store) {
+	t.Run("put/get", func(t *testing.T) {
+		for i := 0; i < 50; i++ {
+			if err := store.Put(fmt.Sprintf("key%02d", i), fmt.Sprintf("value%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 50; i++ {
+			value, err := store.Get(fmt.Sprintf("key%02d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != fmt.Sprintf("value%d", i) {
+				t.Errorf("Bad value returned expected value%d, got %s", i, value)
+			}
+		}
+		if _, err := store.Get("missing"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := store.Delete("key07"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Get("key07"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound after delete, got %v", err)
+		}
+		if err := store.Delete("key07"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound deleting twice, got %v", err)
+		}
+		if err := store.Put("key07", "again"); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := store.Get("key07"); err != nil || value != "again" {
+			t.Errorf("Unexpected value after re-put %s %v", value, err)
+		}
+	})
+
+	t.Run("size limits", func(t *testing.T) {
+		if err := store.Put(strings.Repeat("k", MaxKeySize+1), "value"); !errors.Is(err, ErrKeyTooLarge) {
+			t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+		}
+		if err := store.Put("big", strings.Repeat("v", MaxValueSize+1)); !errors.Is(err, ErrValueTooLarge) {
+			t.Errorf("Expected ErrValueTooLarge, got %v", err)
+		}
+		if _, err := store.Get("big"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a rejected value, got %v", err)
+		}
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		if err := store.Delete("key12"); err != nil {
+			t.Fatal(err)
+		}
+		var keys, values []string
+		err := store.Scan("key1", func(key, value string) error {
+			keys = append(keys, key)
+			values = append(values, value)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"key10", "key11", "key13", "key14", "key15", "key16", "key17", "key18", "key19"}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Unexpected keys %v", keys)
+		}
+		if values[0] != "value10" {
+			t.Errorf("Unexpected first value %s", values[0])
+		}
+
+		stop := fmt.Errorf("stop")
+		count := 0
+		err = store.Scan("", func(key, value string) error {
+			count++
+			return stop
+		})
+		if err != stop || count != 1 {
+			t.Errorf("Expected scan to stop at the first error, got %v after %d keys", err, count)
+		}
+
+		if ks, ok := store.(KeyScanner); ok {
+			keys = nil
+			err := ks.ScanKeys("key1", "key11", func(key string) error {
+				keys = append(keys, key)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(keys, expected[2:]) {
+				t.Errorf("Unexpected keys after key11 %v", keys)
+			}
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		stop := fmt.Errorf("stop")
+		err := store.Update("key20", func(value string, ok bool) (string, error) {
+			if !ok || value != "value20" {
+				t.Errorf("Unexpected current value %s %v", value, ok)
+			}
+			return "", stop
+		})
+		if err != stop {
+			t.Errorf("Expected the error of fn, got %v", err)
+		}
+		if value, err := store.Get("key20"); err != nil || value != "value20" {
+			t.Errorf("Expected the value unchanged after a failed update, got %s %v", value, err)
+		}
+		err = store.Update("key07", func(value string, ok bool) (string, error) {
+			return value + "+", nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, err := store.Get("key07"); err != nil || value != "again+" {
+			t.Errorf("Unexpected updated value %s %v", value, err)
+		}
+		err = store.Update("key12", func(value string, ok bool) (string, error) {
+			if ok {
+				t.Errorf("Expected a deleted key to be missing, got %s", value)
+			}
+			return "revived", nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		err := store.WriteBatch([]BatchOp{
+			{Key: "batch1", Value: "a"},
+			{Key: "batch2", Value: "b"},
+			{Key: "batch1", Delete: true},
+			{Key: "batch-missing", Delete: true},
+			{Key: "key20", Value: "batched"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range map[string]string{"batch2": "b", "key20": "batched"} {
+			if value, err := store.Get(key); err != nil || value != want {
+				t.Errorf("Expected %s for %s, got %s %v", want, key, value, err)
+			}
+		}
+		if _, err := store.Get("batch1"); err != ErrNotFound {
+			t.Errorf("Expected the deleted key to be missing, got %v", err)
+		}
+
+		err = store.WriteBatch([]BatchOp{
+			{Key: "batch2", Value: "c"},
+			{Key: "batch3", Value: strings.Repeat("x", MaxValueSize+1)},
+		})
+		if !errors.Is(err, ErrValueTooLarge) {
+			t.Errorf("Expected ErrValueTooLarge, got %v", err)
+		}
+		if value, err := store.Get("batch2"); err != nil || value != "b" {
+			t.Errorf("Expected a rejected batch to write nothing, got %s %v", value, err)
+		}
+	})
+
+	t.Run("incr", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					if _, err := store.Incr("counter", 2); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if n, err := store.GetInt64("counter"); err != nil || n != 400 {
+			t.Errorf("Expected counter 400, got %d %v", n, err)
+		}
+		if n, err := store.Incr("counter", -401); err != nil || n != -1 {
+			t.Errorf("Expected counter -1, got %d %v", n, err)
+		}
+
+		if _, err := store.Incr("key20", 1); !errors.Is(err, ErrNotInteger) {
+			t.Errorf("Expected ErrNotInteger, got %v", err)
+		}
+		if _, err := store.GetInt64("key20"); !errors.Is(err, ErrNotInteger) {
+			t.Errorf("Expected ErrNotInteger, got %v", err)
+		}
+		if _, err := store.GetInt64("missing"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+		if _, err := store.Incr("big", math.MaxInt64); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Incr("big", 1); !errors.Is(err, ErrOverflow) {
+			t.Errorf("Expected ErrOverflow, got %v", err)
+		}
+	})
+}
+
+func TestDb_Store(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 300, WithCompactionDelay(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testStore(t, db)
+}
+
+func TestLSM_Store(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := NewLSM(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	testStore(t, l)
+}
+
+func TestMemStore_Store(t *testing.T) {
+	m := NewMemStore()
+	defer m.Close()
+	testStore(t, m)
+
+	stats := m.Stats()
+	if stats.RawValueBytes == 0 || stats.CompressionRatio != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,186 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	tableIndexSuffix     = ".index"
+	tableIndexRecordSize = 12
+)
+
+// segmentIndex maps keys of a segment to the offsets of their records.
+type segmentIndex interface {
+	get(key string) (int64, bool, error)
+	keys() ([]string, error)
+}
+
+type fence struct {
+	key    string
+	offset int64
+}
+
+// tableIndex is a segmentIndex of a sealed segment kept on disk as a table of
+// key/offset pairs sorted by key. Only every fenceInterval-th key is held in
+// memory, a lookup reads the single block between two fences.
+type tableIndex struct {
+	fs     FS
+	path   string
+	size   int64
+	fences []fence
+}
+
+func encodeTableRecord(w io.Writer, key string, offset int64) (int, error) {
+	res := make([]byte, len(key)+tableIndexRecordSize)
+	binary.LittleEndian.PutUint32(res, uint32(len(key)))
+	copy(res[4:], key)
+	binary.LittleEndian.PutUint64(res[4+len(key):], uint64(offset))
+	return w.Write(res)
+}
+
+func decodeTableRecord(in *bufio.Reader) (string, int64, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return "", 0, err
+	}
+	kl := binary.LittleEndian.Uint32(header)
+	if kl > MaxKeySize {
+		return "", 0, fmt.Errorf("%w: key length %d in table index", ErrCorruptedRecord, kl)
+	}
+	data := make([]byte, kl+8)
+	if _, err := io.ReadFull(in, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", 0, err
+	}
+	return string(data[:kl]), int64(binary.LittleEndian.Uint64(data[kl:])), nil
+}
+
+// writeTableIndex stores the index as a sorted table next to the segment.
+func writeTableIndex(fs FS, segmentPath string, idx segmentIndex, fenceInterval int) (*tableIndex, error) {
+	keys, err := idx.keys()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	t := &tableIndex{
+		fs:   fs,
+		path: segmentPath + tableIndexSuffix,
+	}
+	err = createFileAtomic(fs, t.path, func(f io.Writer) error {
+		w := bufio.NewWriterSize(f, bufSize)
+		for i, key := range keys {
+			offset, ok, err := idx.get(key)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("key %s disappeared from the index", key)
+			}
+			if i%fenceInterval == 0 {
+				t.fences = append(t.fences, fence{key, t.size})
+			}
+			n, err := encodeTableRecord(w, key, offset)
+			if err != nil {
+				return err
+			}
+			t.size += int64(n)
+		}
+		return w.Flush()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// openTableIndex loads the fences of a table written by writeTableIndex.
+func openTableIndex(fs FS, segmentPath string, fenceInterval int) (*tableIndex, error) {
+	t := &tableIndex{
+		fs:   fs,
+		path: segmentPath + tableIndexSuffix,
+	}
+	i := 0
+	size, err := scanTable(fs, t.path, func(key string, _, pos int64) {
+		if i%fenceInterval == 0 {
+			t.fences = append(t.fences, fence{key, pos})
+		}
+		i++
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.size = size
+	return t, nil
+}
+
+// scanTable calls fn for every record of the table with its position in the
+// file and returns the size of the table.
+func scanTable(fs FS, path string, fn func(key string, offset, pos int64)) (int64, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var pos int64
+	reader := bufio.NewReaderSize(file, bufSize)
+	for {
+		key, offset, err := decodeTableRecord(reader)
+		if err == io.EOF {
+			return pos, nil
+		} else if err != nil {
+			return pos, err
+		}
+		fn(key, offset, pos)
+		pos += int64(len(key) + tableIndexRecordSize)
+	}
+}
+
+func (t *tableIndex) get(key string) (int64, bool, error) {
+	i := sort.Search(len(t.fences), func(i int) bool {
+		return t.fences[i].key > key
+	}) - 1
+	if i < 0 {
+		return 0, false, nil
+	}
+	end := t.size
+	if i+1 < len(t.fences) {
+		end = t.fences[i+1].offset
+	}
+
+	file, err := t.fs.Open(t.path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(io.NewSectionReader(file, t.fences[i].offset, end-t.fences[i].offset))
+	for {
+		k, offset, err := decodeTableRecord(reader)
+		if err == io.EOF {
+			return 0, false, nil
+		} else if err != nil {
+			return 0, false, err
+		}
+		if k == key {
+			return offset, true, nil
+		} else if k > key {
+			return 0, false, nil
+		}
+	}
+}
+
+func (t *tableIndex) keys() ([]string, error) {
+	var keys []string
+	_, err := scanTable(t.fs, t.path, func(key string, _, _ int64) {
+		keys = append(keys, key)
+	})
+	return keys, err
+}
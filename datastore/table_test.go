@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTableIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx := newShardedIndex()
+	for i := 0; i < 100; i++ {
+		idx.set(fmt.Sprintf("key%03d", i), int64(i*10))
+	}
+
+	table, err := writeTableIndex(OSFS{}, filepath.Join(dir, "segment"), idx, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table.fences) != 13 {
+		t.Errorf("Expected 13 fences, got %d", len(table.fences))
+	}
+	for i := 0; i < 100; i++ {
+		position, ok, err := table.get(fmt.Sprintf("key%03d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || position != int64(i*10) {
+			t.Errorf("Unexpected position of key%03d: %d %t", i, position, ok)
+		}
+	}
+	for _, key := range []string{"a", "key0500", "key05", "zzz"} {
+		if _, ok, err := table.get(key); ok || err != nil {
+			t.Errorf("Unexpected lookup result for %s: %t %v", key, ok, err)
+		}
+	}
+	keys, err := table.keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 100 || keys[0] != "key000" || keys[99] != "key099" {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+}
+
+func TestDb_TableIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 200, WithTableIndex(4), WithCompactionDelay(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 40; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%20), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 20; i < 40; i++ {
+		value, err := db.Get(fmt.Sprintf("key%d", i%20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Bad value returned expected value%d, got %s", i, value)
+		}
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, segment := range db.segments[:len(db.segments)-1] {
+		if _, ok := segment.index.(*tableIndex); !ok {
+			t.Errorf("Expected sealed segment %s to use a table index", segment.filePath)
+		}
+	}
+	if _, ok := db.segments[len(db.segments)-1].index.(*shardedIndex); !ok {
+		t.Error("Expected the active segment to use a hash index")
+	}
+}
@@ -0,0 +1,276 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	valueLogFileName = "value-log"
+	valuePointerSize = 16
+)
+
+// valuePointer locates a record inside one of the value log files.
+type valuePointer struct {
+	file   int
+	offset int64
+	size   int64
+}
+
+func (p valuePointer) encode() string {
+	res := make([]byte, valuePointerSize)
+	binary.LittleEndian.PutUint32(res, uint32(p.file))
+	binary.LittleEndian.PutUint64(res[4:], uint64(p.offset))
+	binary.LittleEndian.PutUint32(res[12:], uint32(p.size))
+	return string(res)
+}
+
+func decodeValuePointer(s string) (valuePointer, error) {
+	if len(s) != valuePointerSize {
+		return valuePointer{}, fmt.Errorf("bad value pointer length %d", len(s))
+	}
+	data := []byte(s)
+	return valuePointer{
+		file:   int(binary.LittleEndian.Uint32(data)),
+		offset: int64(binary.LittleEndian.Uint64(data[4:])),
+		size:   int64(binary.LittleEndian.Uint32(data[12:])),
+	}, nil
+}
+
+// valueLog is an append-only set of files holding the values when key/value
+// separation is enabled. Only the last file is written to, the sealed ones
+// are reclaimed by Db.CollectValueLog.
+type valueLog struct {
+	fs        FS
+	dir       string
+	fileSize  int64
+	out       File
+	outID     int
+	outOffset int64
+	sealed    []int
+	// sync makes rotate flush the file it seals.
+	sync bool
+}
+
+func openValueLog(fs FS, dir string, fileSize int64) (*valueLog, error) {
+	vl := &valueLog{
+		fs:       fs,
+		dir:      dir,
+		fileSize: fileSize,
+	}
+	ids, err := valueLogFiles(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		vl.sealed = ids[:len(ids)-1]
+		vl.outID = ids[len(ids)-1]
+	}
+	if err := vl.open(vl.outID); err != nil {
+		return nil, err
+	}
+	if err := vl.truncateTail(); err != nil {
+		vl.out.Close()
+		return nil, err
+	}
+	return vl, nil
+}
+
+func valueLogFiles(fs FS, dir string) ([]int, error) {
+	names, err := listFiles(fs, dir, valueLogFileName)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, name := range names {
+		id, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(name), valueLogFileName))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (vl *valueLog) filePath(id int) string {
+	return filepath.Join(vl.dir, fmt.Sprintf("%s%d", valueLogFileName, id))
+}
+
+func (vl *valueLog) open(id int) error {
+	f, err := vl.fs.OpenFile(vl.filePath(id), os.O_APPEND|os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	vl.out = f
+	vl.outID = id
+	vl.outOffset = stat.Size()
+	return nil
+}
+
+func (vl *valueLog) rotate() error {
+	if vl.sync {
+		if err := vl.out.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := vl.out.Close(); err != nil {
+		return err
+	}
+	vl.sealed = append(vl.sealed, vl.outID)
+	return vl.open(vl.outID + 1)
+}
+
+func (vl *valueLog) append(e entry) (valuePointer, error) {
+	if vl.outOffset > 0 && vl.outOffset+e.length() > vl.fileSize {
+		if err := vl.rotate(); err != nil {
+			return valuePointer{}, err
+		}
+	}
+	n, err := vl.out.Write(e.Encode())
+	if err != nil {
+		vl.out.Truncate(vl.outOffset)
+		return valuePointer{}, err
+	}
+	p := valuePointer{
+		file:   vl.outID,
+		offset: vl.outOffset,
+		size:   int64(n),
+	}
+	vl.outOffset += int64(n)
+	return p, nil
+}
+
+// truncateTail drops a partially written record left at the end of the
+// active file by a crash.
+func (vl *valueLog) truncateTail() error {
+	var end int64
+	err := vl.scan(vl.outID, func(e entry, offset int64) error {
+		end = offset + e.length()
+		return nil
+	})
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil || end == vl.outOffset {
+		return err
+	}
+	vl.outOffset = end
+	return vl.out.Truncate(end)
+}
+
+func (vl *valueLog) read(p valuePointer) (entry, error) {
+	file, err := vl.fs.Open(vl.filePath(p.file))
+	if err != nil {
+		return entry{}, err
+	}
+	defer file.Close()
+
+	if p.size < entryHeaderSize || p.size > maxEntrySize {
+		return entry{}, fmt.Errorf("%w: bad value pointer size %d", ErrCorruptedRecord, p.size)
+	}
+	data := make([]byte, p.size)
+	if _, err := file.ReadAt(data, p.offset); err != nil {
+		return entry{}, err
+	}
+	var e entry
+	if err := e.Decode(data); err != nil {
+		return entry{}, err
+	}
+	return e, nil
+}
+
+// scan calls fn for every record of the given file with its offset.
+func (vl *valueLog) scan(id int, fn func(e entry, offset int64) error) error {
+	file, err := vl.fs.Open(vl.filePath(id))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var offset int64
+	reader := bufio.NewReaderSize(file, bufSize)
+	for {
+		e, err := readEntry(reader)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(e, offset); err != nil {
+			return err
+		}
+		offset += e.length()
+	}
+}
+
+// drop forgets the sealed file, the caller removes it.
+func (vl *valueLog) drop(id int) {
+	for i, sid := range vl.sealed {
+		if sid == id {
+			vl.sealed = append(vl.sealed[:i], vl.sealed[i+1:]...)
+			break
+		}
+	}
+}
+
+func (vl *valueLog) close() error {
+	return vl.out.Close()
+}
+
+// collectValueLog rewrites the live values of the oldest sealed value log file
+// and removes it. It must run on the put routine.
+func (db *Db) collectValueLog() error {
+	if db.vlog == nil || len(db.vlog.sealed) == 0 {
+		return nil
+	}
+	id := db.vlog.sealed[0]
+	err := db.vlog.scan(id, func(e entry, offset int64) error {
+		current, pos, err := db.lookupRecord(e.key)
+		if err == ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if current.flags&flagValuePointer == 0 {
+			return nil
+		}
+		p, err := decodeValuePointer(current.value)
+		if err != nil {
+			return err
+		}
+		if p.file != id || p.offset != offset {
+			return nil
+		}
+		e, err = db.rekey(e)
+		if err != nil {
+			return err
+		}
+		e.seq = recordVersion(current, pos)
+		return db.appendEntries(e)
+	})
+	if err != nil {
+		return err
+	}
+	db.vlog.drop(id)
+	return db.removeFiles(db.vlog.filePath(id))
+}
+
+// CollectValueLog reclaims the space of the oldest sealed value log file.
+// It is a no-op when key/value separation is disabled.
+func (db *Db) CollectValueLog() error {
+	db.putOps <- db.collectValueLog
+	return <-db.putDone
+}
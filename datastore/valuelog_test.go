@@ -0,0 +1,100 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValuePointer_Encode(t *testing.T) {
+	p := valuePointer{file: 3, offset: 1 << 40, size: 512}
+	decoded, err := decodeValuePointer(p.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != p {
+		t.Errorf("Bad pointer decoded expected %v, got %v", p, decoded)
+	}
+	if _, err := decodeValuePointer("short"); err == nil {
+		t.Error("Expected error for a bad pointer")
+	}
+}
+
+func TestDb_ValueLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 500, WithValueLog(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	large := strings.Repeat("v", 300)
+
+	t.Run("put/get", func(t *testing.T) {
+		for _, key := range []string{"key1", "key2"} {
+			if err := db.Put(key, key+large); err != nil {
+				t.Fatalf("Cannot put %s: %s", key, err)
+			}
+			value, err := db.Get(key)
+			if err != nil {
+				t.Fatalf("Cannot get %s: %s", key, err)
+			}
+			if value != key+large {
+				t.Errorf("Bad value returned for %s", key)
+			}
+		}
+		if _, err := db.Get("missing"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("segment keeps pointers", func(t *testing.T) {
+		info, err := os.Stat(filepath.Join(dir, outFileName+"0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedSize := int64(2 * (4 + valuePointerSize + 12))
+		if info.Size() != expectedSize {
+			t.Errorf("Unexpected segment size (%d vs %d)", expectedSize, info.Size())
+		}
+	})
+
+	t.Run("garbage collection", func(t *testing.T) {
+		for i := 0; i < 6; i++ {
+			if err := db.Put("key1", large); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(db.vlog.sealed) >= valueLogMaxSealed {
+			t.Errorf("Expected sealed value logs to be collected, got %d", len(db.vlog.sealed))
+		}
+		if _, err := os.Stat(db.vlog.filePath(0)); !os.IsNotExist(err) {
+			t.Errorf("Expected the oldest value log to be removed")
+		}
+		if err := db.CollectValueLog(); err != nil {
+			t.Fatal(err)
+		}
+
+		value, err := db.Get("key2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "key2"+large {
+			t.Errorf("Bad value returned for key2 after collection")
+		}
+		value, err = db.Get("key1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != large {
+			t.Errorf("Bad value returned for key1 after collection")
+		}
+	})
+}
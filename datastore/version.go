@@ -0,0 +1,78 @@
+package datastore
+
+import "errors"
+
+var ErrVersionMismatch = errors.New("record version does not match")
+
+// Versioner is a Store which reports the version of every record, so a
+// writer can detect that the record was changed after it was read.
+type Versioner interface {
+	GetVersion(key string) (string, uint64, error)
+	CompareAndSwap(key, value string, version uint64) error
+	CompareAndWriteBatch(key string, version uint64, ops []BatchOp) error
+}
+
+var _ Versioner = (*Db)(nil)
+
+// positionSeq is the sequence number of a write appended at the offset of
+// the segment file. Segment ids only grow and every write appends a record,
+// so the numbers grow with the writes and are never reused. Zero is left
+// for no sequence number.
+func positionSeq(filePath string, offset int64) uint64 {
+	f, _ := parseSegmentName(filePath)
+	seq := uint64(f.id)<<41 | uint64(offset)
+	if f.merged {
+		seq |= 1 << 40
+	}
+	return seq + 1
+}
+
+// recordVersion is the version of the record at the position: the sequence
+// number of the write. A record is written with the number of its position
+// and stores it once compaction or value log collection moves it, so the
+// version stays the same until the key is written again.
+func recordVersion(e entry, pos *KeyPosition) uint64 {
+	if e.seq != 0 {
+		return e.seq
+	}
+	return positionSeq(pos.segment.filePath, pos.position)
+}
+
+// GetVersion returns the value of the key with its version.
+func (db *Db) GetVersion(key string) (string, uint64, error) {
+	e, pos, err := db.lookupRecord(key)
+	if err != nil {
+		return "", 0, err
+	}
+	value, err := db.resolve(e)
+	if err != nil {
+		return "", 0, err
+	}
+	return value, recordVersion(e, pos), nil
+}
+
+// CompareAndSwap stores the value only if the version of the key is still
+// the given one. It returns ErrNotFound if the key does not exist and
+// ErrVersionMismatch if it was changed.
+func (db *Db) CompareAndSwap(key, value string, version uint64) error {
+	return db.CompareAndWriteBatch(key, version, []BatchOp{{Key: key, Value: value}})
+}
+
+// CompareAndWriteBatch writes the batch like WriteBatch only if the version
+// of the key is still the given one, with the errors of CompareAndSwap.
+func (db *Db) CompareAndWriteBatch(key string, version uint64, ops []BatchOp) error {
+	if err := checkBatch(ops); err != nil {
+		return err
+	}
+	db.putOps <- func() error {
+		e, pos, err := db.lookupRecord(key)
+		if err != nil {
+			return err
+		}
+		if recordVersion(e, pos) != version {
+			return ErrVersionMismatch
+		}
+		return db.writeBatch(ops)
+	}
+	return <-db.putDone
+}
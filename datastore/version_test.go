@@ -0,0 +1,198 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDb_CompareAndSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 150, WithCompactionDelay(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := db.GetVersion("key"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if err := db.CompareAndSwap("key", "v", 0); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	if err := db.Put("key", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	value, v1, err := db.GetVersion("key")
+	if err != nil || value != "v1" {
+		t.Fatalf("Unexpected value %q, %v", value, err)
+	}
+	if err := db.CompareAndSwap("key", "v2", v1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CompareAndSwap("key", "v3", v1); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch, got %v", err)
+	}
+	value, v2, err := db.GetVersion("key")
+	if err != nil || value != "v2" || v2 == v1 {
+		t.Errorf("Unexpected value %q, version %d, %v", value, v2, err)
+	}
+	if err := db.Put("key", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CompareAndSwap("key", "v3", v2); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch after a write of the same value, got %v", err)
+	}
+
+	// Only one of the concurrent swaps from the same version wins.
+	_, version, err := db.GetVersion("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- db.CompareAndSwap("key", "swapped", version)
+		}()
+	}
+	wg.Wait()
+	close(results)
+	won := 0
+	for err := range results {
+		if err == nil {
+			won++
+		} else if err != ErrVersionMismatch {
+			t.Error(err)
+		}
+	}
+	if won != 1 {
+		t.Errorf("Expected exactly one swap to succeed, got %d", won)
+	}
+
+	// Versions survive a reopen.
+	_, version, err = db.GetVersion("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 150, WithCompactionDelay(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	value, reopened, err := db.GetVersion("key")
+	if err != nil || value != "swapped" {
+		t.Fatalf("Unexpected value %q, %v", value, err)
+	}
+	if reopened != version {
+		t.Errorf("Expected the version %d to stay, got %d", version, reopened)
+	}
+	if err := db.CompareAndSwap("key", "v", version); err != nil {
+		t.Error(err)
+	}
+	if err := db.CompareAndSwap("key", "v", version); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch, got %v", err)
+	}
+}
+
+func TestDb_VersionKeptWhenMoved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 500, WithValueLog(1000), WithCompactionThreshold(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	large := strings.Repeat("v", 300)
+	if err := db.Put("key", large); err != nil {
+		t.Fatal(err)
+	}
+	_, version, err := db.GetVersion("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion := func(moved string) {
+		t.Helper()
+		if value, v, err := db.GetVersion("key"); err != nil || value != large || v != version {
+			t.Fatalf("Expected the version %d to stay after %s, got %d %v", version, moved, v, err)
+		}
+	}
+
+	// The other writes move the record to a sealed segment and the value to
+	// a sealed value log file.
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("other%d", i), large); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion("compaction")
+	if err := db.CollectValueLog(); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion("value log collection")
+
+	if err := db.CompareAndSwap("key", "new", version); err != nil {
+		t.Errorf("Expected the swap to succeed, got %v", err)
+	}
+	if err := db.CompareAndSwap("key", "newer", version); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch, got %v", err)
+	}
+}
+
+func TestDb_CompareAndWriteBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	_, version, err := db.GetVersion("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := []BatchOp{{Key: "key", Value: "v2"}, {Key: "other", Value: "o"}}
+	if err := db.CompareAndWriteBatch("key", version+1, ops); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch, got %v", err)
+	}
+	if _, err := db.Get("other"); err != ErrNotFound {
+		t.Errorf("Expected no write of a failed swap, got %v", err)
+	}
+	if err := db.CompareAndWriteBatch("key", version, ops); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"key": "v2", "other": "o"} {
+		if value, err := db.Get(key); err != nil || value != want {
+			t.Errorf("Unexpected value of %s %q %v", key, value, err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package datastore
+
+import (
+	"strings"
+	"sync"
+)
+
+// Change is a write seen by a watcher. Seq grows with every write of the Db.
+type Change struct {
+	Seq     uint64
+	Key     string
+	Value   string
+	Deleted bool
+}
+
+// Watcher is a Store which streams its writes.
+type Watcher interface {
+	// Watch returns the changes of the keys with the prefix made after the
+	// call. The channel is closed by stop or when the reader falls more than
+	// buffer changes behind, so writes never wait for watchers.
+	Watch(prefix string, buffer int) (changes <-chan Change, stop func())
+}
+
+var _ Watcher = (*Db)(nil)
+
+type watcher struct {
+	prefix  string
+	changes chan Change
+}
+
+type watchers struct {
+	mu   sync.Mutex
+	subs map[*watcher]struct{}
+}
+
+func (ws *watchers) add(w *watcher) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.subs == nil {
+		ws.subs = make(map[*watcher]struct{})
+	}
+	ws.subs[w] = struct{}{}
+}
+
+// remove closes the channel of the watcher unless it is already closed.
+func (ws *watchers) remove(w *watcher) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if _, ok := ws.subs[w]; ok {
+		delete(ws.subs, w)
+		close(w.changes)
+	}
+}
+
+func (ws *watchers) publish(c Change) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for w := range ws.subs {
+		if !strings.HasPrefix(c.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.changes <- c:
+		default:
+			delete(ws.subs, w)
+			close(w.changes)
+		}
+	}
+}
+
+func (db *Db) Watch(prefix string, buffer int) (<-chan Change, func()) {
+	if buffer < 1 {
+		buffer = 1
+	}
+	w := &watcher{
+		prefix:  prefix,
+		changes: make(chan Change, buffer),
+	}
+	db.watchers.add(w)
+	return w.changes, func() { db.watchers.remove(w) }
+}
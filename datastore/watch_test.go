@@ -0,0 +1,93 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDb_Watch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 150, WithCompactionDelay(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("user:0", "before"); err != nil {
+		t.Fatal(err)
+	}
+	changes, stop := db.Watch("user:", 10)
+	defer stop()
+
+	if err := db.Put("user:1", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("other", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("user:1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Incr("user:2", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Change{
+		{Key: "user:1", Value: "a"},
+		{Key: "user:1", Deleted: true},
+		{Key: "user:2", Value: "5"},
+	}
+	var last uint64
+	for _, want := range expected {
+		c := <-changes
+		if c.Key != want.Key || c.Value != want.Value || c.Deleted != want.Deleted {
+			t.Errorf("Expected %+v, got %+v", want, c)
+		}
+		if c.Seq <= last {
+			t.Errorf("Sequence %d after %d", c.Seq, last)
+		}
+		last = c.Seq
+	}
+
+	stop()
+	if _, ok := <-changes; ok {
+		t.Error("Expected the channel to be closed by stop")
+	}
+	stop()
+}
+
+func TestDb_WatchOverflow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1000, WithCompactionDelay(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	changes, stop := db.Watch("", 2)
+	defer stop()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int
+	for range changes {
+		count++
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 buffered changes before the close, got %d", count)
+	}
+}
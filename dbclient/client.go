@@ -0,0 +1,506 @@
+// Package dbclient is a client of the HTTP API of cmd/db.
+package dbclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VersionHeader carries the version of the value of a conditional write.
+const VersionHeader = "X-Version"
+
+const (
+	defaultTimeout = 10 * time.Second
+	defaultRetries = 2
+	defaultBackoff = 100 * time.Millisecond
+	maxErrorBody   = 64 << 10
+	scanPageSize   = 100
+)
+
+// Client calls the db server. It is safe for concurrent use.
+type Client struct {
+	baseURL string
+	http    *http.Client
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+}
+
+type Option func(c *Client) error
+
+// WithTimeout limits every attempt of a request, 0 disables the limit. Watch
+// streams are limited only by their context.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) error {
+		if d < 0 {
+			return fmt.Errorf("negative timeout %s", d)
+		}
+		c.timeout = d
+		return nil
+	}
+}
+
+// WithRetries retries a request which failed to reach the server or got a
+// server error up to n times, waiting backoff before the first retry and
+// twice as long before every next one. Writes are retried too, so a retried
+// Delete may report ErrNotFound for a key it has deleted.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) error {
+		if n < 0 || backoff < 0 {
+			return fmt.Errorf("bad retries %d with backoff %s", n, backoff)
+		}
+		c.retries = n
+		c.backoff = backoff
+		return nil
+	}
+}
+
+// WithHTTPClient sends the requests with the client instead of
+// http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) error {
+		c.http = hc
+		return nil
+	}
+}
+
+// New returns a client of the server at the base URL, such as
+// http://db:8083.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("bad base URL %q", baseURL)
+	}
+	c := &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		http:    http.DefaultClient,
+		timeout: defaultTimeout,
+		retries: defaultRetries,
+		backoff: defaultBackoff,
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func keyPath(key string) string {
+	return "/db/" + url.PathEscape(key)
+}
+
+// Record is a key with its value.
+type Record struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Get returns the value of the key or ErrNotFound.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var res Record
+	if err := c.do(ctx, http.MethodGet, keyPath(key), nil, &res); err != nil {
+		return "", err
+	}
+	return res.Value, nil
+}
+
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	return c.do(ctx, http.MethodPost, keyPath(key), struct {
+		Value string `json:"value"`
+	}{value}, nil)
+}
+
+// Meta is the metadata stored with a value, such as memcached flags and the
+// expiration time in Unix milliseconds.
+type Meta struct {
+	Flags   uint32 `json:"flags,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+// GetWithMeta returns the value of the key with its metadata or ErrNotFound.
+func (c *Client) GetWithMeta(ctx context.Context, key string) (string, Meta, error) {
+	var res struct {
+		Value string `json:"value"`
+		Meta  Meta   `json:"meta"`
+	}
+	if err := c.do(ctx, http.MethodGet, keyPath(key)+"?meta", nil, &res); err != nil {
+		return "", Meta{}, err
+	}
+	return res.Value, res.Meta, nil
+}
+
+// PutWithMeta stores the value with the metadata in one write.
+func (c *Client) PutWithMeta(ctx context.Context, key, value string, meta Meta) error {
+	return c.do(ctx, http.MethodPost, keyPath(key), struct {
+		Value string `json:"value"`
+		Meta  Meta   `json:"meta"`
+	}{value, meta}, nil)
+}
+
+// PutVersion stores the value unless the value stored at the key has the
+// same or a newer version, then it returns ErrStaleVersion. The stored value
+// must be a replica envelope, see cluster.Versioned.
+func (c *Client) PutVersion(ctx context.Context, key, value string, version uint64) error {
+	header := http.Header{VersionHeader: {strconv.FormatUint(version, 10)}}
+	return c.doWithHeader(ctx, http.MethodPost, keyPath(key), header, struct {
+		Value string `json:"value"`
+	}{value}, nil)
+}
+
+// Delete removes the key or returns ErrNotFound if it does not exist.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodDelete, keyPath(key), nil, nil)
+}
+
+// DeleteVersion removes the key only if the stored replica envelope has the
+// version, otherwise it returns ErrStaleVersion.
+func (c *Client) DeleteVersion(ctx context.Context, key string, version uint64) error {
+	header := http.Header{VersionHeader: {strconv.FormatUint(version, 10)}}
+	return c.doWithHeader(ctx, http.MethodDelete, keyPath(key), header, nil, nil)
+}
+
+// MGet returns the values of the keys which exist.
+func (c *Client) MGet(ctx context.Context, keys ...string) (map[string]string, error) {
+	var res struct {
+		Values map[string]struct {
+			Found bool   `json:"found"`
+			Value string `json:"value"`
+		} `json:"values"`
+	}
+	req := struct {
+		Keys []string `json:"keys"`
+	}{keys}
+	if err := c.do(ctx, http.MethodPost, "/db/_mget", req, &res); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(res.Values))
+	for key, v := range res.Values {
+		if v.Found {
+			values[key] = v.Value
+		}
+	}
+	return values, nil
+}
+
+// Op is a put or, if Delete is set, a delete of a batch.
+type Op struct {
+	Key    string
+	Value  string
+	Delete bool
+}
+
+// Batch applies the operations atomically: all of them or, if any fails,
+// none. Deleting a missing key is not an error.
+func (c *Client) Batch(ctx context.Context, ops []Op) error {
+	type operation struct {
+		Op    string `json:"op"`
+		Key   string `json:"key"`
+		Value string `json:"value,omitempty"`
+	}
+	req := struct {
+		Ops []operation `json:"ops"`
+	}{make([]operation, len(ops))}
+	for i, op := range ops {
+		req.Ops[i] = operation{Op: "put", Key: op.Key, Value: op.Value}
+		if op.Delete {
+			req.Ops[i] = operation{Op: "delete", Key: op.Key}
+		}
+	}
+	return c.do(ctx, http.MethodPost, "/db/_batch", req, nil)
+}
+
+// Scan calls fn in key order for every key with the prefix and stops at the
+// first error returned by fn. The keys are fetched page by page, so keys
+// written while scanning may or may not be visited.
+func (c *Client) Scan(ctx context.Context, prefix string, fn func(key, value string) error) error {
+	after := ""
+	for {
+		records, next, err := c.ScanPage(ctx, prefix, after, scanPageSize)
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			if err := fn(r.Key, r.Value); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		after = next
+	}
+}
+
+// ScanPage returns up to limit records of the keys with the prefix which
+// follow the key after, in key order. Next is the after of the following
+// page, it is empty on the last page.
+func (c *Client) ScanPage(ctx context.Context, prefix, after string, limit int) (records []Record, next string, err error) {
+	query := url.Values{
+		"prefix": {prefix},
+		"limit":  {strconv.Itoa(limit)},
+	}
+	if after != "" {
+		query.Set("after", after)
+	}
+	var page struct {
+		Records []Record `json:"records"`
+		Next    string   `json:"next"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/db?"+query.Encode(), nil, &page); err != nil {
+		return nil, "", err
+	}
+	return page.Records, page.Next, nil
+}
+
+// Event is a write seen by Watch. Seq grows with every write of the server.
+type Event struct {
+	Seq     uint64 `json:"seq"`
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Deleted bool   `json:"deleted"`
+}
+
+// Watch calls fn for every write of the keys with the prefix made after the
+// stream is opened. It returns the error of fn, the error of the context or
+// ErrWatchClosed.
+func (c *Client) Watch(ctx context.Context, prefix string, fn func(Event) error) error {
+	resp, err := c.stream(ctx, "/db/_watch?"+url.Values{"prefix": {prefix}}.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event Event
+		if err := dec.Decode(&event); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == io.EOF {
+				return ErrWatchClosed
+			}
+			return fmt.Errorf("%w: %v", ErrWatchClosed, err)
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+}
+
+// Stats are the counters of the store, see datastore.Stats.
+type Stats struct {
+	RawValueBytes    int64   `json:"raw_value_bytes"`
+	StoredValueBytes int64   `json:"stored_value_bytes"`
+	CompressionRatio float64 `json:"compression_ratio"`
+	CacheHits        int64   `json:"cache_hits"`
+	CacheMisses      int64   `json:"cache_misses"`
+	CacheBytes       int64   `json:"cache_bytes"`
+}
+
+func (c *Client) Stats(ctx context.Context) (Stats, error) {
+	var s Stats
+	err := c.do(ctx, http.MethodGet, "/admin/stats", nil, &s)
+	return s, err
+}
+
+// Compact merges the sealed segments of the store and waits for it. It
+// returns ErrConflict if a compaction is already running.
+func (c *Client) Compact(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/admin/compact", nil, nil)
+}
+
+// Backup writes the tar archive of a consistent copy of the store to w. The
+// archive can be restored with datastore.RestoreBackup. It returns
+// ErrBadArchive if the archive does not end with the end-of-archive blocks,
+// which the server writes only once the whole backup is sent.
+func (c *Client) Backup(ctx context.Context, w io.Writer) error {
+	resp, err := c.stream(ctx, "/admin/backup")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	archive := &countingReader{r: io.TeeReader(resp.Body, w)}
+	if err := checkArchive(archive); err != nil {
+		return err
+	}
+	// Anything after the end of the archive is padding, it is kept as is.
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// checkArchive reads the tar archive up to its end. The tar reader also
+// stops at an end of input between two entries, so the two zero blocks
+// which end the archive are checked to be read after the last entry.
+func checkArchive(archive *countingReader) error {
+	const endBlocks = 2 * 512
+	tr := tar.NewReader(archive)
+	var dataEnd int64
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("%w: %s", ErrBadArchive, err)
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return fmt.Errorf("%w: %s", ErrBadArchive, err)
+		}
+		dataEnd = archive.n
+	}
+	if archive.n-dataEnd < endBlocks {
+		return fmt.Errorf("%w: the archive is truncated", ErrBadArchive)
+	}
+	return nil
+}
+
+// stream opens a GET response which is read for as long as the context
+// allows, so the timeout applies to none of the attempts.
+func (c *Client) stream(ctx context.Context, path string) (*http.Response, error) {
+	var resp *http.Response
+	err := c.retry(ctx, func() (err error) {
+		resp, err = c.send(ctx, http.MethodGet, path, nil, nil)
+		return err
+	})
+	return resp, err
+}
+
+// do sends the request with the JSON body in, if it is not nil, and decodes
+// the JSON response into out, if it is not nil.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	return c.doWithHeader(ctx, method, path, nil, in, out)
+}
+
+func (c *Client) doWithHeader(ctx context.Context, method, path string, header http.Header, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	return c.retry(ctx, func() error {
+		ctx := ctx
+		if c.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+		}
+		resp, err := c.send(ctx, method, path, header, body)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if out == nil {
+			return nil
+		}
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("db: cannot decode the response of %s %s: %w", method, path, err)
+		}
+		return nil
+	})
+}
+
+// retry calls fn until it succeeds, fails with an error which is not
+// temporary, or the retries run out.
+func (c *Client) retry(ctx context.Context, fn func() error) error {
+	wait := c.backoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == c.retries || ctx.Err() != nil || !temporary(err) {
+			return err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		wait *= 2
+	}
+}
+
+func temporary(err error) bool {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.temporary()
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// send returns the response of a successful request or the *Error decoded
+// from the error response.
+func (c *Client) send(ctx context.Context, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, r)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, readError(resp)
+}
+
+func readError(resp *http.Response) error {
+	apiErr := &Error{
+		StatusCode: resp.StatusCode,
+		RequestID:  resp.Header.Get(RequestIDHeader),
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	var body ErrorResponse
+	if json.Unmarshal(data, &body) == nil && body.Code != "" {
+		apiErr.Code, apiErr.Message = body.Code, body.Message
+		if body.RequestID != "" {
+			apiErr.RequestID = body.RequestID
+		}
+		return apiErr
+	}
+	// The error did not come from the db server, a proxy may have sent it.
+	apiErr.Message = strings.TrimSpace(string(data))
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+	return apiErr
+}
@@ -0,0 +1,176 @@
+package dbclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	for _, baseURL := range []string{"", "db:8083", "ftp://db", "http://"} {
+		if _, err := New(baseURL); err == nil {
+			t.Errorf("Expected an error for %q", baseURL)
+		}
+	}
+	if _, err := New("http://db:8083", WithRetries(-1, 0)); err == nil {
+		t.Error("Expected an error for negative retries")
+	}
+	if _, err := New("http://db:8083", WithTimeout(-time.Second)); err == nil {
+		t.Error("Expected an error for a negative timeout")
+	}
+	c, err := New("http://db:8083/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.baseURL != "http://db:8083" {
+		t.Errorf("Unexpected base URL %s", c.baseURL)
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/db/missing":
+			rw.Header().Set("X-Request-Id", "header-id")
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte(`{"code":"not_found","message":"record does not exist","request_id":"r1"}`))
+		case "/db/proxy":
+			http.Error(rw, "no healthy servers", http.StatusBadGateway)
+		case "/db/garbage":
+			rw.Write([]byte("{"))
+		}
+	}))
+	defer server.Close()
+	c, err := New(server.URL, WithRetries(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	_, err = c.Get(ctx, "missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || apiErr.RequestID != "r1" {
+		t.Errorf("Unexpected error %#v", err)
+	}
+	if errors.Is(err, ErrConflict) {
+		t.Error("Not found must not match ErrConflict")
+	}
+
+	_, err = c.Get(ctx, "proxy")
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway || apiErr.Code != "" || apiErr.Message != "no healthy servers" {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	if _, err := c.Get(ctx, "garbage"); err == nil {
+		t.Error("Expected a decoding error")
+	}
+}
+
+func TestClient_Retries(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		n := calls.Add(1)
+		switch req.URL.Path {
+		case "/db/flaky":
+			if n < 3 {
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			rw.Write([]byte(`{"key":"flaky","value":"v"}`))
+		case "/db/corrupted":
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte(`{"code":"corrupted_record","message":"corrupted record"}`))
+		case "/db/slow":
+			time.Sleep(50 * time.Millisecond)
+			rw.Write([]byte(`{"key":"slow","value":"v"}`))
+		}
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	c, err := New(server.URL, WithRetries(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.Get(ctx, "flaky"); err != nil || value != "v" {
+		t.Errorf("Expected the third attempt to succeed, got %q, %v", value, err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("Expected 3 calls, got %d", calls.Load())
+	}
+
+	calls.Store(0)
+	if _, err := c.Get(ctx, "corrupted"); !errors.Is(err, ErrCorruptedRecord) {
+		t.Errorf("Expected ErrCorruptedRecord, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected a corrupted record not to be retried, got %d calls", calls.Load())
+	}
+
+	calls.Store(0)
+	c, err = New(server.URL, WithRetries(1, time.Millisecond), WithTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "slow"); err == nil {
+		t.Error("Expected a timeout")
+	}
+	if calls.Load() != 2 {
+		t.Errorf("Expected the timed out request to be retried once, got %d calls", calls.Load())
+	}
+
+	calls.Store(0)
+	c, err = New(server.URL, WithRetries(5, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.Get(ctx, "flaky"); err != context.DeadlineExceeded {
+		t.Errorf("Expected the backoff to stop with the context, got %v", err)
+	}
+}
+
+func TestClient_Backup(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: "current-data0", Mode: 0o600, Size: 4})
+	tw.Write([]byte("data"))
+	tw.Close()
+
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(body)
+	}))
+	defer server.Close()
+	c, err := New(server.URL, WithRetries(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body = archive.Bytes()
+	var out bytes.Buffer
+	if err := c.Backup(context.Background(), &out); err != nil || !bytes.Equal(out.Bytes(), body) {
+		t.Errorf("Unexpected backup of %d bytes, %v", out.Len(), err)
+	}
+	for name, b := range map[string][]byte{
+		"cut after the last file": archive.Bytes()[:archive.Len()-1024],
+		"cut in a file":           archive.Bytes()[:514],
+		"not an archive":          []byte("garbage"),
+	} {
+		body = b
+		if err := c.Backup(context.Background(), io.Discard); !errors.Is(err, ErrBadArchive) {
+			t.Errorf("%s: expected ErrBadArchive, got %v", name, err)
+		}
+	}
+}
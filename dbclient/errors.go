@@ -0,0 +1,90 @@
+package dbclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// RequestIDHeader carries the id of a request. The servers set it on every
+// response and repeat it in the error responses.
+const RequestIDHeader = "X-Request-Id"
+
+// ErrorResponse is the body of every failed request to the db servers and
+// the router.
+type ErrorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+// WriteError writes the error response with the request id set on rw.
+func WriteError(rw http.ResponseWriter, status int, code, message string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(ErrorResponse{
+		Code:      code,
+		Message:   message,
+		RequestID: rw.Header().Get(RequestIDHeader),
+	})
+}
+
+// The errors reported by the server, they mirror the errors of the datastore
+// package. Test for them with errors.Is.
+var (
+	ErrNotFound        = errors.New("record does not exist")
+	ErrInvalidKey      = errors.New("invalid key")
+	ErrTooLarge        = errors.New("value is too large")
+	ErrConflict        = errors.New("conflicting value")
+	ErrCorruptedRecord = errors.New("corrupted record")
+	ErrNotImplemented  = errors.New("not supported by the store")
+	ErrStaleVersion    = errors.New("a newer version is stored")
+	// ErrWatchClosed is returned by Watch when the server ends the stream,
+	// because it shuts down or the watcher fell behind the writes.
+	ErrWatchClosed = errors.New("watch stream closed by the server")
+)
+
+// ErrBadArchive is returned by Backup when the archive is cut short or is
+// not a tar archive.
+var ErrBadArchive = errors.New("bad backup archive")
+
+var codeErrors = map[string]error{
+	"not_found":        ErrNotFound,
+	"invalid_key":      ErrInvalidKey,
+	"too_large":        ErrTooLarge,
+	"conflict":         ErrConflict,
+	"corrupted_record": ErrCorruptedRecord,
+	"not_implemented":  ErrNotImplemented,
+	"stale_version":    ErrStaleVersion,
+}
+
+// Error is a failed request, decoded from the error response of the server.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestID  string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("db: status %d: %s", e.StatusCode, e.Message)
+	if e.Code != "" {
+		msg = fmt.Sprintf("db: %s: %s", e.Code, e.Message)
+	}
+	if e.RequestID != "" {
+		msg += " (request " + e.RequestID + ")"
+	}
+	return msg
+}
+
+// Is reports whether the error has the code of the target error.
+func (e *Error) Is(target error) bool {
+	err, ok := codeErrors[e.Code]
+	return ok && err == target
+}
+
+// temporary reports whether the request may succeed if it is retried.
+func (e *Error) temporary() bool {
+	return e.StatusCode >= 500 && e.StatusCode != 501 && e.Code != "corrupted_record"
+}